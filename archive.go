@@ -0,0 +1,291 @@
+package zwibserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Archive stores documents before they expire, so that they can be restored
+// if they are opened again. Give one to a database using its SetArchive method.
+//
+// With an archive, a document is only removed from the database after it has
+// been stored. GetDocument restores the document from the archive when it is
+// not in the database, and DeleteDocument removes it from both.
+type Archive interface {
+	// StoreDocument saves the document, replacing any earlier copy.
+	StoreDocument(ctx context.Context, doc *ArchivedDocument) error
+
+	// LoadDocument returns the document, or ErrMissing if it is not archived.
+	LoadDocument(ctx context.Context, docID string) (*ArchivedDocument, error)
+
+	// DeleteDocument removes the document from the archive, if it is there.
+	DeleteDocument(ctx context.Context, docID string) error
+}
+
+// archiveSetter is implemented by document databases that can archive
+// expired documents.
+type archiveSetter interface {
+	SetArchive(archive Archive)
+}
+
+// SetArchive makes the DocumentDB store documents in the archive before they
+// expire, instead of deleting them. It returns an error if the DocumentDB does
+// not have a SetArchive(Archive) method. All of the included databases have one.
+func (zh *Handler) SetArchive(archive Archive) error {
+	setter, ok := zh.db.db.(archiveSetter)
+	if !ok {
+		return fmt.Errorf("the %s database does not support archiving", backendName(zh.db.db))
+	}
+	setter.SetArchive(archive)
+	return nil
+}
+
+// ArchivedDocument is a document and its keys, as stored in an Archive.
+type ArchivedDocument struct {
+	DocID    string
+	Data     []byte
+	Keys     []Key
+	Archived time.Time
+}
+
+// ObjectStore is the interface to an S3-compatible storage service, used by
+// ObjectStoreArchive. Adapt the client library of your storage provider to it.
+type ObjectStore interface {
+	// PutObject creates or replaces the object.
+	PutObject(ctx context.Context, name string, data []byte) error
+
+	// GetObject returns the contents of the object, or ErrMissing.
+	GetObject(ctx context.Context, name string) ([]byte, error)
+
+	// DeleteObject removes the object. It is not an error if it does not exist.
+	DeleteObject(ctx context.Context, name string) error
+}
+
+// Version of the format of archived documents
+const archiveFormatVersion = 1
+
+// archiveRecord is the format of an archived document. It is stored as gzipped JSON.
+type archiveRecord struct {
+	Version  int    `json:"version"`
+	DocID    string `json:"docID"`
+	Archived int64  `json:"archived"`
+	Keys     []Key  `json:"keys"`
+	Data     []byte `json:"data"`
+}
+
+var errArchiveFormat = errors.New("unsupported archive format")
+
+func encodeArchivedDocument(doc *ArchivedDocument) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	err := json.NewEncoder(zw).Encode(archiveRecord{
+		Version:  archiveFormatVersion,
+		DocID:    doc.DocID,
+		Archived: doc.Archived.Unix(),
+		Keys:     doc.Keys,
+		Data:     doc.Data,
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	return buf.Bytes(), err
+}
+
+func decodeArchivedDocument(data []byte) (*ArchivedDocument, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var record archiveRecord
+	if err := json.NewDecoder(zr).Decode(&record); err != nil {
+		return nil, err
+	}
+	if record.Version != archiveFormatVersion {
+		return nil, fmt.Errorf("%w: version %d", errArchiveFormat, record.Version)
+	}
+
+	return &ArchivedDocument{
+		DocID:    record.DocID,
+		Data:     record.Data,
+		Keys:     record.Keys,
+		Archived: time.Unix(record.Archived, 0),
+	}, nil
+}
+
+// archiveName returns the name of the file or object of the document. The
+// document ID is hashed so that it is safe to use in a path.
+func archiveName(docID string) string {
+	hash := sha256.Sum256([]byte(docID))
+	name := hex.EncodeToString(hash[:])
+	return name[:2] + "/" + name + ".zwa"
+}
+
+// DirectoryArchive stores archived documents as files in a directory.
+type DirectoryArchive struct {
+	dir string
+}
+
+// NewDirectoryArchive returns an Archive that stores documents in the directory,
+// creating it if necessary.
+func NewDirectoryArchive(dir string) (*DirectoryArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirectoryArchive{dir: dir}, nil
+}
+
+func (a *DirectoryArchive) path(docID string) string {
+	return filepath.Join(a.dir, filepath.FromSlash(archiveName(docID)))
+}
+
+// StoreDocument ...
+func (a *DirectoryArchive) StoreDocument(ctx context.Context, doc *ArchivedDocument) error {
+	contents, err := encodeArchivedDocument(doc)
+	if err != nil {
+		return err
+	}
+
+	path := a.path(doc.DocID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFile(path, contents)
+}
+
+// LoadDocument ...
+func (a *DirectoryArchive) LoadDocument(ctx context.Context, docID string) (*ArchivedDocument, error) {
+	contents, err := ioutil.ReadFile(a.path(docID))
+	if os.IsNotExist(err) {
+		return nil, ErrMissing
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeArchivedDocument(contents)
+}
+
+// DeleteDocument ...
+func (a *DirectoryArchive) DeleteDocument(ctx context.Context, docID string) error {
+	err := os.Remove(a.path(docID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ObjectStoreArchive stores archived documents in an S3-compatible object store.
+type ObjectStoreArchive struct {
+	store  ObjectStore
+	prefix string
+}
+
+// NewObjectStoreArchive returns an Archive that stores each document as an
+// object whose name begins with prefix, eg. "zwibbler-archive/".
+func NewObjectStoreArchive(store ObjectStore, prefix string) *ObjectStoreArchive {
+	return &ObjectStoreArchive{
+		store:  store,
+		prefix: prefix,
+	}
+}
+
+// StoreDocument ...
+func (a *ObjectStoreArchive) StoreDocument(ctx context.Context, doc *ArchivedDocument) error {
+	contents, err := encodeArchivedDocument(doc)
+	if err != nil {
+		return err
+	}
+	return a.store.PutObject(ctx, a.prefix+archiveName(doc.DocID), contents)
+}
+
+// LoadDocument ...
+func (a *ObjectStoreArchive) LoadDocument(ctx context.Context, docID string) (*ArchivedDocument, error) {
+	contents, err := a.store.GetObject(ctx, a.prefix+archiveName(docID))
+	if err != nil {
+		return nil, err
+	}
+	return decodeArchivedDocument(contents)
+}
+
+// DeleteDocument ...
+func (a *ObjectStoreArchive) DeleteDocument(ctx context.Context, docID string) error {
+	return a.store.DeleteObject(ctx, a.prefix+archiveName(docID))
+}
+
+// archiveDocument stores the document in the archive before it is removed
+// from the database.
+func archiveDocument(ctx context.Context, archive Archive, l *logger, docID string, data []byte, keys []Key) error {
+	err := archive.StoreDocument(ctx, &ArchivedDocument{
+		DocID:    docID,
+		Data:     data,
+		Keys:     keys,
+		Archived: time.Now(),
+	})
+	if err != nil {
+		l.error("cannot archive document", field(fieldDocument, docID), field(fieldError, err))
+		return err
+	}
+	l.info("archived expired document", field(fieldDocument, docID), field("bytes", len(data)))
+	return nil
+}
+
+// getOrRestore is used by the GetDocument method of databases with an archive.
+// It calls get to retrieve the document, but if the document does not exist,
+// it is restored from the archive before it would be created. The keys are
+// restored using setKey.
+func getOrRestore(ctx context.Context, archive Archive, l *logger, docID string, mode CreateMode, initialData []byte,
+	get func(mode CreateMode, initialData []byte) ([]byte, bool, error),
+	setKey func(key Key) error) ([]byte, bool, error) {
+
+	if archive == nil {
+		return get(mode, initialData)
+	}
+
+	if mode != AlwaysCreate {
+		doc, created, err := get(NeverCreate, nil)
+		if err != ErrMissing {
+			return doc, created, err
+		}
+	}
+
+	archived, err := archive.LoadDocument(ctx, docID)
+	if err == ErrMissing {
+		return get(mode, initialData)
+	} else if err != nil {
+		return nil, false, err
+	} else if mode == AlwaysCreate {
+		return nil, false, ErrExists
+	}
+
+	_, _, err = get(AlwaysCreate, archived.Data)
+	if err == ErrExists {
+		// it was restored by someone else.
+		return get(NeverCreate, nil)
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	for _, key := range archived.Keys {
+		if err := setKey(key); err != nil && err != ErrConflict {
+			return nil, false, err
+		}
+	}
+
+	l.info("restored archived document", field(fieldDocument, docID), field("bytes", len(archived.Data)),
+		field("archived", archived.Archived.Format(time.RFC3339)))
+
+	// It is archived again when it expires.
+	if err := archive.DeleteDocument(ctx, docID); err != nil {
+		l.warn("cannot remove restored document from archive", field(fieldDocument, docID), field(fieldError, err))
+	}
+	return archived.Data, false, nil
+}
@@ -0,0 +1,121 @@
+package zwibserve
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryObjectStore is an ObjectStore that keeps the objects in memory.
+type memoryObjectStore struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemoryObjectStore() *memoryObjectStore {
+	return &memoryObjectStore{objects: make(map[string][]byte)}
+}
+
+func (s *memoryObjectStore) PutObject(ctx context.Context, name string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *memoryObjectStore) GetObject(ctx context.Context, name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return nil, ErrMissing
+	}
+	return data, nil
+}
+
+func (s *memoryObjectStore) DeleteObject(ctx context.Context, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memoryObjectStore) names() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	return names
+}
+
+// expire makes the documents in the database old enough to be removed, and
+// removes them.
+func (db *MemoryDocumentDB) expire() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, doc := range db.docs {
+		doc.lastAccess = time.Now().Add(-time.Hour)
+	}
+	db.lastClean = time.Time{}
+	db.clean()
+}
+
+func TestObjectStoreArchive(t *testing.T) {
+	store := newMemoryObjectStore()
+	db := NewMemoryDB().(*MemoryDocumentDB)
+	db.SetLogger(NewStdLogger(LogError))
+	db.SetArchive(NewObjectStoreArchive(store, "archive/"))
+	db.SetExpiration(60)
+
+	if _, _, err := db.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	key := Key{1, "name", "value"}
+	if err := db.SetDocumentKey("doc", 0, key); err != nil {
+		t.Fatal(err)
+	}
+
+	db.expire()
+	names := store.names()
+	if len(names) != 1 || !strings.HasPrefix(names[0], "archive/") {
+		t.Fatalf("objects are %v, want one beginning with the prefix", names)
+	}
+	db.mutex.Lock()
+	_, ok := db.docs["doc"]
+	db.mutex.Unlock()
+	if ok {
+		t.Fatal("the expired document is still in the database")
+	}
+
+	// opening the document restores it.
+	if _, _, err := db.GetDocument("doc", AlwaysCreate, nil); err != ErrExists {
+		t.Errorf("creating an archived document: got %v, want ErrExists", err)
+	}
+	doc, created, err := db.GetDocument("doc", PossiblyCreate, []byte("new"))
+	if err != nil || created || string(doc) != "abc" {
+		t.Fatalf("restored document is %q, created=%v, %v", doc, created, err)
+	}
+	keys, err := db.GetDocumentKeys("doc")
+	if err != nil || len(keys) != 1 || keys[0] != key {
+		t.Errorf("restored keys are %v, %v", keys, err)
+	}
+	if names := store.names(); len(names) != 0 {
+		t.Errorf("restored document is still archived as %v", names)
+	}
+
+	// deleting it removes it from the archive too.
+	db.expire()
+	if err := db.DeleteDocument("doc"); err != nil {
+		t.Fatal(err)
+	}
+	if names := store.names(); len(names) != 0 {
+		t.Errorf("deleted document is still archived as %v", names)
+	}
+	if _, _, err := db.GetDocument("doc", NeverCreate, nil); err != ErrMissing {
+		t.Errorf("got %v, want ErrMissing", err)
+	}
+}
@@ -0,0 +1,664 @@
+package zwibserve
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltDocumentDB stores documents in a file using bbolt, an embedded
+// transactional key-value store written in go. Each change to a document is
+// stored as a separate chunk, so that appending does not rewrite the document.
+// Every transaction is synced to disk. Only one process may open the file at a
+// time.
+type BoltDocumentDB struct {
+	bolt       *bolt.DB
+	expiration int64
+	log        *logger
+	archive    Archive
+
+	cleanMutex sync.Mutex
+	lastClean  time.Time
+}
+
+// The buckets:
+//
+//	docs:   docID -> last access time (8 bytes), length (8 bytes)
+//	chunks: docID prefix, offset (8 bytes) -> data
+//	keys:   docID prefix, name -> Key as JSON
+//	tokens: tokenID -> boltToken as JSON
+//	users:  userID prefix, tokenID -> empty
+//	meta:   docID -> boltDocMeta as JSON
+//
+// A prefix is the length of the ID (4 bytes) followed by the ID, so that one
+// ID cannot be the beginning of another.
+var (
+	boltDocs   = []byte("docs")
+	boltChunks = []byte("chunks")
+	boltKeys   = []byte("keys")
+	boltTokens = []byte("tokens")
+	boltUsers  = []byte("users")
+	boltMeta   = []byte("meta")
+)
+
+// Chunks of a document are merged when it is read and has more than this many.
+const boltMaxChunks = 64
+
+type boltToken struct {
+	DocID       string `json:"docID"`
+	UserID      string `json:"userID"`
+	Permissions string `json:"permissions"`
+	Expiration  int64  `json:"expiration"`
+}
+
+// boltDocMeta is the DocumentInfo of a document, apart from its length.
+type boltDocMeta struct {
+	Created    int64  `json:"created"`
+	Creator    string `json:"creator"`
+	Modified   int64  `json:"modified"`
+	LastWriter string `json:"lastWriter"`
+	Appends    int64  `json:"appends"`
+}
+
+// NewBoltDB opens or creates the database file.
+func NewBoltDB(path string) (*BoltDocumentDB, error) {
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltDocs, boltChunks, boltKeys, boltTokens, boltUsers, boltMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return &BoltDocumentDB{
+		bolt: b,
+		log:  newLogger(nil),
+	}, nil
+}
+
+// SetLogger sets the destination of log messages.
+func (db *BoltDocumentDB) SetLogger(l Logger) {
+	db.log.setOutput(l)
+}
+
+// SetArchive sets where documents are stored before they expire.
+func (db *BoltDocumentDB) SetArchive(archive Archive) {
+	db.archive = archive
+}
+
+// SetExpiration ...
+func (db *BoltDocumentDB) SetExpiration(seconds int64) {
+	db.expiration = seconds
+	db.cleanMutex.Lock()
+	db.lastClean = time.Time{}
+	db.cleanMutex.Unlock()
+}
+
+// CheckHealth ...
+func (db *BoltDocumentDB) CheckHealth() error {
+	return db.bolt.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// Close closes the database file.
+func (db *BoltDocumentDB) Close() error {
+	return db.bolt.Close()
+}
+
+func boltPrefix(id string) []byte {
+	prefix := make([]byte, 4+len(id))
+	binary.BigEndian.PutUint32(prefix, uint32(len(id)))
+	copy(prefix[4:], id)
+	return prefix
+}
+
+func boltChunkKey(docID string, offset uint64) []byte {
+	key := boltPrefix(docID)
+	key = append(key, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(key[len(key)-8:], offset)
+	return key
+}
+
+func boltDocInfo(lastAccess int64, length uint64) []byte {
+	info := make([]byte, 16)
+	binary.BigEndian.PutUint64(info, uint64(lastAccess))
+	binary.BigEndian.PutUint64(info[8:], length)
+	return info
+}
+
+// boltLength returns the length of the document, and whether it exists.
+func boltLength(tx *bolt.Tx, docID string) (uint64, bool) {
+	info := tx.Bucket(boltDocs).Get([]byte(docID))
+	if info == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(info[8:]), true
+}
+
+// deletePrefix deletes the keys in the bucket that begin with the prefix.
+func deletePrefix(bucket *bolt.Bucket, prefix []byte) error {
+	c := bucket.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDocument stores a new document.
+func (db *BoltDocumentDB) createDocument(tx *bolt.Tx, docID string, contents []byte, creator string) error {
+	now := time.Now().Unix()
+	err := tx.Bucket(boltDocs).Put([]byte(docID), boltDocInfo(now, uint64(len(contents))))
+	if err == nil && len(contents) > 0 {
+		err = tx.Bucket(boltChunks).Put(boltChunkKey(docID, 0), contents)
+	}
+	if err == nil {
+		err = putBoltMeta(tx, docID, boltDocMeta{
+			Created:    now,
+			Creator:    creator,
+			Modified:   now,
+			LastWriter: creator,
+		})
+	}
+	return err
+}
+
+// getBoltMeta returns the metadata of the document, which is empty for
+// documents created before it was recorded.
+func getBoltMeta(tx *bolt.Tx, docID string) (boltDocMeta, error) {
+	var meta boltDocMeta
+	value := tx.Bucket(boltMeta).Get([]byte(docID))
+	if value == nil {
+		return meta, nil
+	}
+	err := json.Unmarshal(value, &meta)
+	return meta, err
+}
+
+func putBoltMeta(tx *bolt.Tx, docID string, meta boltDocMeta) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltMeta).Put([]byte(docID), value)
+}
+
+// readChunks returns the contents of the document, merging its chunks into
+// one if there are too many.
+func (db *BoltDocumentDB) readChunks(tx *bolt.Tx, docID string) ([]byte, error) {
+	bucket := tx.Bucket(boltChunks)
+	prefix := boltPrefix(docID)
+
+	doc := []byte{}
+	count := 0
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		doc = append(doc, v...)
+		count++
+	}
+
+	if count > boltMaxChunks && tx.Writable() {
+		if err := deletePrefix(bucket, prefix); err != nil {
+			return nil, err
+		}
+		if err := bucket.Put(boltChunkKey(docID, 0), doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// GetDocument ...
+func (db *BoltDocumentDB) GetDocument(docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	return db.getDocumentByUser(docID, mode, initialData, "")
+}
+
+func (db *BoltDocumentDB) getDocumentByUser(docID string, mode CreateMode, initialData []byte, userID string) ([]byte, bool, error) {
+	db.log.debug("GetDocument", field(fieldDocument, docID))
+	db.clean()
+
+	return getOrRestore(context.Background(), db.archive, db.log, docID, mode, initialData,
+		func(mode CreateMode, initialData []byte) ([]byte, bool, error) {
+			return db.getDocument(docID, mode, initialData, userID)
+		}, func(key Key) error {
+			return db.SetDocumentKey(docID, 0, key)
+		})
+}
+
+func (db *BoltDocumentDB) getDocument(docID string, mode CreateMode, initialData []byte, userID string) ([]byte, bool, error) {
+	var doc []byte
+	created := false
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		length, exists := boltLength(tx, docID)
+		if !exists && mode == NeverCreate {
+			return ErrMissing
+		} else if exists && mode == AlwaysCreate {
+			return ErrExists
+		}
+
+		if !exists {
+			doc = initialData
+			created = true
+			return db.createDocument(tx, docID, initialData, userID)
+		}
+
+		err := tx.Bucket(boltDocs).Put([]byte(docID), boltDocInfo(time.Now().Unix(), length))
+		if err != nil {
+			return err
+		}
+
+		doc, err = db.readChunks(tx, docID)
+		return err
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+	return doc, created, nil
+}
+
+// AppendDocument ...
+func (db *BoltDocumentDB) AppendDocument(docID string, oldLength uint64, newData []byte) (uint64, error) {
+	return db.appendDocumentByUser(docID, oldLength, newData, "")
+}
+
+func (db *BoltDocumentDB) appendDocumentByUser(docID string, oldLength uint64, newData []byte, userID string) (uint64, error) {
+	db.log.debug("AppendDocument", field(fieldDocument, docID), field("bytes", len(newData)))
+	db.clean()
+
+	var length uint64
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		var exists bool
+		length, exists = boltLength(tx, docID)
+		if !exists {
+			return ErrMissing
+		} else if length != oldLength {
+			return ErrConflict
+		}
+
+		now := time.Now().Unix()
+		if len(newData) > 0 {
+			if err := tx.Bucket(boltChunks).Put(boltChunkKey(docID, oldLength), newData); err != nil {
+				return err
+			}
+
+			meta, err := getBoltMeta(tx, docID)
+			if err != nil {
+				return err
+			}
+			meta.Modified = now
+			meta.LastWriter = userID
+			meta.Appends++
+			if err := putBoltMeta(tx, docID, meta); err != nil {
+				return err
+			}
+		}
+
+		length = oldLength + uint64(len(newData))
+		return tx.Bucket(boltDocs).Put([]byte(docID), boltDocInfo(now, length))
+	})
+
+	if err != nil && err != ErrConflict {
+		return 0, err
+	}
+	return length, err
+}
+
+// SetDocumentKey ...
+func (db *BoltDocumentDB) SetDocumentKey(docID string, oldVersion int, key Key) error {
+	value, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	name := append(boltPrefix(docID), key.Name...)
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltKeys)
+		if existing := bucket.Get(name); existing != nil {
+			var current Key
+			if err := json.Unmarshal(existing, &current); err != nil {
+				return err
+			}
+			if current.Version != oldVersion {
+				return ErrConflict
+			}
+		} else if oldVersion != 0 {
+			return ErrConflict
+		}
+
+		return bucket.Put(name, value)
+	})
+}
+
+// GetDocumentKeys ...
+func (db *BoltDocumentDB) GetDocumentKeys(docID string) ([]Key, error) {
+	var keys []Key
+	prefix := boltPrefix(docID)
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltKeys).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var key Key
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// DeleteDocument ...
+func (db *BoltDocumentDB) DeleteDocument(docID string) error {
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		return deleteBoltDocument(tx, docID)
+	})
+	if err == nil && db.archive != nil {
+		err = db.archive.DeleteDocument(context.Background(), docID)
+	}
+	return err
+}
+
+// ListDocuments ...
+func (db *BoltDocumentDB) ListDocuments(ctx context.Context, fn func(docID string) error) error {
+	var docIDs []string
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDocs).ForEach(func(k, v []byte) error {
+			docIDs = append(docIDs, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return listEach(ctx, docIDs, fn)
+}
+
+// ListTokens ...
+func (db *BoltDocumentDB) ListTokens(ctx context.Context, fn func(token TokenInfo) error) error {
+	now := time.Now().Unix()
+	var tokens []TokenInfo
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokens).ForEach(func(k, v []byte) error {
+			var token boltToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			if now < token.Expiration {
+				tokens = append(tokens, TokenInfo{string(k), token.DocID, token.UserID, token.Permissions, token.Expiration})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return listTokensEach(ctx, tokens, fn)
+}
+
+func deleteBoltDocument(tx *bolt.Tx, docID string) error {
+	if err := tx.Bucket(boltDocs).Delete([]byte(docID)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltMeta).Delete([]byte(docID)); err != nil {
+		return err
+	}
+	if err := deletePrefix(tx.Bucket(boltChunks), boltPrefix(docID)); err != nil {
+		return err
+	}
+	return deletePrefix(tx.Bucket(boltKeys), boltPrefix(docID))
+}
+
+// AddToken ...
+func (db *BoltDocumentDB) AddToken(tokenID, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	value, err := json.Marshal(boltToken{
+		DocID:       docID,
+		UserID:      userID,
+		Permissions: permissions,
+		Expiration:  expirationSeconds,
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(boltTokens)
+		if tokens.Get([]byte(tokenID)) != nil {
+			return ErrExists
+		}
+
+		if len(contents) > 0 {
+			if _, exists := boltLength(tx, docID); exists {
+				return ErrConflict
+			}
+			if err := db.createDocument(tx, docID, contents, userID); err != nil {
+				return err
+			}
+		}
+
+		if err := tokens.Put([]byte(tokenID), value); err != nil {
+			return err
+		}
+		return tx.Bucket(boltUsers).Put(append(boltPrefix(userID), tokenID...), []byte{})
+	})
+}
+
+// GetDocumentInfo ...
+func (db *BoltDocumentDB) GetDocumentInfo(ctx context.Context, docID string) (DocumentInfo, error) {
+	info := DocumentInfo{DocID: docID}
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		length, exists := boltLength(tx, docID)
+		if !exists {
+			return ErrMissing
+		}
+
+		meta, err := getBoltMeta(tx, docID)
+		if err != nil {
+			return err
+		}
+		info.Length = length
+		info.Creator = meta.Creator
+		info.LastWriter = meta.LastWriter
+		info.Appends = meta.Appends
+		if meta.Created != 0 {
+			info.Created = time.Unix(meta.Created, 0)
+		}
+		if meta.Modified != 0 {
+			info.Modified = time.Unix(meta.Modified, 0)
+		}
+		return nil
+	})
+	return info, err
+}
+
+// GetToken ...
+func (db *BoltDocumentDB) GetToken(tokenID string) (docID, userID, permissions string, err error) {
+	var token boltToken
+	err = db.bolt.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltTokens).Get([]byte(tokenID))
+		if value == nil {
+			return ErrMissing
+		}
+		return json.Unmarshal(value, &token)
+	})
+
+	if err == nil && time.Now().Unix() >= token.Expiration {
+		err = ErrMissing
+	}
+	if err != nil {
+		return
+	}
+	return token.DocID, token.UserID, token.Permissions, nil
+}
+
+// UpdateUser ...
+func (db *BoltDocumentDB) UpdateUser(userID, permissions string) error {
+	prefix := boltPrefix(userID)
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(boltTokens)
+		c := tx.Bucket(boltUsers).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			tokenID := k[len(prefix):]
+			value := tokens.Get(tokenID)
+			if value == nil {
+				continue
+			}
+
+			var token boltToken
+			if err := json.Unmarshal(value, &token); err != nil {
+				return err
+			}
+
+			db.log.debug("update permissions", field(fieldToken, string(tokenID)), field(fieldUser, userID), field("permissions", permissions))
+			token.Permissions = permissions
+			value, err := json.Marshal(token)
+			if err != nil {
+				return err
+			}
+			if err = tokens.Put(tokenID, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// clean removes expired documents and tokens, at most once an hour.
+func (db *BoltDocumentDB) clean() {
+	db.cleanMutex.Lock()
+	defer db.cleanMutex.Unlock()
+	if time.Since(db.lastClean).Minutes() < 60 {
+		return
+	}
+	db.lastClean = time.Now()
+
+	var archiveDocs []string
+	var cutoff int64
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		now := time.Now().Unix()
+
+		var expiredTokens []boltToken
+		var expiredTokenIDs []string
+		err := tx.Bucket(boltTokens).ForEach(func(k, v []byte) error {
+			var token boltToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			if token.Expiration < now {
+				expiredTokens = append(expiredTokens, token)
+				expiredTokenIDs = append(expiredTokenIDs, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, token := range expiredTokens {
+			if err := tx.Bucket(boltTokens).Delete([]byte(expiredTokenIDs[i])); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltUsers).Delete(append(boltPrefix(token.UserID), expiredTokenIDs[i]...)); err != nil {
+				return err
+			}
+		}
+
+		seconds := db.expiration
+		if seconds == 0 || seconds == NoExpiration {
+			return nil
+		}
+
+		var expiredDocs []string
+		err = tx.Bucket(boltDocs).ForEach(func(k, v []byte) error {
+			if int64(binary.BigEndian.Uint64(v)) < now-seconds {
+				expiredDocs = append(expiredDocs, string(k))
+			}
+			return nil
+		})
+		if err != nil || db.archive != nil {
+			// Archived documents are removed afterward, so that the
+			// database is not locked while they are stored.
+			archiveDocs, cutoff = expiredDocs, now-seconds
+			return err
+		}
+
+		for _, docID := range expiredDocs {
+			db.log.info("remove expired document", field(fieldDocument, docID))
+			if err := deleteBoltDocument(tx, docID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err == nil && len(archiveDocs) > 0 {
+		err = db.archiveExpired(archiveDocs, cutoff)
+	}
+
+	if err != nil {
+		db.log.error("cannot remove expired documents", field(fieldError, err))
+	}
+}
+
+// archiveExpired stores the documents in the archive, and removes them if they
+// have not been accessed since the cutoff. Documents that cannot be archived
+// are tried again at the next cleaning.
+func (db *BoltDocumentDB) archiveExpired(docIDs []string, cutoff int64) error {
+	for _, docID := range docIDs {
+		var data []byte
+		var found bool
+		err := db.bolt.View(func(tx *bolt.Tx) error {
+			var err error
+			if _, found = boltLength(tx, docID); found {
+				data, err = db.readChunks(tx, docID)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		} else if !found {
+			continue
+		}
+
+		keys, err := db.GetDocumentKeys(docID)
+		if err != nil {
+			return err
+		}
+
+		if archiveDocument(context.Background(), db.archive, db.log, docID, data, keys) != nil {
+			continue
+		}
+
+		err = db.bolt.Update(func(tx *bolt.Tx) error {
+			info := tx.Bucket(boltDocs).Get([]byte(docID))
+			if info == nil || int64(binary.BigEndian.Uint64(info)) >= cutoff {
+				// accessed since it was archived
+				return nil
+			}
+			db.log.info("remove expired document", field(fieldDocument, docID))
+			return deleteBoltDocument(tx, docID)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package zwibserve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Identifies the format of a DocumentBundle, and its current version
+const (
+	bundleFormat  = "zwibbler-document"
+	bundleVersion = 1
+)
+
+// DocumentBundle is a portable copy of a document and its persistent keys. It
+// is the JSON format produced by the exportDocument and exportDocuments
+// management methods and consumed by importDocuments.
+type DocumentBundle struct {
+	Format     string      `json:"format"`
+	Version    int         `json:"version"`
+	DocumentID string      `json:"documentID"`
+	Generation uint32      `json:"generation"`
+	Length     int         `json:"length"`
+	Exported   time.Time   `json:"exported"`
+	Keys       []BundleKey `json:"keys"`
+	Contents   []byte      `json:"contents"`
+}
+
+// BundleKey is a persistent key of a document in a DocumentBundle.
+type BundleKey struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Version int    `json:"version"`
+}
+
+var errBadBundle = errors.New("invalid document bundle")
+
+// exportBundle reads the document and its keys from the database.
+func exportBundle(ctx context.Context, db ContextDocumentDB, docID string) (*DocumentBundle, error) {
+	contents, _, err := db.GetDocumentContext(ctx, docID, NeverCreate, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := db.GetDocumentKeysContext(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &DocumentBundle{
+		Format:     bundleFormat,
+		Version:    bundleVersion,
+		DocumentID: docID,
+		Length:     len(contents),
+		Exported:   time.Now().UTC(),
+		Keys:       []BundleKey{},
+		Contents:   contents,
+	}
+	for _, key := range keys {
+		bundle.Keys = append(bundle.Keys, BundleKey{Name: key.Name, Value: key.Value, Version: key.Version})
+	}
+	return bundle, nil
+}
+
+// check returns an error if the bundle cannot be imported.
+func (b *DocumentBundle) check() error {
+	if b.Format != bundleFormat {
+		return fmt.Errorf("%w: format is %q", errBadBundle, b.Format)
+	} else if b.Version < 1 || b.Version > bundleVersion {
+		return fmt.Errorf("%w: unsupported version %d", errBadBundle, b.Version)
+	} else if b.DocumentID == "" {
+		return fmt.Errorf("%w: missing documentID", errBadBundle)
+	} else if b.Length != len(b.Contents) {
+		return fmt.Errorf("%w: %s has length %d but %d bytes of contents", errBadBundle,
+			b.DocumentID, b.Length, len(b.Contents))
+	}
+	return nil
+}
+
+// importBundle creates the document of the bundle in the database. If the
+// document exists, it returns ErrExists, unless replace is true, in which case
+// the existing document is deleted first.
+func importBundle(ctx context.Context, db ContextDocumentDB, b *DocumentBundle, replace bool) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+
+	_, _, err := db.GetDocumentContext(ctx, b.DocumentID, AlwaysCreate, b.Contents)
+	if err == ErrExists && replace {
+		if err = db.DeleteDocumentContext(ctx, b.DocumentID); err != nil {
+			return err
+		}
+		_, _, err = db.GetDocumentContext(ctx, b.DocumentID, AlwaysCreate, b.Contents)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, key := range b.Keys {
+		err = db.SetDocumentKeyContext(ctx, b.DocumentID, 0, Key{Name: key.Name, Value: key.Value, Version: key.Version})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateBundle brings an existing document up to date with the bundle. Since
+// documents only grow, the existing document must be the beginning of the
+// bundle's contents, or else ErrConflict is returned. The missing contents
+// are appended, and keys with newer versions are set. It returns the previous
+// length of the document, and the keys that were set.
+func updateBundle(ctx context.Context, db ContextDocumentDB, b *DocumentBundle) (uint64, []Key, error) {
+	if err := b.check(); err != nil {
+		return 0, nil, err
+	}
+
+	existing, _, err := db.GetDocumentContext(ctx, b.DocumentID, NeverCreate, nil)
+	if err != nil {
+		return 0, nil, err
+	} else if !bytes.HasPrefix(b.Contents, existing) {
+		return 0, nil, ErrConflict
+	}
+
+	offset := uint64(len(existing))
+	if len(existing) < len(b.Contents) {
+		if _, err = db.AppendDocumentContext(ctx, b.DocumentID, offset, b.Contents[offset:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	existingKeys, err := db.GetDocumentKeysContext(ctx, b.DocumentID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var updated []Key
+	for _, bk := range b.Keys {
+		oldVersion := 0
+		for _, k := range existingKeys {
+			if k.Name == bk.Name {
+				oldVersion = k.Version
+			}
+		}
+		if oldVersion != 0 && bk.Version <= oldVersion {
+			continue
+		}
+
+		key := Key{Name: bk.Name, Value: bk.Value, Version: bk.Version}
+		err = db.SetDocumentKeyContext(ctx, b.DocumentID, oldVersion, key)
+		if err == ErrConflict {
+			// changed by a client in the meantime
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+		updated = append(updated, key)
+	}
+	return offset, updated, nil
+}
+
+func (zh *Handler) handleExportDocument(w http.ResponseWriter, r *http.Request) {
+	zh.log.info("management request", field("method", "exportDocument"))
+	zh.verifyAuth(r)
+
+	docID := zh.mustGet(r, "documentID")
+	bundle, err := exportBundle(r.Context(), zh.db, docID)
+	if err == ErrMissing {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bundle)
+}
+
+// handleExportDocuments writes the bundle of every document, one per line.
+func (zh *Handler) handleExportDocuments(w http.ResponseWriter, r *http.Request) {
+	zh.log.info("management request", field("method", "exportDocuments"))
+	zh.verifyAuth(r)
+
+	lister, ok := zh.db.db.(DocumentLister)
+	if !ok {
+		HTTPPanic(501, "The database cannot list its documents")
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	count := 0
+
+	err := lister.ListDocuments(r.Context(), func(docID string) error {
+		bundle, err := exportBundle(r.Context(), zh.db, docID)
+		if err == ErrMissing {
+			// deleted since it was listed
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(bundle); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		count++
+		return nil
+	})
+
+	if err != nil {
+		// The response is incomplete, so the importer fails to parse the last line.
+		zh.log.error("export failed", field("documents", count), field(fieldError, err))
+		panic(http.ErrAbortHandler)
+	}
+	zh.log.info("exported documents", field("documents", count))
+}
+
+// importResult is the response of importDocuments.
+type importResult struct {
+	Imported  int      `json:"imported"`
+	Updated   int      `json:"updated"`
+	Existing  []string `json:"existing"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// handleImportDocuments creates documents from one or more bundles. They are
+// read from the body of the request, if its content type is JSON, or else from
+// the "bundle" parameter.
+func (zh *Handler) handleImportDocuments(w http.ResponseWriter, r *http.Request) {
+	zh.log.info("management request", field("method", "importDocuments"))
+	zh.verifyAuth(r)
+
+	replace := r.FormValue("replace") == "true"
+	update := r.FormValue("update") == "true"
+
+	var input io.Reader
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/json") || strings.HasPrefix(contentType, "application/x-ndjson") {
+		input = r.Body
+	} else if bundle := r.FormValue("bundle"); bundle != "" {
+		input = strings.NewReader(bundle)
+	} else {
+		file, _, err := r.FormFile("bundle")
+		if err != nil {
+			HTTPPanic(400, "Missing bundle")
+		}
+		defer file.Close()
+		input = file
+	}
+
+	result := importResult{Existing: []string{}, Conflicts: []string{}}
+	decoder := json.NewDecoder(input)
+	for {
+		var bundle DocumentBundle
+		err := decoder.Decode(&bundle)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			HTTPPanic(400, "After %d documents, error reading bundle: %v", result.Imported+len(result.Existing), err)
+		}
+
+		if replace {
+			zh.hub.signalDocumentDeleted(bundle.DocumentID)
+		}
+
+		err = importBundle(r.Context(), zh.db, &bundle, replace)
+		if err == ErrExists && update {
+			err = zh.updateFromBundle(r.Context(), &bundle)
+			if err == ErrConflict {
+				result.Conflicts = append(result.Conflicts, bundle.DocumentID)
+				continue
+			} else if err == nil {
+				result.Updated++
+				continue
+			}
+		}
+
+		if err == ErrExists {
+			result.Existing = append(result.Existing, bundle.DocumentID)
+			continue
+		} else if errors.Is(err, errBadBundle) {
+			HTTPPanic(400, "%v", err)
+		} else if err != nil {
+			zh.log.error("import failed", field(fieldDocument, bundle.DocumentID), field(fieldError, err))
+			panic(err)
+		}
+		result.Imported++
+	}
+
+	zh.log.info("imported documents", field("documents", result.Imported), field("updated", result.Updated),
+		field("existing", len(result.Existing)), field("conflicts", len(result.Conflicts)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// updateFromBundle updates the existing document, and sends the changes to
+// its clients.
+func (zh *Handler) updateFromBundle(ctx context.Context, b *DocumentBundle) error {
+	offset, keys, err := updateBundle(ctx, zh.db, b)
+	if err != nil {
+		return err
+	}
+
+	if offset < uint64(len(b.Contents)) {
+		zh.hub.Append(b.DocumentID, "", offset, b.Contents[offset:])
+	}
+	for _, key := range keys {
+		zh.hub.SetSessionKey(b.DocumentID, "", key)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package zwibserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newManagedHandler(db DocumentDB) *Handler {
+	zh := NewHandler(db)
+	zh.SetLogger(NewStdLogger(LogError))
+	zh.SetSecretUser("user", "secret")
+	return zh
+}
+
+// manage makes a management request. If body is not nil, it is sent as JSON
+// and the parameters are put in the URL.
+func manage(t *testing.T, zh *Handler, params url.Values, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	var r *http.Request
+	if body != nil {
+		r = httptest.NewRequest("POST", "/?"+params.Encode(), body)
+		r.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		r = httptest.NewRequest("POST", "/", strings.NewReader(params.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	r.SetBasicAuth("user", "secret")
+	w := httptest.NewRecorder()
+	zh.ServeHTTP(w, r)
+	return w
+}
+
+func mustImport(t *testing.T, zh *Handler, params url.Values, body io.Reader) importResult {
+	t.Helper()
+	params.Set("method", "importDocuments")
+	w := manage(t, zh, params, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("importDocuments: status %d: %s", w.Code, w.Body.String())
+	}
+	var result importResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func mustKeys(t *testing.T, db DocumentDB, docID string) string {
+	t.Helper()
+	keys, err := db.GetDocumentKeys(docID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(keys)
+}
+
+func TestExportImportDocument(t *testing.T) {
+	src := NewMemoryDB()
+	if _, _, err := src.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetDocumentKey("doc", 0, Key{1, "name", "value"}); err != nil {
+		t.Fatal(err)
+	}
+	from := newManagedHandler(src)
+
+	export := func() string {
+		w := manage(t, from, url.Values{"method": {"exportDocument"}, "documentID": {"doc"}}, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("exportDocument: status %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	if w := manage(t, from, url.Values{"method": {"exportDocument"}, "documentID": {"missing"}}, nil); w.Code != 404 {
+		t.Errorf("exporting a missing document: status %d", w.Code)
+	}
+
+	dst := NewMemoryDB()
+	to := newManagedHandler(dst)
+	bundle := export()
+	if result := mustImport(t, to, url.Values{"bundle": {bundle}}, nil); result.Imported != 1 {
+		t.Errorf("import result is %+v", result)
+	}
+	if got := mustGetDocument(t, dst, "doc"); got != "abc" {
+		t.Errorf("imported document is %q", got)
+	}
+	if got, want := mustKeys(t, dst, "doc"), mustKeys(t, src, "doc"); got != want {
+		t.Errorf("imported keys are %s, want %s", got, want)
+	}
+
+	// importing it again does not change it.
+	if result := mustImport(t, to, url.Values{"bundle": {bundle}}, nil); result.Imported != 0 || fmt.Sprint(result.Existing) != "[doc]" {
+		t.Errorf("import of an existing document: result is %+v", result)
+	}
+
+	// with update, the changes are copied.
+	if _, err := src.AppendDocument("doc", 3, []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetDocumentKey("doc", 1, Key{2, "name", "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	bundle = export()
+	if result := mustImport(t, to, url.Values{"bundle": {bundle}, "update": {"true"}}, nil); result.Updated != 1 {
+		t.Errorf("update result is %+v", result)
+	}
+	if got := mustGetDocument(t, dst, "doc"); got != "abcdef" {
+		t.Errorf("updated document is %q", got)
+	}
+	if got, want := mustKeys(t, dst, "doc"), mustKeys(t, src, "doc"); got != want {
+		t.Errorf("updated keys are %s, want %s", got, want)
+	}
+
+	// a document that has changed differently conflicts, unless it is replaced.
+	if _, err := dst.AppendDocument("doc", 6, []byte("xyz")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.AppendDocument("doc", 6, []byte("ghi")); err != nil {
+		t.Fatal(err)
+	}
+	bundle = export()
+	if result := mustImport(t, to, url.Values{"bundle": {bundle}, "update": {"true"}}, nil); fmt.Sprint(result.Conflicts) != "[doc]" {
+		t.Errorf("conflicting update: result is %+v", result)
+	}
+	if got := mustGetDocument(t, dst, "doc"); got != "abcdefxyz" {
+		t.Errorf("conflicting document was changed to %q", got)
+	}
+	if result := mustImport(t, to, url.Values{"bundle": {bundle}, "replace": {"true"}}, nil); result.Imported != 1 {
+		t.Errorf("replace result is %+v", result)
+	}
+	if got := mustGetDocument(t, dst, "doc"); got != "abcdefghi" {
+		t.Errorf("replaced document is %q", got)
+	}
+
+	// the length must match the contents.
+	bad := strings.Replace(bundle, `"length":9`, `"length":10`, 1)
+	params := url.Values{"method": {"importDocuments"}, "bundle": {bad}}
+	if w := manage(t, to, params, nil); w.Code != 400 {
+		t.Errorf("importing a bad bundle: status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestExportImportDocuments(t *testing.T) {
+	src := NewMemoryDB()
+	const docs = 5
+	for i := 0; i < docs; i++ {
+		docID := fmt.Sprintf("doc%d", i)
+		if _, _, err := src.GetDocument(docID, AlwaysCreate, []byte(strings.Repeat("x", i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.SetDocumentKey(docID, 0, Key{1, "index", fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := manage(t, newManagedHandler(src), url.Values{"method": {"exportDocuments"}}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("exportDocuments: status %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("content type is %q", ct)
+	}
+	export := w.Body.String()
+	lines := strings.Split(strings.TrimSuffix(export, "\n"), "\n")
+	if len(lines) != docs {
+		t.Fatalf("exported %d lines, want %d", len(lines), docs)
+	}
+
+	dst := NewMemoryDB()
+	to := newManagedHandler(dst)
+	if result := mustImport(t, to, url.Values{}, strings.NewReader(export)); result.Imported != docs {
+		t.Errorf("import result is %+v", result)
+	}
+	for i := 0; i < docs; i++ {
+		docID := fmt.Sprintf("doc%d", i)
+		if got := mustGetDocument(t, dst, docID); got != strings.Repeat("x", i) {
+			t.Errorf("%s is %q", docID, got)
+		}
+		if got, want := mustKeys(t, dst, docID), mustKeys(t, src, docID); got != want {
+			t.Errorf("%s has keys %s, want %s", docID, got, want)
+		}
+	}
+
+	// an interrupted export fails to parse, after the complete documents are imported.
+	dst = NewMemoryDB()
+	to = newManagedHandler(dst)
+	truncated := export[:len(export)-len(lines[docs-1])/2]
+	params := url.Values{"method": {"importDocuments"}}
+	if w := manage(t, to, params, strings.NewReader(truncated)); w.Code != 400 {
+		t.Errorf("importing a truncated export: status %d: %s", w.Code, w.Body.String())
+	}
+	for i := 0; i < docs-1; i++ {
+		mustGetDocument(t, dst, fmt.Sprintf("doc%d", i))
+	}
+}
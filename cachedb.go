@@ -0,0 +1,453 @@
+package zwibserve
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// DocumentInvalidator is implemented by databases that cache documents. The
+// server calls InvalidateDocument when it learns that a document was changed
+// by another server, so that the cached copy is not used. The built-in
+// databases that wrap another, such as WriteBehindDB, pass it on.
+type DocumentInvalidator interface {
+	InvalidateDocument(docID string)
+}
+
+// CacheOptions configures a CachingDB.
+type CacheOptions struct {
+	// Maximum total size of the cached documents and keys. The default is 64 MB.
+	MaxBytes int64
+
+	// Cached documents are read again from the database after this time, so
+	// that the database sees that they are in use, and changes that another
+	// server made without notifying this one are seen. The default is 10 minutes.
+	MaxAge time.Duration
+}
+
+// CachingDB wraps another DocumentDB, keeping the most recently used documents
+// and their keys in memory. Changes are written through to the database before
+// the cache is updated.
+//
+// When several servers share the database, they must be connected to each
+// other so that appends made by the others are reported, or else the cache
+// is only corrected when an append conflicts or MaxAge passes.
+type CachingDB struct {
+	db      DocumentDB
+	cdb     ContextDocumentDB
+	options CacheOptions
+
+	mutex   sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	bytes   int64
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	docID string
+
+	doc       []byte
+	hasDoc    bool
+	ownsDoc   bool // the doc is not shared with the database, so it can be appended to
+	docLoaded time.Time
+
+	keys       []Key
+	hasKeys    bool
+	keysLoaded time.Time
+
+	// number of appends in progress. The cached document is not used while
+	// the result is unknown.
+	appending int
+
+	// incremented when appends and key changes finish, so that reads that
+	// started earlier do not replace the result.
+	changes uint64
+}
+
+// Memory used by each entry in addition to its contents
+const cacheEntryOverhead = 128
+
+func (e *cacheEntry) size() int64 {
+	size := int64(cacheEntryOverhead + cap(e.doc))
+	for _, key := range e.keys {
+		size += int64(len(key.Name) + len(key.Value) + 16)
+	}
+	return size
+}
+
+// NewCachingDB returns a DocumentDB that caches documents from db.
+func NewCachingDB(db DocumentDB, options CacheOptions) *CachingDB {
+	if options.MaxBytes == 0 {
+		options.MaxBytes = 64 << 20
+	}
+	if options.MaxAge == 0 {
+		options.MaxAge = 10 * time.Minute
+	}
+
+	return &CachingDB{
+		db:      db,
+		cdb:     WithContext(db),
+		options: options,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// InvalidateDocument removes the document and its keys from the cache.
+func (c *CachingDB) InvalidateDocument(docID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(docID)
+}
+
+// remove removes the entry. The mutex must be held.
+func (c *CachingDB) remove(docID string) {
+	if element, ok := c.entries[docID]; ok {
+		c.bytes -= element.Value.(*cacheEntry).size()
+		c.lru.Remove(element)
+		delete(c.entries, docID)
+	}
+}
+
+// update calls fn to change the entry for the document, creating it if
+// necessary, and then evicts entries until the cache is within its budget.
+// The mutex must be held.
+func (c *CachingDB) update(docID string, fn func(e *cacheEntry)) {
+	var e *cacheEntry
+	if element, ok := c.entries[docID]; ok {
+		e = element.Value.(*cacheEntry)
+		c.bytes -= e.size()
+		c.lru.MoveToFront(element)
+	} else {
+		e = &cacheEntry{docID: docID}
+		c.entries[docID] = c.lru.PushFront(e)
+	}
+
+	fn(e)
+	c.bytes += e.size()
+
+	// Entries with appends in progress are kept, so that a read cannot
+	// replace them with an older copy. Evict the others first.
+	for skipped := 0; c.bytes > c.options.MaxBytes && skipped < c.lru.Len(); {
+		last := c.lru.Back().Value.(*cacheEntry)
+		if last.appending > 0 || last == e {
+			c.lru.MoveToFront(c.lru.Back())
+			skipped++
+			continue
+		}
+		c.remove(last.docID)
+	}
+}
+
+// lookup returns the entry, if it is cached. The mutex must be held.
+func (c *CachingDB) lookup(docID string) *cacheEntry {
+	if element, ok := c.entries[docID]; ok {
+		c.lru.MoveToFront(element)
+		return element.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+// GetDocumentContext returns the cached document, or reads it from the database.
+func (c *CachingDB) GetDocumentContext(ctx context.Context, docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	c.mutex.Lock()
+	if e := c.lookup(docID); mode != AlwaysCreate && e != nil && e.hasDoc && e.appending == 0 &&
+		time.Since(e.docLoaded) < c.options.MaxAge {
+		// Callers cannot append into the cached copy.
+		doc := e.doc[:len(e.doc):len(e.doc)]
+		c.hits++
+		c.mutex.Unlock()
+		return doc, false, nil
+	}
+	c.misses++
+	e, changes := c.track(docID)
+	c.mutex.Unlock()
+
+	doc, created, err := c.cdb.GetDocumentContext(ctx, docID, mode, initialData)
+	if err != nil {
+		return doc, created, err
+	}
+
+	c.mutex.Lock()
+	// Do not replace the result of an append that finished while reading.
+	if c.current(docID, e) && e.changes == changes && e.appending == 0 &&
+		int64(len(doc)) < c.options.MaxBytes/2 {
+		c.update(docID, func(e *cacheEntry) {
+			e.doc = doc
+			e.hasDoc = true
+			e.ownsDoc = false
+			e.docLoaded = time.Now()
+		})
+	}
+	c.mutex.Unlock()
+	return doc, created, nil
+}
+
+// track returns the entry for the document, creating an empty one if
+// necessary, and its number of changes. The mutex must be held.
+func (c *CachingDB) track(docID string) (*cacheEntry, uint64) {
+	e := c.lookup(docID)
+	if e == nil {
+		c.update(docID, func(*cacheEntry) {})
+		e = c.lookup(docID)
+	}
+	return e, e.changes
+}
+
+// current returns true if e is still the entry of the document. The mutex
+// must be held.
+func (c *CachingDB) current(docID string, e *cacheEntry) bool {
+	element, ok := c.entries[docID]
+	return ok && element.Value.(*cacheEntry) == e
+}
+
+// AppendDocumentContext appends to the document in the database, and then to
+// the cached copy.
+func (c *CachingDB) AppendDocumentContext(ctx context.Context, docID string, oldLength uint64, newData []byte) (uint64, error) {
+	c.mutex.Lock()
+	e, _ := c.track(docID)
+	e.appending++
+	c.mutex.Unlock()
+
+	length, err := c.cdb.AppendDocumentContext(ctx, docID, oldLength, newData)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e.appending--
+	e.changes++
+
+	if !c.current(docID, e) {
+		// It was removed while appending.
+		return length, err
+	}
+
+	if err == nil && e.hasDoc && uint64(len(e.doc)) == oldLength {
+		c.update(docID, func(e *cacheEntry) {
+			if !e.ownsDoc {
+				// Leave room to append, so that each append does not copy the document.
+				doc := make([]byte, len(e.doc), len(e.doc)+len(newData)+len(e.doc)/4+64)
+				copy(doc, e.doc)
+				e.doc = doc
+				e.ownsDoc = true
+			}
+			e.doc = append(e.doc, newData...)
+		})
+	} else {
+		// The cached copy is out of date.
+		c.update(docID, func(e *cacheEntry) {
+			e.doc = nil
+			e.hasDoc = false
+			e.ownsDoc = false
+		})
+	}
+
+	return length, err
+}
+
+// SetDocumentKeyContext sets the key in the database, and then in the cache.
+func (c *CachingDB) SetDocumentKeyContext(ctx context.Context, docID string, oldVersion int, key Key) error {
+	err := c.cdb.SetDocumentKeyContext(ctx, docID, oldVersion, key)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e := c.lookup(docID)
+	if e == nil {
+		return err
+	}
+	e.changes++
+	if !e.hasKeys {
+		return err
+	}
+
+	c.update(docID, func(e *cacheEntry) {
+		if err != nil {
+			// The cached keys may be out of date.
+			e.keys = nil
+			e.hasKeys = false
+			return
+		}
+
+		keys := make([]Key, 0, len(e.keys)+1)
+		for _, k := range e.keys {
+			if k.Name != key.Name {
+				keys = append(keys, k)
+			}
+		}
+		e.keys = append(keys, key)
+	})
+	return err
+}
+
+// GetDocumentKeysContext returns the cached keys, or reads them from the database.
+func (c *CachingDB) GetDocumentKeysContext(ctx context.Context, docID string) ([]Key, error) {
+	c.mutex.Lock()
+	if e := c.lookup(docID); e != nil && e.hasKeys && time.Since(e.keysLoaded) < c.options.MaxAge {
+		keys := append([]Key(nil), e.keys...)
+		c.hits++
+		c.mutex.Unlock()
+		return keys, nil
+	}
+	c.misses++
+	e, changes := c.track(docID)
+	c.mutex.Unlock()
+
+	keys, err := c.cdb.GetDocumentKeysContext(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	if c.current(docID, e) && e.changes == changes {
+		c.update(docID, func(e *cacheEntry) {
+			e.keys = append([]Key(nil), keys...)
+			e.hasKeys = true
+			e.keysLoaded = time.Now()
+		})
+	}
+	c.mutex.Unlock()
+	return keys, nil
+}
+
+// DeleteDocumentContext deletes the document from the database and the cache.
+func (c *CachingDB) DeleteDocumentContext(ctx context.Context, docID string) error {
+	c.InvalidateDocument(docID)
+	err := c.cdb.DeleteDocumentContext(ctx, docID)
+	c.InvalidateDocument(docID)
+	return err
+}
+
+// AddTokenContext ...
+func (c *CachingDB) AddTokenContext(ctx context.Context, token, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	err := c.cdb.AddTokenContext(ctx, token, docID, userID, permissions, expirationSeconds, contents)
+	if len(contents) > 0 {
+		c.InvalidateDocument(docID)
+	}
+	return err
+}
+
+// GetTokenContext ...
+func (c *CachingDB) GetTokenContext(ctx context.Context, token string) (string, string, string, error) {
+	return c.cdb.GetTokenContext(ctx, token)
+}
+
+// UpdateUserContext ...
+func (c *CachingDB) UpdateUserContext(ctx context.Context, userID, permissions string) error {
+	return c.cdb.UpdateUserContext(ctx, userID, permissions)
+}
+
+// CheckHealthContext ...
+func (c *CachingDB) CheckHealthContext(ctx context.Context) error {
+	return c.cdb.CheckHealthContext(ctx)
+}
+
+// GetDocument ...
+func (c *CachingDB) GetDocument(docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	return c.GetDocumentContext(context.Background(), docID, mode, initialData)
+}
+
+// AppendDocument ...
+func (c *CachingDB) AppendDocument(docID string, oldLength uint64, newData []byte) (uint64, error) {
+	return c.AppendDocumentContext(context.Background(), docID, oldLength, newData)
+}
+
+// SetDocumentKey ...
+func (c *CachingDB) SetDocumentKey(docID string, oldVersion int, key Key) error {
+	return c.SetDocumentKeyContext(context.Background(), docID, oldVersion, key)
+}
+
+// GetDocumentKeys ...
+func (c *CachingDB) GetDocumentKeys(docID string) ([]Key, error) {
+	return c.GetDocumentKeysContext(context.Background(), docID)
+}
+
+// DeleteDocument ...
+func (c *CachingDB) DeleteDocument(docID string) error {
+	return c.DeleteDocumentContext(context.Background(), docID)
+}
+
+// AddToken ...
+func (c *CachingDB) AddToken(token, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	return c.AddTokenContext(context.Background(), token, docID, userID, permissions, expirationSeconds, contents)
+}
+
+// GetToken ...
+func (c *CachingDB) GetToken(token string) (string, string, string, error) {
+	return c.GetTokenContext(context.Background(), token)
+}
+
+// UpdateUser ...
+func (c *CachingDB) UpdateUser(userID, permissions string) error {
+	return c.UpdateUserContext(context.Background(), userID, permissions)
+}
+
+// CheckHealth ...
+func (c *CachingDB) CheckHealth() error {
+	return c.CheckHealthContext(context.Background())
+}
+
+// SetExpiration ...
+func (c *CachingDB) SetExpiration(seconds int64) {
+	c.db.SetExpiration(seconds)
+}
+
+// ListDocuments lists the documents of the underlying database.
+func (c *CachingDB) ListDocuments(ctx context.Context, fn func(docID string) error) error {
+	lister, ok := c.db.(DocumentLister)
+	if !ok {
+		return errListUnsupported
+	}
+	return lister.ListDocuments(ctx, fn)
+}
+
+// ListTokens lists the tokens of the underlying database.
+func (c *CachingDB) ListTokens(ctx context.Context, fn func(token TokenInfo) error) error {
+	lister, ok := c.db.(TokenLister)
+	if !ok {
+		return errListUnsupported
+	}
+	return lister.ListTokens(ctx, fn)
+}
+
+// GetDocumentInfo returns the information recorded by the underlying database.
+func (c *CachingDB) GetDocumentInfo(ctx context.Context, docID string) (DocumentInfo, error) {
+	provider, ok := c.db.(DocumentInfoProvider)
+	if !ok {
+		return DocumentInfo{}, errInfoUnsupported
+	}
+	return provider.GetDocumentInfo(ctx, docID)
+}
+
+// SetArchive sets the archive of the underlying database.
+func (c *CachingDB) SetArchive(archive Archive) {
+	if setter, ok := c.db.(archiveSetter); ok {
+		setter.SetArchive(archive)
+	}
+}
+
+// SetLogger sets the destination of log messages of the underlying database.
+func (c *CachingDB) SetLogger(l Logger) {
+	if setter, ok := c.db.(interface{ SetLogger(Logger) }); ok {
+		setter.SetLogger(l)
+	}
+}
+
+// Close closes the underlying database, if it implements io.Closer.
+func (c *CachingDB) Close() error {
+	if closer, ok := c.db.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *CachingDB) collectMetrics(m *metrics) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	m.set("zwibserve_cache_requests_total", float64(c.hits), "hit")
+	m.set("zwibserve_cache_requests_total", float64(c.misses), "miss")
+	m.set("zwibserve_cache_documents", float64(c.lru.Len()))
+	m.set("zwibserve_cache_bytes", float64(c.bytes))
+}
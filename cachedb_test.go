@@ -0,0 +1,144 @@
+package zwibserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cached returns true if the document is in the cache.
+func (c *CachingDB) cached(docID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e := c.lookup(docID)
+	return e != nil && e.hasDoc
+}
+
+func TestCacheByteBudget(t *testing.T) {
+	inner := NewMemoryDB()
+	const docSize = 1000
+	for _, docID := range []string{"a", "b", "c"} {
+		if _, _, err := inner.GetDocument(docID, AlwaysCreate, make([]byte, docSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// room for two documents, but not three.
+	cache := NewCachingDB(inner, CacheOptions{MaxBytes: 2*(docSize+cacheEntryOverhead) + 100})
+	for _, docID := range []string{"a", "b"} {
+		mustGetDocument(t, cache, docID)
+	}
+	if !cache.cached("a") || !cache.cached("b") {
+		t.Fatal("documents within the budget were not cached")
+	}
+
+	// a is used more recently than b, so b is evicted.
+	mustGetDocument(t, cache, "a")
+	mustGetDocument(t, cache, "c")
+	if !cache.cached("a") || cache.cached("b") || !cache.cached("c") {
+		t.Errorf("cached a=%v b=%v c=%v, want b evicted", cache.cached("a"), cache.cached("b"), cache.cached("c"))
+	}
+
+	cache.mutex.Lock()
+	bytes := cache.bytes
+	cache.mutex.Unlock()
+	if bytes > cache.options.MaxBytes {
+		t.Errorf("cache has %d bytes, more than its budget of %d", bytes, cache.options.MaxBytes)
+	}
+
+	// a document larger than the budget is not kept.
+	if _, _, err := inner.GetDocument("big", AlwaysCreate, make([]byte, 3*docSize)); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGetDocument(t, cache, "big"); len(got) != 3*docSize {
+		t.Errorf("read %d bytes", len(got))
+	}
+	if cache.cached("big") {
+		t.Error("a document larger than the budget was cached")
+	}
+}
+
+// cacheWrappers returns a CachingDB, and the database to give to the Handler,
+// which may wrap it.
+var cacheWrappers = []struct {
+	name string
+	wrap func(t *testing.T, cache *CachingDB) DocumentDB
+}{
+	{"CachingDB", func(t *testing.T, cache *CachingDB) DocumentDB {
+		return cache
+	}},
+	{"WriteBehindDB", func(t *testing.T, cache *CachingDB) DocumentDB {
+		wb, err := NewWriteBehindDB(cache, WriteBehindOptions{FlushInterval: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { wb.Close() })
+		return wb
+	}},
+}
+
+func TestCacheInvalidatedByRemoteAppend(t *testing.T) {
+	for _, wrapper := range cacheWrappers {
+		t.Run(wrapper.name, func(t *testing.T) {
+			inner := NewMemoryDB()
+			cache := NewCachingDB(inner, CacheOptions{})
+			zh := NewHandler(wrapper.wrap(t, cache))
+			zh.SetLogger(NewStdLogger(LogError))
+
+			if _, _, err := cache.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+				t.Fatal(err)
+			}
+
+			// another server appends, and tells this one.
+			if _, err := inner.AppendDocument("doc", 3, []byte("def")); err != nil {
+				t.Fatal(err)
+			}
+			zh.hub.Append("doc", "server-1", 3, []byte("def"))
+
+			if cache.cached("doc") {
+				t.Error("the document is still cached")
+			}
+			if got := mustGetDocument(t, cache, "doc"); got != "abcdef" {
+				t.Errorf("document is %q", got)
+			}
+		})
+	}
+}
+
+func TestCacheInvalidatedByManagementDelete(t *testing.T) {
+	for _, wrapper := range cacheWrappers {
+		t.Run(wrapper.name, func(t *testing.T) {
+			cache := NewCachingDB(NewMemoryDB(), CacheOptions{})
+			zh := NewHandler(wrapper.wrap(t, cache))
+			zh.SetLogger(NewStdLogger(LogError))
+			zh.SetSecretUser("user", "secret")
+
+			if _, _, err := cache.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+				t.Fatal(err)
+			}
+			if !cache.cached("doc") {
+				t.Fatal("the document was not cached")
+			}
+
+			form := url.Values{"method": {"deleteDocument"}, "documentID": {"doc"}}
+			r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth("user", "secret")
+			w := httptest.NewRecorder()
+			zh.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+
+			if cache.cached("doc") {
+				t.Error("the document is still cached")
+			}
+			if _, _, err := cache.GetDocument("doc", NeverCreate, nil); err != ErrMissing {
+				t.Errorf("got %v, want ErrMissing", err)
+			}
+		})
+	}
+}
@@ -1,10 +1,11 @@
 package zwibserve
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
+	"net"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,9 +36,12 @@ type client struct {
 	writePermission bool
 	adminPermission bool
 
-	db  DocumentDB
+	db  ContextDocumentDB
 	hub *hub
 
+	// carries the trace parent from the upgrade request
+	ctx context.Context
+
 	// A single thread writes to the socket. When another thread wants to
 	// send, it appends to the queue and signals the condition variable.
 	// To close the socket, we set closed = true and signal the condition.
@@ -45,8 +49,15 @@ type client struct {
 	mutex  sync.Mutex
 	closed bool
 
+	// set when the server is shutting down, so a close frame is sent.
+	goingAway bool
+
 	// queued messages to send, other than key-information
-	queued [][]byte
+	queued      []queuedMessage
+	queuedBytes int
+
+	// set when the client is disconnected because its queue is full.
+	tooSlow bool
 
 	// queued keys to update to client
 	keys []Key
@@ -59,9 +70,22 @@ func idstr(id int64) string {
 	return fmt.Sprintf("%x", id)
 }
 
+// fields returns the fields identifying the client in log messages.
+func (c *client) fields() []LogField {
+	fields := []LogField{field(fieldClient, c.id)}
+	if c.docID != "" {
+		fields = append(fields, field(fieldDocument, c.docID))
+	}
+	if c.userID != "" {
+		fields = append(fields, field(fieldUser, c.userID))
+	}
+	return fields
+}
+
 // Takes over the connection and runs the client, Responsible for closing the socket.
-func runClient(hub *hub, db DocumentDB, ws *websocket.Conn) {
+func runClient(ctx context.Context, hub *hub, db ContextDocumentDB, ws *websocket.Conn) {
 	c := &client{
+		ctx:     ctx,
 		ws:      ws,
 		db:      db,
 		hub:     hub,
@@ -77,16 +101,18 @@ func runClient(hub *hub, db DocumentDB, ws *websocket.Conn) {
 	message, err := readMessageWithTimeout(c.ws, 30*time.Second)
 	if err != nil {
 		ws.Close()
-		log.Printf("%s: error waiting for init message: %v", c.id, err)
+		hub.log.info("error waiting for init message", field(fieldClient, c.id), field(fieldError, err))
 		return
 	}
 
 	if len(message) < 2 {
 		ws.Close()
-		log.Printf("Received message is too short. Close connection")
+		hub.log.warn("received message is too short; close connection", field(fieldClient, c.id))
 		return
 	}
 
+	hub.metrics.recordReceived(message)
+
 	if message[0] == serverIdentificationMessageType {
 		hub.swarm.HandleIncomingConnection(ws, message)
 		return
@@ -99,41 +125,59 @@ func runClient(hub *hub, db DocumentDB, ws *websocket.Conn) {
 		c.mutex.Unlock()
 	}()
 
-	if !c.processInitMessage(message) {
+	if !c.processInitMessage(c.ctx, message) {
 		return
 	}
 
-	log.Printf("Client %s connected", c.id)
+	hub.log.info("client connected", c.fields()...)
 
 	hub.addClient(c.docID, c)
 	defer hub.RemoveClient(c.docID, c.id)
 
-	sessionKeys, _ := c.db.GetDocumentKeys(c.docID)
+	stopPings := make(chan struct{})
+	defer close(stopPings)
+	c.keepAlive(stopPings)
+
+	dbctx, cancel := hub.dbContext(c.ctx)
+	sessionKeys, err := c.db.GetDocumentKeysContext(dbctx, c.docID)
+	cancel()
+	if err != nil {
+		hub.log.warn("cannot get document keys", append(c.fields(), field(fieldError, err))...)
+	}
 	c.notifyKeysUpdated(c.hub.getClientKeys(c.docID))
 	c.notifyKeysUpdated(sessionKeys)
 	sessionKeys = nil
 
 	for {
 		message, err = readMessage(c.ws)
-		if err != nil {
-			log.Printf("client for %s disconnected", c.docID)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			hub.log.info("client timed out", c.fields()...)
+			break
+		} else if err != nil {
+			hub.log.info("client disconnected", append(c.fields(), field(fieldError, err))...)
 			break
 		}
 
+		if hub.pingInterval > 0 {
+			c.ws.SetReadDeadline(time.Now().Add(hub.pongTimeout))
+		}
+
+		hub.metrics.recordReceived(message)
+
 		if message[0] == 0x02 || message[0] == 0x05 {
-			if !c.processAppend(message) {
+			if !c.processAppend(c.ctx, message) {
 				break
 			}
 		} else if message[0] == 0x03 {
-			if !c.processSetKey(message) {
+			if !c.processSetKey(c.ctx, message) {
 				break
 			}
 		} else if message[0] == 0x04 {
-			if !c.processBroadcast(message) {
+			if !c.processBroadcast(c.ctx, message) {
 				break
 			}
 		} else {
-			log.Printf("client %v sent unexpected message type %v", c.id, message[0])
+			hub.log.warn("client sent unexpected message type", append(c.fields(), field(fieldMessageType, message[0]))...)
 		}
 	}
 }
@@ -142,7 +186,7 @@ func (c *client) writeThread() {
 	defer func() {
 		err := recover()
 		if err != nil {
-			log.Printf("Handling panic: %v", err)
+			c.hub.log.error("panic in write thread", append(c.fields(), field(fieldError, err))...)
 			c.ws.Close()
 		}
 	}()
@@ -159,12 +203,18 @@ func (c *client) writeThread() {
 		keys := c.keys
 		closed = c.closed
 		c.queued = nil
+		c.queuedBytes = 0
 		c.keys = nil
+		maxSize := c.maxSize
 		c.mutex.Unlock()
 
+		// Contiguous appends, such as when someone is drawing quickly, are
+		// sent as one message.
+		messages = coalesceAppends(messages, maxSize)
+
 		// send all the queued messages.
-		for _, message := range messages {
-			c.sendMessage(message)
+		for i := range messages {
+			c.sendMessage(messages[i].encode())
 		}
 
 		if len(keys) > 0 {
@@ -183,9 +233,23 @@ func (c *client) writeThread() {
 			c.sendMessage(encode(nil, info))
 		}
 	}
+
+	c.mutex.Lock()
+	goingAway := c.goingAway
+	c.mutex.Unlock()
+	if goingAway {
+		c.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server going away"),
+			time.Now().Add(time.Second))
+	}
 	c.ws.Close()
 }
 
+var (
+	errMessageTooShort      = errors.New("message too short")
+	errExpectedContinuation = errors.New("expected continuation message")
+)
+
 // Reads a complete message, taking into account the MORE byte to
 // join continuation messages together.
 func readMessage(conn *websocket.Conn) ([]uint8, error) {
@@ -197,7 +261,7 @@ func readMessage(conn *websocket.Conn) ([]uint8, error) {
 			return nil, err
 		}
 		if len(p) < 2 {
-			log.Panicf("message too short")
+			return nil, errMessageTooShort
 		}
 
 		if buffer == nil {
@@ -207,7 +271,7 @@ func readMessage(conn *websocket.Conn) ([]uint8, error) {
 			// continuation message
 			buffer = append(buffer, p[2:]...)
 		} else {
-			log.Panicf("expected continuation message")
+			return nil, errExpectedContinuation
 		}
 
 		if p[1] == 0 {
@@ -225,7 +289,13 @@ func readMessageWithTimeout(conn *websocket.Conn, timeout time.Duration) ([]uint
 	return msg, err
 }
 
-func sendMessage(conn *websocket.Conn, data []byte, maxSize int) {
+// sendMessage writes the message. If writeTimeout is not zero, the entire message
+// must be written within that time or an error is returned.
+func sendMessage(l *logger, conn *websocket.Conn, data []byte, maxSize int, writeTimeout time.Duration) error {
+	if writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+
 	send := len(data)
 	if send > maxSize {
 		send = maxSize
@@ -237,14 +307,14 @@ func sendMessage(conn *websocket.Conn, data []byte, maxSize int) {
 	// send first part
 	err := conn.WriteMessage(websocket.BinaryMessage, data[:send])
 	if err != nil {
-		log.Printf("Got ERROR writing to socket: %v", err)
+		return err
 	}
 	data = data[send:]
 	for len(data) > 0 {
-		log.Printf("Sent %d/%d bytes", send, len(data))
+		l.debug("sending continuation", field("sent", send), field("remaining", len(data)))
 		writer, err := conn.NextWriter(websocket.BinaryMessage)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
 		send := len(data)
@@ -256,24 +326,129 @@ func sendMessage(conn *websocket.Conn, data []byte, maxSize int) {
 
 		writer.Write([]byte{0xff, more})
 		writer.Write(data[:send])
-		writer.Close()
+		err = writer.Close()
+		if err != nil {
+			return err
+		}
 		data = data[send:]
 	}
+	return nil
 }
 
 // Writes a complete message, respecting maximum message size and breaking it into chunks
 // if necessary. MUST ONLY BE CALLED BY WRITETHREAD
+// If the write fails, the socket is closed so that the reading thread
+// will remove the client.
 func (c *client) sendMessage(data []byte) {
-	sendMessage(c.ws, data, c.maxSize)
+	c.hub.metrics.recordSent(data)
+	err := sendMessage(c.hub.log, c.ws, data, c.maxSize, c.hub.writeTimeout)
+	if err != nil {
+		c.hub.log.info("error writing to socket", append(c.fields(), field(fieldError, err))...)
+		c.ws.Close()
+	}
+}
+
+// keepAlive sends pings to the client until stop is closed. The read deadline
+// is extended whenever a pong or message arrives, so a client that stops
+// responding will cause readMessage to fail.
+func (c *client) keepAlive(stop chan struct{}) {
+	interval := c.hub.pingInterval
+	timeout := c.hub.pongTimeout
+	if interval <= 0 {
+		return
+	}
+
+	c.ws.SetReadDeadline(time.Now().Add(timeout))
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(timeout))
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+				if err != nil {
+					c.hub.log.debug("error sending ping", append(c.fields(), field(fieldError, err))...)
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// queueSize returns the number of messages and bytes waiting to be sent.
+func (c *client) queueSize() (messages int, bytes int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.queued) + len(c.keys), c.queuedBytes
 }
 
 func (c *client) enqueue(message interface{}) {
+	encoded := encode(nil, message)
+	c.push(queuedMessage{messageType: encoded[0], encoded: encoded})
+}
+
+// push adds the message to the queue and wakes the write thread.
+func (c *client) push(message queuedMessage) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.queued = append(c.queued, encode(nil, message))
+	if c.tooSlow {
+		// the client is being disconnected; nothing more will be sent.
+		return
+	}
+	c.queued = append(c.queued, message)
+	c.queuedBytes += message.size()
+	c.limitQueue()
 	c.wakeup.Signal()
 }
 
+// limitQueue applies the queue policy if the queue exceeds the limits.
+// The mutex must be held.
+func (c *client) limitQueue() {
+	limits := c.hub.queueLimits
+	if withinLimits(len(c.queued), c.queuedBytes, limits) {
+		return
+	}
+
+	switch limits.Policy {
+	case QueueCoalesce:
+		// Merge without a size limit, since sendMessage splits long messages
+		// into continuations, and only then is the queue much smaller.
+		c.queued = coalesceAppends(c.queued, 0)
+		c.queuedBytes = queuedBytes(c.queued)
+		c.hub.metrics.inc("zwibserve_queue_overflows_total", "coalesce")
+	case QueueDropBroadcasts:
+		c.queued = dropBroadcasts(c.queued, limits)
+		c.queuedBytes = queuedBytes(c.queued)
+		c.hub.metrics.inc("zwibserve_queue_overflows_total", "drop")
+	}
+
+	if withinLimits(len(c.queued), c.queuedBytes, limits) {
+		return
+	}
+
+	// Still too big. Discard everything and tell the client to reconnect.
+	c.hub.log.warn("client write queue full; disconnecting", append(c.fields(),
+		field("messages", len(c.queued)), field("bytes", c.queuedBytes))...)
+	c.hub.metrics.inc("zwibserve_queue_overflows_total", "disconnect")
+	encoded := encode(nil, errorMessage{
+		MessageType: errorMessageType,
+		ErrorCode:   uint16(errorTooSlow),
+		Description: errorTextTooSlow,
+	})
+	c.queued = []queuedMessage{{messageType: errorMessageType, encoded: encoded}}
+	c.queuedBytes = len(encoded)
+	c.keys = nil
+	c.tooSlow = true
+	c.closed = true
+}
+
 type errorCode uint16
 
 const (
@@ -281,6 +456,7 @@ const (
 	errorDoesNotExist  errorCode = 1
 	errorInvalidOffset errorCode = 3
 	errorAccessDenied  errorCode = 4
+	errorTooSlow       errorCode = 5
 )
 
 var errorStrings = []string{
@@ -289,10 +465,11 @@ var errorStrings = []string{
 	"already exists",
 	"invalid offset",
 	"access denied",
+	errorTextTooSlow,
 }
 
 func (c *client) enqueueError(code errorCode, text string) {
-	log.Printf("Client %v error: %s", c.id, text)
+	c.hub.log.info("client error", append(c.fields(), field("code", code), field(fieldError, text))...)
 	if text == "" && int(code) < len(errorStrings) {
 		text = errorStrings[code]
 	}
@@ -311,20 +488,16 @@ func (c *client) enqueueAppend(data []byte, offset uint64) {
 	c.lastEnd = offset + uint64(len(data))
 	//log.Printf("Append: %d bytes at offset %d", len(data), offset)
 
+	// appends are encoded by the write thread, so that adjacent ones can be merged.
+	messageType := byte(appendMessageType)
 	if c.protocolVersion < 3 {
-		c.enqueue(appendMessageV2{
-			MessageType: appendV2MessageType,
-			Offset:      offset,
-			Data:        data,
-		})
-		return
+		messageType = appendV2MessageType
 	}
 
-	c.enqueue(appendMessage{
-		MessageType: appendMessageType,
-		Generation:  0, // Future feature
-		Offset:      offset,
-		Data:        data,
+	c.push(queuedMessage{
+		messageType: messageType,
+		offset:      offset,
+		data:        data,
 	})
 }
 
@@ -348,15 +521,15 @@ func (c *client) enqueueAckNack(ack uint16, length uint64) {
 func (c *client) enqueueSetKeyAckNack(ack bool, requestID uint16) {
 	var Ack uint16
 	if ack {
-		log.Printf("Client %v << KEY ACK", c.id)
+		c.hub.log.debug("key ack", c.fields()...)
 		Ack = 0x01
 	} else {
-		log.Printf("Client %v << KEY NACK", c.id)
+		c.hub.log.debug("key nack", c.fields()...)
 		Ack = 0x00
 	}
 
 	c.enqueue(setKeyAckNackMessage{
-		MessageType: 0x83,
+		MessageType: setKeyAckNackMessageType,
 		Ack:         Ack,
 		RequestID:   requestID,
 	})
@@ -406,21 +579,34 @@ func decodeAppendMessage(m *appendMessage, data []uint8) error {
 	return decode(m, data)
 }
 
-func (c *client) processInitMessage(data []uint8) bool {
+// The description of the error sent to clients when the database fails.
+const errorTextDatabase = "database unavailable; try again"
+
+// databaseFailed tells the client that an operation failed for a reason that
+// may be temporary.
+func (c *client) databaseFailed(err error) {
+	c.hub.log.warn("database operation failed", append(c.fields(), field(fieldError, err))...)
+	c.enqueueError(errorUnspecified, errorTextDatabase)
+}
+
+func (c *client) processInitMessage(ctx context.Context, data []uint8) bool {
+	ctx, span := c.hub.tracer.start(ctx, "processInitMessage", field(fieldClient, c.id))
+	defer span.end()
+
 	var m initMessage
 	err := decodeInitMessage(&m, data)
 	if err != nil {
-		log.Printf("Client %v: %v", c.id, err)
+		c.hub.log.warn("invalid init message", field(fieldClient, c.id), field(fieldError, err))
 		return false
 	}
 
 	if m.MessageType != 0x01 {
-		log.Printf("Client %v: ERROR Expected INIT message", c.id)
+		c.hub.log.warn("expected init message", field(fieldClient, c.id), field(fieldMessageType, m.MessageType))
 		return false
 	}
 
 	if m.ProtocolVersion != 2 && m.ProtocolVersion != 3 {
-		log.Printf("Client %v: protocol versiom must be 2", c.id)
+		c.hub.log.warn("unsupported protocol version", field(fieldClient, c.id), field("version", m.ProtocolVersion))
 		return false
 	}
 	c.protocolVersion = m.ProtocolVersion
@@ -431,16 +617,20 @@ func (c *client) processInitMessage(data []uint8) bool {
 
 	errorCodeOnMissing := errorDoesNotExist
 
+	dbctx, cancel := c.hub.dbContext(ctx)
+	defer cancel()
+
 	// check if its a token
-	realDocID, userID, permissions, err := c.db.GetToken(m.DocID)
+	realDocID, userID, permissions, err := c.db.GetTokenContext(dbctx, m.DocID)
 
 	if err == ErrMissing && c.hub.jwtKey != "" {
 		// interpret as JWT token
-		realDocID, userID, permissions, err = decodeJWT(c.hub.jwtKey, c.hub.keyIsBase64, m.DocID)
+		realDocID, userID, permissions, err = decodeJWT(c.hub.log, c.hub.jwtKey, c.hub.keyIsBase64, m.DocID)
 	}
 
 	if err == nil {
-		log.Printf("Token %s maps to doc %s", m.DocID, realDocID)
+		c.hub.log.debug("token maps to document", field(fieldClient, c.id), field(fieldToken, m.DocID),
+			field(fieldDocument, realDocID), field(fieldUser, userID))
 		c.docID = realDocID
 		c.writePermission = strings.Contains(permissions, "w")
 		c.adminPermission = strings.Contains(permissions, "a")
@@ -464,7 +654,7 @@ func (c *client) processInitMessage(data []uint8) bool {
 		c.enqueueError(0x0004, "access denied")
 		return false
 	} else {
-		c.enqueueError(0, err.Error())
+		c.databaseFailed(err)
 		return false
 	}
 
@@ -473,8 +663,9 @@ func (c *client) processInitMessage(data []uint8) bool {
 	// look up document id
 	// if the document exists and create mode is ALWAYS_CREATE, then send error code ALREADY_EXISTS
 	// if the document does not exist and create mode is NEVER_CREATE then send error code DOES NOT EXIST
-	log.Printf("client %v looks for document %s", c.id, c.docID)
-	doc, created, err := c.db.GetDocument(c.docID, CreateMode(m.CreationMode), initialData)
+	c.hub.log.debug("client looks for document", c.fields()...)
+	span.setAttributes(field(fieldDocument, c.docID))
+	doc, created, err := c.db.GetDocumentContext(WithUserID(dbctx, c.userID), c.docID, CreateMode(m.CreationMode), initialData)
 	if err != nil {
 		switch err {
 		case ErrExists:
@@ -482,7 +673,7 @@ func (c *client) processInitMessage(data []uint8) bool {
 		case ErrMissing:
 			c.enqueueError(errorCodeOnMissing, "")
 		default:
-			c.enqueueError(0, err.Error())
+			c.databaseFailed(err)
 		}
 		return false
 	}
@@ -517,7 +708,7 @@ func init() {
 	errSignatureInvalid = errors.New("signature invalid")
 }
 
-func decodeJWT(jwtKey string, keyIsBase64 bool, tokenString string) (realDocID string, userID string, permissions string, err error) {
+func decodeJWT(l *logger, jwtKey string, keyIsBase64 bool, tokenString string) (realDocID string, userID string, permissions string, err error) {
 	// decode JWT token and verify signature using JSON Web Keyset
 	// pass your custom claims to the parser function
 	var token *jwt.Token
@@ -543,7 +734,7 @@ func decodeJWT(jwtKey string, keyIsBase64 bool, tokenString string) (realDocID s
 
 		now := time.Now().Unix()
 		if myClaims.ExpiresAt <= now {
-			log.Printf("User's JWT Token has expired. Token: %d Now is: %d", myClaims.ExpiresAt, now)
+			l.info("JWT has expired", field(fieldUser, myClaims.UserID), field("expiresAt", myClaims.ExpiresAt), field("now", now))
 			err = ErrMissing
 		}
 
@@ -561,64 +752,98 @@ func decodeJWT(jwtKey string, keyIsBase64 bool, tokenString string) (realDocID s
 	return
 }
 
-func (c *client) processAppend(data []uint8) bool {
+func (c *client) processAppend(ctx context.Context, data []uint8) bool {
+	ctx, span := c.hub.tracer.start(ctx, "processAppend", c.fields()...)
+	defer span.end()
+
 	var m appendMessage
 	err := decodeAppendMessage(&m, data)
 	if err != nil {
-		log.Printf("Client %v: %v", c.id, err)
+		c.hub.log.warn("invalid append message", append(c.fields(), field(fieldError, err))...)
 		return false
 	}
 
 	if !c.writePermission {
-		log.Printf("Nack. no permission to write")
+		c.hub.log.debug("nack; no permission to write", c.fields()...)
 		m.Data = nil
 	}
 
 	// attempt to append to document
-	newLength, err := c.db.AppendDocument(c.docID, m.Offset, m.Data)
+	dbctx, cancel := c.hub.dbContext(ctx)
+	dbctx = WithUserID(dbctx, c.userID)
+	newLength, err := c.db.AppendDocumentContext(dbctx, c.docID, m.Offset, m.Data)
+	cancel()
+	span.setAttributes(field("offset", m.Offset), field("bytes", len(m.Data)))
 
 	if err == nil && c.writePermission {
+		c.hub.metrics.inc("zwibserve_appends_total", "ack")
 		c.enqueueAckNack(0x01, newLength)
 		c.lastEnd = newLength
-		c.hub.Append(c.docID, c.id, m.Offset, m.Data)
+		c.hub.appendContext(ctx, c.docID, c.id, m.Offset, m.Data)
 	} else if err == nil && !c.writePermission {
+		c.hub.metrics.inc("zwibserve_appends_total", "nack")
 		c.enqueueAckNack(0x02, newLength)
 	} else if err == ErrConflict {
 		//log.Printf("Nack. offset should be %d not %d", newLength, m.Offset)
+		c.hub.metrics.inc("zwibserve_appends_total", "conflict")
 		c.enqueueAckNack(0x00, newLength)
 	} else if err == ErrMissing {
-		log.Printf("ErrMissing during append: %s does not exist", c.docID)
+		c.hub.log.info("document does not exist during append", c.fields()...)
 		c.enqueueError(0x0001, "does not exist")
 	} else {
-		log.Panic(err)
+		// The client cannot know if the append succeeded, so it must reconnect.
+		span.setError(err)
+		c.databaseFailed(err)
+		return false
 	}
 
 	return true
 }
 
-func (c *client) processSetKey(data []uint8) bool {
+func (c *client) processSetKey(ctx context.Context, data []uint8) bool {
+	ctx, span := c.hub.tracer.start(ctx, "processSetKey", c.fields()...)
+	defer span.end()
+
 	var m setKeyMessage
 	err := decode(&m, data)
 	if err != nil {
-		log.Printf("Client %v: %v", c.id, err)
+		c.hub.log.warn("invalid set key message", append(c.fields(), field(fieldError, err))...)
 		return false
 	}
 
+	lifetime := "session"
+	if m.Lifetime == 0x00 {
+		lifetime = "client"
+	}
+
 	var ack bool
 	if strings.HasPrefix(m.Name, "admin:") && !c.adminPermission {
-		log.Printf("Client %v: Tried to set admin: key but lacks permissions.", c.id)
+		c.hub.log.warn("tried to set admin: key but lacks permissions", append(c.fields(), field("key", m.Name))...)
 
 	} else if m.Lifetime == 0x00 {
 		ack = c.hub.SetClientKey(c.docID, c.id, int(m.OldVersion), int(m.NewVersion), m.Name, m.Value)
 
 	} else {
 		key := Key{int(m.NewVersion), m.Name, m.Value}
-		ack = nil == c.db.SetDocumentKey(c.docID, int(m.OldVersion), key)
+		dbctx, cancel := c.hub.dbContext(ctx)
+		err = c.db.SetDocumentKeyContext(dbctx, c.docID, int(m.OldVersion), key)
+		cancel()
+		if err != nil && err != ErrConflict {
+			c.hub.log.warn("cannot set document key", append(c.fields(), field("key", m.Name), field(fieldError, err))...)
+		}
+		ack = err == nil
 		if ack {
-			c.hub.SetSessionKey(c.docID, c.id, key)
+			c.hub.setSessionKeyContext(ctx, c.docID, c.id, key)
 		}
 	}
 
+	span.setAttributes(field("key", m.Name), field("lifetime", lifetime), field("ack", ack))
+	if ack {
+		c.hub.metrics.inc("zwibserve_key_sets_total", lifetime, "success")
+	} else {
+		c.hub.metrics.inc("zwibserve_key_sets_total", lifetime, "failure")
+	}
+
 	if !ack || m.OldVersion != m.NewVersion {
 		c.enqueueSetKeyAckNack(ack, m.RequestID)
 	}
@@ -626,16 +851,19 @@ func (c *client) processSetKey(data []uint8) bool {
 	return true
 }
 
-func (c *client) processBroadcast(data []uint8) bool {
+func (c *client) processBroadcast(ctx context.Context, data []uint8) bool {
+	ctx, span := c.hub.tracer.start(ctx, "processBroadcast", c.fields()...)
+	defer span.end()
+
 	var m broadcastMessage
 	err := decode(&m, data)
 	if err != nil {
-		log.Printf("Client %v: %v", c.id, err)
+		c.hub.log.warn("invalid broadcast message", append(c.fields(), field(fieldError, err))...)
 		return false
 	}
 
-	// attempt to append to document
-	c.hub.Broadcast(c.docID, c.id, m.Data)
+	span.setAttributes(field("bytes", len(m.Data)))
+	c.hub.broadcastContext(ctx, c.docID, c.id, m.Data)
 	return true
 }
 
@@ -670,13 +898,24 @@ outer:
 
 // The client has lost access to the document.
 func (c *client) notifyLostAccess(code errorCode) {
-	log.Printf("    Client %v lost access to the document. Closing connection.", c.id)
+	c.hub.log.info("client lost access to the document; closing connection", c.fields()...)
 	c.enqueueError(code, "")
 	c.mutex.Lock()
 	c.closed = true
 	c.mutex.Unlock()
 }
 
+// The server is shutting down. Send the message, and close the connection after
+// all queued messages are written.
+func (c *client) notifyGoingAway(message string) {
+	c.enqueueError(errorUnspecified, message)
+	c.mutex.Lock()
+	c.closed = true
+	c.goingAway = true
+	c.wakeup.Signal()
+	c.mutex.Unlock()
+}
+
 func (c *client) notifyPermissionChange(permissions string) {
 	c.mutex.Lock()
 	c.writePermission = strings.Contains(permissions, "w")
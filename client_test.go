@@ -0,0 +1,103 @@
+package zwibserve
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialDocument connects to the server and opens the document, returning the
+// connection once the server has sent the initial contents.
+func dialDocument(t *testing.T, server *httptest.Server, docID string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sendConnectMessage(conn, docID)
+	if _, err := readMessage(conn); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readErrors reads from the connection until it fails, and then sends the error.
+func readErrors(conn *websocket.Conn) chan error {
+	result := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				result <- err
+				return
+			}
+		}
+	}()
+	return result
+}
+
+func TestKeepalive(t *testing.T) {
+	zh := NewHandler(NewMemoryDB())
+	zh.SetLogger(NewStdLogger(LogError))
+	zh.SetKeepalive(50*time.Millisecond, 200*time.Millisecond)
+	server := httptest.NewServer(zh)
+	defer server.Close()
+
+	// this client answers pings, because reading processes them.
+	alive := dialDocument(t, server, "keepalive")
+	aliveErr := readErrors(alive)
+
+	// this client ignores pings, so the server stops hearing from it.
+	silent := dialDocument(t, server, "keepalive")
+	silent.SetPingHandler(func(string) error { return nil })
+	silentErr := readErrors(silent)
+
+	select {
+	case <-silentErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client that does not answer pings was not disconnected")
+	}
+
+	select {
+	case err := <-aliveErr:
+		t.Fatalf("client that answers pings was disconnected: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestMalformedMessage(t *testing.T) {
+	zh := NewHandler(NewMemoryDB())
+	zh.SetLogger(NewStdLogger(LogError))
+	server := httptest.NewServer(zh)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		messages [][]byte
+	}{
+		{"too short", [][]byte{{appendV2MessageType}}},
+		{"missing continuation", [][]byte{{appendV2MessageType, 1}, {appendV2MessageType, 0}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialDocument(t, server, "malformed")
+			for _, message := range test.messages {
+				if err := conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case <-readErrors(conn):
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection was not closed")
+			}
+		})
+	}
+
+	// the server is still running.
+	dialDocument(t, server, "malformed")
+}
@@ -0,0 +1,168 @@
+package zwibserve_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/jmoiron/sqlx"
+	"github.com/smhanov/zwibserve"
+	"github.com/smhanov/zwibserve/dbtest"
+)
+
+func must(t *testing.T, db zwibserve.DocumentDB, err error) zwibserve.DocumentDB {
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMemoryDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+		return zwibserve.NewMemoryDB()
+	})
+}
+
+func TestSQLiteDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+		db, err := zwibserve.NewSQLiteDBWithOptions(zwibserve.SQLiteOptions{
+			Filename: filepath.Join(zwibserve.TempDir(t), "test.db"),
+		})
+		return must(t, db, err)
+	})
+}
+
+func TestSQLiteChunkedDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+		db, err := zwibserve.NewSQLiteDBWithOptions(zwibserve.SQLiteOptions{
+			SQLOptions: zwibserve.SQLOptions{ChunkedStorage: true},
+			Filename:   filepath.Join(zwibserve.TempDir(t), "test.db"),
+		})
+		return must(t, db, err)
+	})
+}
+
+// The tests of database servers share them, so each test uses its own tables
+// or keys, which are removed when it ends.
+var testPrefixes int64
+
+func testPrefix() string {
+	return fmt.Sprintf("test%d_%d_", time.Now().Unix(), atomic.AddInt64(&testPrefixes, 1))
+}
+
+// dropTables removes the tables of a test from the SQL database.
+func dropTables(t *testing.T, driverName, dsn, prefix string) {
+	t.Cleanup(func() {
+		conn, err := sqlx.Connect(driverName, dsn)
+		if err != nil {
+			t.Logf("cannot remove tables: %v", err)
+			return
+		}
+		defer conn.Close()
+		for _, table := range []string{"ZwibblerKeys", "ZwibblerChunks", "ZwibblerDocs", "ZwibblerTokens", "ZwibblerSchemaVersion"} {
+			if _, err := conn.Exec("DROP TABLE IF EXISTS " + prefix + table); err != nil {
+				t.Logf("cannot remove table %s: %v", prefix+table, err)
+			}
+		}
+	})
+}
+
+func TestPostgreSQLDB(t *testing.T) {
+	dsn := os.Getenv("ZWIBSERVE_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("ZWIBSERVE_POSTGRES_DSN is not set")
+	}
+	for _, chunked := range []bool{false, true} {
+		chunked := chunked
+		t.Run(fmt.Sprintf("chunked=%v", chunked), func(t *testing.T) {
+			dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+				prefix := testPrefix()
+				dropTables(t, "postgres", dsn, prefix)
+				db, err := zwibserve.NewPostgreSQLConnectionWithOptions(zwibserve.PostgreSQLOptions{
+					SQLOptions: zwibserve.SQLOptions{TablePrefix: prefix, ChunkedStorage: chunked},
+					DSN:        dsn,
+				})
+				return must(t, db, err)
+			})
+		})
+	}
+}
+
+func TestMySQLDB(t *testing.T) {
+	dsn := os.Getenv("ZWIBSERVE_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("ZWIBSERVE_MYSQL_DSN is not set")
+	}
+	for _, chunked := range []bool{false, true} {
+		chunked := chunked
+		t.Run(fmt.Sprintf("chunked=%v", chunked), func(t *testing.T) {
+			dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+				prefix := testPrefix()
+				dropTables(t, "mysql", dsn, prefix)
+				db, err := zwibserve.NewMySQLConnectionWithOptions(zwibserve.MySQLOptions{
+					SQLOptions: zwibserve.SQLOptions{TablePrefix: prefix, ChunkedStorage: chunked},
+					DSN:        dsn,
+				})
+				return must(t, db, err)
+			})
+		})
+	}
+}
+
+// TestRedisDB runs the conformance tests against the Redis server at
+// REDIS_ADDR, eg. "localhost:6379".
+func TestRedisDB(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+		prefix := testPrefix()
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		t.Cleanup(func() {
+			defer client.Close()
+			ctx := context.Background()
+			iter := client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+			for iter.Next(ctx) {
+				client.Del(ctx, iter.Val())
+			}
+		})
+		db, err := zwibserve.NewRedisDBWithClient(client, zwibserve.RedisOptions{KeyPrefix: prefix})
+		return must(t, db, err)
+	})
+}
+
+func TestFileDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+		db, err := zwibserve.NewFileDB(zwibserve.TempDir(t))
+		return must(t, db, err)
+	})
+}
+
+func TestBoltDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+		db, err := zwibserve.NewBoltDB(filepath.Join(zwibserve.TempDir(t), "test.bolt"))
+		return must(t, db, err)
+	})
+}
+
+func TestCachingDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+		// Cached copies of expired documents are used until they are read again.
+		return zwibserve.NewCachingDB(zwibserve.NewMemoryDB(), zwibserve.CacheOptions{
+			MaxAge: time.Second,
+		})
+	})
+}
+
+func TestWriteBehindDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+		db, err := zwibserve.NewWriteBehindDB(zwibserve.NewMemoryDB(), zwibserve.WriteBehindOptions{})
+		return must(t, db, err)
+	})
+}
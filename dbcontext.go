@@ -0,0 +1,179 @@
+package zwibserve
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ContextDocumentDB is the interface to a document storage whose operations
+// take a context, which carries the deadline of the operation, and which report
+// database failures as errors instead of panicking. The server uses it for all
+// operations. Implementations of DocumentDB that do not implement it are
+// adapted using WithContext.
+//
+// ErrMissing, ErrConflict and ErrExists have the same meanings as in DocumentDB.
+// Any other error is reported to the client as a temporary failure.
+type ContextDocumentDB interface {
+	GetDocumentContext(ctx context.Context, docID string, mode CreateMode, initialData []byte) ([]byte, bool, error)
+	AppendDocumentContext(ctx context.Context, docID string, oldLength uint64, newData []byte) (uint64, error)
+	SetDocumentKeyContext(ctx context.Context, docID string, oldVersion int, key Key) error
+	GetDocumentKeysContext(ctx context.Context, docID string) ([]Key, error)
+	DeleteDocumentContext(ctx context.Context, docID string) error
+	AddTokenContext(ctx context.Context, token, docID, userID, permissions string, expirationSeconds int64, contents []byte) error
+	GetTokenContext(ctx context.Context, token string) (string, string, string, error)
+	UpdateUserContext(ctx context.Context, userID, permissions string) error
+	CheckHealthContext(ctx context.Context) error
+}
+
+// Default time allowed for each database operation made on behalf of a client.
+const defaultDBTimeout = 10 * time.Second
+
+// SetDatabaseTimeout sets the maximum time for each database operation made on
+// behalf of a client. If it is exceeded, the client is sent an error and
+// disconnected, so that it reconnects. The default is 10 seconds. Zero means no limit.
+func (zh *Handler) SetDatabaseTimeout(timeout time.Duration) {
+	zh.hub.dbTimeout = timeout
+}
+
+// WithContext returns db as a ContextDocumentDB. If it does not implement the
+// interface, each operation is run in another goroutine, so that it returns
+// when the context is done even if the operation is still running. Panics are
+// returned as errors.
+func WithContext(db DocumentDB) ContextDocumentDB {
+	if cdb, ok := db.(ContextDocumentDB); ok {
+		return cdb
+	}
+	return contextAdapter{db}
+}
+
+type contextAdapter struct {
+	db DocumentDB
+}
+
+// call runs fn, returning the context's error if it is done first.
+func (a contextAdapter) call(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// If the context can never be done, there is no need for another goroutine.
+	if ctx.Done() == nil {
+		return recoverError(fn)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- recoverError(fn)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recoverError runs fn and returns its error, or the value passed to panic.
+func recoverError(fn func() error) (err error) {
+	defer func() {
+		if thing := recover(); thing != nil {
+			if e, ok := thing.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", thing)
+			}
+		}
+	}()
+	return fn()
+}
+
+func (a contextAdapter) GetDocumentContext(ctx context.Context, docID string, mode CreateMode, initialData []byte) (doc []byte, created bool, err error) {
+	var result struct {
+		doc     []byte
+		created bool
+	}
+	err = a.call(ctx, func() (err error) {
+		if udb, ok := a.db.(userDocumentDB); ok {
+			result.doc, result.created, err = udb.getDocumentByUser(docID, mode, initialData, UserIDFromContext(ctx))
+		} else {
+			result.doc, result.created, err = a.db.GetDocument(docID, mode, initialData)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return result.doc, result.created, nil
+}
+
+func (a contextAdapter) AppendDocumentContext(ctx context.Context, docID string, oldLength uint64, newData []byte) (uint64, error) {
+	var length uint64
+	err := a.call(ctx, func() (err error) {
+		if udb, ok := a.db.(userDocumentDB); ok {
+			length, err = udb.appendDocumentByUser(docID, oldLength, newData, UserIDFromContext(ctx))
+		} else {
+			length, err = a.db.AppendDocument(docID, oldLength, newData)
+		}
+		return err
+	})
+	if err != nil && err != ErrConflict {
+		return 0, err
+	}
+	return length, err
+}
+
+func (a contextAdapter) SetDocumentKeyContext(ctx context.Context, docID string, oldVersion int, key Key) error {
+	return a.call(ctx, func() error {
+		return a.db.SetDocumentKey(docID, oldVersion, key)
+	})
+}
+
+func (a contextAdapter) GetDocumentKeysContext(ctx context.Context, docID string) ([]Key, error) {
+	var keys []Key
+	err := a.call(ctx, func() (err error) {
+		keys, err = a.db.GetDocumentKeys(docID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (a contextAdapter) DeleteDocumentContext(ctx context.Context, docID string) error {
+	return a.call(ctx, func() error {
+		return a.db.DeleteDocument(docID)
+	})
+}
+
+func (a contextAdapter) AddTokenContext(ctx context.Context, token, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	return a.call(ctx, func() error {
+		return a.db.AddToken(token, docID, userID, permissions, expirationSeconds, contents)
+	})
+}
+
+func (a contextAdapter) GetTokenContext(ctx context.Context, token string) (string, string, string, error) {
+	var docID, userID, permissions string
+	err := a.call(ctx, func() (err error) {
+		docID, userID, permissions, err = a.db.GetToken(token)
+		return err
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+	return docID, userID, permissions, nil
+}
+
+func (a contextAdapter) UpdateUserContext(ctx context.Context, userID, permissions string) error {
+	return a.call(ctx, func() error {
+		return a.db.UpdateUser(userID, permissions)
+	})
+}
+
+func (a contextAdapter) CheckHealthContext(ctx context.Context) error {
+	return a.call(ctx, func() error {
+		return a.db.CheckHealth()
+	})
+}
@@ -0,0 +1,174 @@
+package dbtest
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smhanov/zwibserve"
+)
+
+// BenchmarkFactory returns a database for a benchmark. If the database
+// implements io.Closer, it is closed when the benchmark ends.
+type BenchmarkFactory func(b *testing.B) zwibserve.DocumentDB
+
+type contentionBenchmark struct {
+	name string
+	run  func(b *testing.B, db zwibserve.DocumentDB)
+}
+
+var contentionBenchmarks = []contentionBenchmark{
+	{"Append", benchmarkAppend},
+	{"SetDocumentKey", benchmarkSetDocumentKey},
+	{"AddToken", benchmarkAddToken},
+	{"UpdateUser", benchmarkUpdateUser},
+}
+
+// RunContentionBenchmarks measures the operations that must check a value
+// before changing it, when many writers use the same document or user at
+// once, as when many teachers draw on one board. Call it from a benchmark in
+// your own package, and use -cpu or b.SetParallelism to vary the number of
+// writers:
+//
+//	func BenchmarkRedis(b *testing.B) {
+//		dbtest.RunContentionBenchmarks(b, func(b *testing.B) zwibserve.DocumentDB {
+//			return zwibserve.NewRedisDB(&redis.Options{Addr: "localhost:6379"})
+//		})
+//	}
+//
+// Besides the time per operation, each benchmark reports the number of
+// conflicts per operation, which writers resolve by trying again.
+func RunContentionBenchmarks(b *testing.B, factory BenchmarkFactory) {
+	for _, bench := range contentionBenchmarks {
+		bench := bench
+		b.Run(bench.name, func(b *testing.B) {
+			db := factory(b)
+			if closer, ok := db.(io.Closer); ok {
+				defer closer.Close()
+			}
+			bench.run(b, db)
+		})
+	}
+}
+
+func benchmarkID(name string) string {
+	return fmt.Sprintf("bench-%s-%d", name, time.Now().UnixNano())
+}
+
+// benchmarkAppend has every writer append to the same document, starting
+// again from the current length after each conflict.
+func benchmarkAppend(b *testing.B, db zwibserve.DocumentDB) {
+	id := benchmarkID("append")
+	if _, _, err := db.GetDocument(id, zwibserve.AlwaysCreate, []byte{}); err != nil {
+		b.Fatal(err)
+	}
+	defer db.DeleteDocument(id)
+
+	change := make([]byte, 200)
+	var conflicts int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var length uint64
+		for pb.Next() {
+			for {
+				newLength, err := db.AppendDocument(id, length, change)
+				if err == zwibserve.ErrConflict {
+					atomic.AddInt64(&conflicts, 1)
+					length = newLength
+					continue
+				} else if err != nil {
+					b.Fatal(err)
+				}
+				length = newLength
+				break
+			}
+		}
+	})
+	b.ReportMetric(float64(conflicts)/float64(b.N), "conflicts/op")
+}
+
+// benchmarkSetDocumentKey has every writer increment the version of the same
+// key, reading it again after each conflict.
+func benchmarkSetDocumentKey(b *testing.B, db zwibserve.DocumentDB) {
+	id := benchmarkID("key")
+	if _, _, err := db.GetDocument(id, zwibserve.AlwaysCreate, []byte{}); err != nil {
+		b.Fatal(err)
+	}
+	defer db.DeleteDocument(id)
+
+	var conflicts int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		version := 0
+		for pb.Next() {
+			for {
+				key := zwibserve.Key{Name: "page", Value: fmt.Sprint(version + 1), Version: version + 1}
+				err := db.SetDocumentKey(id, version, key)
+				if err == zwibserve.ErrConflict {
+					atomic.AddInt64(&conflicts, 1)
+					keys, err := db.GetDocumentKeys(id)
+					if err != nil {
+						b.Fatal(err)
+					}
+					for _, k := range keys {
+						if k.Name == key.Name {
+							version = k.Version
+						}
+					}
+					continue
+				} else if err != nil {
+					b.Fatal(err)
+				}
+				version++
+				break
+			}
+		}
+	})
+	b.ReportMetric(float64(conflicts)/float64(b.N), "conflicts/op")
+}
+
+// benchmarkAddToken adds tokens for the same user.
+func benchmarkAddToken(b *testing.B, db zwibserve.DocumentDB) {
+	prefix := benchmarkID("token")
+	expiration := time.Now().Add(time.Hour).Unix()
+	var count int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&count, 1)
+			err := db.AddToken(fmt.Sprintf("%s-%d", prefix, n), prefix, prefix, "edit", expiration, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// benchmarkUpdateUser changes the permissions of a user with ten tokens,
+// while tokens are read.
+func benchmarkUpdateUser(b *testing.B, db zwibserve.DocumentDB) {
+	user := benchmarkID("user")
+	expiration := time.Now().Add(time.Hour).Unix()
+	for i := 0; i < 10; i++ {
+		if err := db.AddToken(fmt.Sprintf("%s-%d", user, i), user, user, "edit", expiration, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var count int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&count, 1)
+			if n%2 == 0 {
+				if _, _, _, err := db.GetToken(fmt.Sprintf("%s-%d", user, n%10)); err != nil {
+					b.Fatal(err)
+				}
+			} else if err := db.UpdateUser(user, fmt.Sprint("view", n)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
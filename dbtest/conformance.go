@@ -0,0 +1,648 @@
+// Package dbtest contains tests that every implementation of
+// zwibserve.DocumentDB must pass. Call RunConformance from a test in your own
+// package to check a custom database:
+//
+//	func TestMyDB(t *testing.T) {
+//		dbtest.RunConformance(t, func(t *testing.T) zwibserve.DocumentDB {
+//			return NewMyDB()
+//		})
+//	}
+package dbtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smhanov/zwibserve"
+)
+
+// Factory returns a new, empty database. It is called once for each test. If
+// the database implements io.Closer, it is closed when the test ends.
+type Factory func(t *testing.T) zwibserve.DocumentDB
+
+type conformanceTest struct {
+	name string
+	run  func(t *testing.T, db zwibserve.DocumentDB)
+}
+
+var conformanceTests = []conformanceTest{
+	{"CreateModes", testCreateModes},
+	{"EmptyDocument", testEmptyDocument},
+	{"Append", testAppend},
+	{"ConcurrentAppends", testConcurrentAppends},
+	{"Keys", testKeys},
+	{"DeleteDocument", testDeleteDocument},
+	{"Tokens", testTokens},
+	{"TokenDocument", testTokenDocument},
+	{"ExpiredToken", testExpiredToken},
+	{"Expiration", testExpiration},
+	{"UpdateUser", testUpdateUser},
+	{"CheckHealth", testCheckHealth},
+	{"ListDocuments", testListDocuments},
+	{"ListTokens", testListTokens},
+	{"DocumentInfo", testDocumentInfo},
+}
+
+// RunConformance runs each conformance test as a subtest, using a new database
+// from the factory.
+func RunConformance(t *testing.T, factory Factory) {
+	for _, test := range conformanceTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db := factory(t)
+			if closer, ok := db.(io.Closer); ok {
+				defer closer.Close()
+			}
+			test.run(t, db)
+		})
+	}
+}
+
+// docID returns a document ID that is not used by other runs of the tests, in
+// case the database is not empty.
+func docID(t *testing.T, name string) string {
+	return fmt.Sprintf("%s-%s-%d", t.Name(), name, time.Now().UnixNano())
+}
+
+func expectError(t *testing.T, what string, err, expected error) {
+	t.Helper()
+	if err != expected {
+		t.Fatalf("%s: expected error %v, got %v", what, expected, err)
+	}
+}
+
+func expectDocument(t *testing.T, db zwibserve.DocumentDB, docID string, expected []byte) {
+	t.Helper()
+	doc, created, err := db.GetDocument(docID, zwibserve.NeverCreate, nil)
+	if err != nil {
+		t.Fatalf("GetDocument(%s): %v", docID, err)
+	}
+	if created {
+		t.Fatalf("GetDocument(%s) with NeverCreate reported that it was created", docID)
+	}
+	if !bytes.Equal(doc, expected) {
+		t.Fatalf("GetDocument(%s): expected %q, got %q", docID, expected, doc)
+	}
+}
+
+func testCreateModes(t *testing.T, db zwibserve.DocumentDB) {
+	id := docID(t, "doc")
+
+	_, _, err := db.GetDocument(id, zwibserve.NeverCreate, nil)
+	expectError(t, "NeverCreate of missing document", err, zwibserve.ErrMissing)
+
+	doc, created, err := db.GetDocument(id, zwibserve.PossiblyCreate, []byte("hello"))
+	if err != nil || !created || string(doc) != "hello" {
+		t.Fatalf("PossiblyCreate of missing document returned %q, %v, %v", doc, created, err)
+	}
+
+	doc, created, err = db.GetDocument(id, zwibserve.PossiblyCreate, []byte("other"))
+	if err != nil || created || string(doc) != "hello" {
+		t.Fatalf("PossiblyCreate of existing document returned %q, %v, %v", doc, created, err)
+	}
+
+	_, _, err = db.GetDocument(id, zwibserve.AlwaysCreate, []byte("other"))
+	expectError(t, "AlwaysCreate of existing document", err, zwibserve.ErrExists)
+	expectDocument(t, db, id, []byte("hello"))
+
+	id2 := docID(t, "doc2")
+	doc, created, err = db.GetDocument(id2, zwibserve.AlwaysCreate, []byte("new"))
+	if err != nil || !created || string(doc) != "new" {
+		t.Fatalf("AlwaysCreate of missing document returned %q, %v, %v", doc, created, err)
+	}
+}
+
+func testEmptyDocument(t *testing.T, db zwibserve.DocumentDB) {
+	id := docID(t, "doc")
+	_, created, err := db.GetDocument(id, zwibserve.PossiblyCreate, nil)
+	if err != nil || !created {
+		t.Fatalf("creating empty document returned %v, %v", created, err)
+	}
+
+	expectDocument(t, db, id, nil)
+
+	length, err := db.AppendDocument(id, 0, []byte("abc"))
+	if err != nil || length != 3 {
+		t.Fatalf("appending to empty document returned %v, %v", length, err)
+	}
+	expectDocument(t, db, id, []byte("abc"))
+}
+
+func testAppend(t *testing.T, db zwibserve.DocumentDB) {
+	id := docID(t, "doc")
+
+	_, err := db.AppendDocument(id, 0, []byte("abc"))
+	expectError(t, "AppendDocument to missing document", err, zwibserve.ErrMissing)
+
+	_, _, err = db.GetDocument(id, zwibserve.PossiblyCreate, []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length, err := db.AppendDocument(id, 3, []byte("def"))
+	if err != nil || length != 6 {
+		t.Fatalf("AppendDocument returned %v, %v", length, err)
+	}
+
+	length, err = db.AppendDocument(id, 3, []byte("xyz"))
+	expectError(t, "AppendDocument at old length", err, zwibserve.ErrConflict)
+	if length != 6 {
+		t.Fatalf("AppendDocument conflict returned length %d, expected 6", length)
+	}
+
+	length, err = db.AppendDocument(id, 7, []byte("xyz"))
+	expectError(t, "AppendDocument past end", err, zwibserve.ErrConflict)
+	if length != 6 {
+		t.Fatalf("AppendDocument conflict returned length %d, expected 6", length)
+	}
+
+	expectDocument(t, db, id, []byte("abcdef"))
+}
+
+// testConcurrentAppends checks that when several writers append at the same
+// length, exactly one succeeds.
+func testConcurrentAppends(t *testing.T, db zwibserve.DocumentDB) {
+	const writers = 8
+	const attempts = 20
+
+	id := docID(t, "doc")
+	_, _, err := db.GetDocument(id, zwibserve.PossiblyCreate, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var appended [][]byte
+	errs := make(chan error, writers)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for j := 0; j < attempts; j++ {
+				doc, _, err := db.GetDocument(id, zwibserve.NeverCreate, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				data := []byte(fmt.Sprintf("[%d.%d]", writer, j))
+				_, err = db.AppendDocument(id, uint64(len(doc)), data)
+				if err == zwibserve.ErrConflict {
+					continue
+				} else if err != nil {
+					errs <- err
+					return
+				}
+
+				mutex.Lock()
+				appended = append(appended, data)
+				mutex.Unlock()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent append: %v", err)
+	}
+
+	doc, _, err := db.GetDocument(id, zwibserve.NeverCreate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, data := range appended {
+		total += len(data)
+		if !bytes.Contains(doc, data) {
+			t.Fatalf("successful append %q is missing from the document", data)
+		}
+	}
+	if total != len(doc) {
+		t.Fatalf("document has %d bytes, but %d bytes were appended", len(doc), total)
+	}
+}
+
+func keyMap(t *testing.T, db zwibserve.DocumentDB, docID string) map[string]zwibserve.Key {
+	t.Helper()
+	keys, err := db.GetDocumentKeys(docID)
+	if err != nil {
+		t.Fatalf("GetDocumentKeys(%s): %v", docID, err)
+	}
+
+	m := make(map[string]zwibserve.Key)
+	for _, key := range keys {
+		if _, ok := m[key.Name]; ok {
+			t.Fatalf("GetDocumentKeys(%s) returned key %s more than once", docID, key.Name)
+		}
+		m[key.Name] = key
+	}
+	return m
+}
+
+func testKeys(t *testing.T, db zwibserve.DocumentDB) {
+	id := docID(t, "doc")
+	other := docID(t, "other")
+	for _, docID := range []string{id, other} {
+		if _, _, err := db.GetDocument(docID, zwibserve.PossiblyCreate, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if keys := keyMap(t, db, id); len(keys) != 0 {
+		t.Fatalf("new document has keys %v", keys)
+	}
+
+	err := db.SetDocumentKey(id, 1, zwibserve.Key{Name: "a", Value: "1", Version: 2})
+	expectError(t, "SetDocumentKey of missing key with version 1", err, zwibserve.ErrConflict)
+
+	err = db.SetDocumentKey(id, 0, zwibserve.Key{Name: "a", Value: "1", Version: 1})
+	expectError(t, "SetDocumentKey of new key", err, nil)
+
+	err = db.SetDocumentKey(id, 0, zwibserve.Key{Name: "a", Value: "2", Version: 1})
+	expectError(t, "SetDocumentKey of existing key with version 0", err, zwibserve.ErrConflict)
+
+	err = db.SetDocumentKey(id, 1, zwibserve.Key{Name: "a", Value: "2", Version: 2})
+	expectError(t, "SetDocumentKey with current version", err, nil)
+
+	err = db.SetDocumentKey(id, 1, zwibserve.Key{Name: "a", Value: "3", Version: 3})
+	expectError(t, "SetDocumentKey with old version", err, zwibserve.ErrConflict)
+
+	err = db.SetDocumentKey(id, 0, zwibserve.Key{Name: "b", Value: "x", Version: 1})
+	expectError(t, "SetDocumentKey of second key", err, nil)
+
+	keys := keyMap(t, db, id)
+	if len(keys) != 2 || keys["a"].Value != "2" || keys["a"].Version != 2 || keys["b"].Value != "x" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	if keys := keyMap(t, db, other); len(keys) != 0 {
+		t.Fatalf("keys of one document appear in another: %v", keys)
+	}
+}
+
+func testDeleteDocument(t *testing.T, db zwibserve.DocumentDB) {
+	id := docID(t, "doc")
+	if _, _, err := db.GetDocument(id, zwibserve.PossiblyCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AppendDocument(id, 3, []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetDocumentKey(id, 0, zwibserve.Key{Name: "a", Value: "1", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeleteDocument(id); err != nil {
+		t.Fatalf("DeleteDocument: %v", err)
+	}
+
+	_, _, err := db.GetDocument(id, zwibserve.NeverCreate, nil)
+	expectError(t, "GetDocument of deleted document", err, zwibserve.ErrMissing)
+	_, err = db.AppendDocument(id, 6, []byte("ghi"))
+	expectError(t, "AppendDocument to deleted document", err, zwibserve.ErrMissing)
+
+	if keys := keyMap(t, db, id); len(keys) != 0 {
+		t.Fatalf("deleted document still has keys %v", keys)
+	}
+
+	// A new document with the same ID starts empty.
+	doc, created, err := db.GetDocument(id, zwibserve.PossiblyCreate, []byte("new"))
+	if err != nil || !created || string(doc) != "new" {
+		t.Fatalf("recreating deleted document returned %q, %v, %v", doc, created, err)
+	}
+
+	err = db.SetDocumentKey(id, 0, zwibserve.Key{Name: "a", Value: "2", Version: 1})
+	expectError(t, "SetDocumentKey on recreated document", err, nil)
+
+	if err := db.DeleteDocument(docID(t, "missing")); err != nil {
+		t.Fatalf("DeleteDocument of missing document: %v", err)
+	}
+}
+
+func expectToken(t *testing.T, db zwibserve.DocumentDB, token, docID, userID, permissions string) {
+	t.Helper()
+	gotDocID, gotUserID, gotPermissions, err := db.GetToken(token)
+	if err != nil {
+		t.Fatalf("GetToken(%s): %v", token, err)
+	}
+	if gotDocID != docID || gotUserID != userID || gotPermissions != permissions {
+		t.Fatalf("GetToken(%s) returned %s, %s, %s; expected %s, %s, %s", token,
+			gotDocID, gotUserID, gotPermissions, docID, userID, permissions)
+	}
+}
+
+func expiresIn(d time.Duration) int64 {
+	return time.Now().Add(d).Unix()
+}
+
+func testTokens(t *testing.T, db zwibserve.DocumentDB) {
+	token := docID(t, "token")
+	id := docID(t, "doc")
+
+	_, _, _, err := db.GetToken(token)
+	expectError(t, "GetToken of missing token", err, zwibserve.ErrMissing)
+
+	err = db.AddToken(token, id, "user", "rw", expiresIn(time.Hour), nil)
+	expectError(t, "AddToken", err, nil)
+	expectToken(t, db, token, id, "user", "rw")
+
+	err = db.AddToken(token, id, "other", "r", expiresIn(time.Hour), nil)
+	expectError(t, "AddToken of existing token", err, zwibserve.ErrExists)
+	expectToken(t, db, token, id, "user", "rw")
+
+	// Without contents, the document is not created.
+	_, _, err = db.GetDocument(id, zwibserve.NeverCreate, nil)
+	expectError(t, "GetDocument after AddToken without contents", err, zwibserve.ErrMissing)
+}
+
+func testTokenDocument(t *testing.T, db zwibserve.DocumentDB) {
+	id := docID(t, "doc")
+
+	err := db.AddToken(docID(t, "token1"), id, "user", "rw", expiresIn(time.Hour), []byte("contents"))
+	expectError(t, "AddToken with contents", err, nil)
+	expectDocument(t, db, id, []byte("contents"))
+
+	err = db.AddToken(docID(t, "token2"), id, "user", "rw", expiresIn(time.Hour), []byte("replaced"))
+	expectError(t, "AddToken with contents for existing document", err, zwibserve.ErrConflict)
+	expectDocument(t, db, id, []byte("contents"))
+
+	// Without contents, the existing document is left alone.
+	err = db.AddToken(docID(t, "token3"), id, "user", "rw", expiresIn(time.Hour), nil)
+	expectError(t, "AddToken without contents for existing document", err, nil)
+	expectDocument(t, db, id, []byte("contents"))
+}
+
+func testExpiredToken(t *testing.T, db zwibserve.DocumentDB) {
+	token := docID(t, "token")
+	err := db.AddToken(token, docID(t, "doc"), "user", "rw", expiresIn(-time.Minute), nil)
+	expectError(t, "AddToken", err, nil)
+
+	_, _, _, err = db.GetToken(token)
+	expectError(t, "GetToken of expired token", err, zwibserve.ErrMissing)
+}
+
+// testExpiration checks that setting an expiration does not remove documents
+// and tokens that are still in use, and removes those which are not.
+func testExpiration(t *testing.T, db zwibserve.DocumentDB) {
+	db.SetExpiration(3600)
+	token := docID(t, "token")
+	id := docID(t, "doc")
+
+	err := db.AddToken(token, id, "user", "rw", expiresIn(time.Hour), []byte("abc"))
+	expectError(t, "AddToken", err, nil)
+
+	// The databases remove expired items when documents are accessed.
+	if _, _, err := db.GetDocument(docID(t, "other"), zwibserve.PossiblyCreate, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AppendDocument(id, 3, []byte("def")); err != nil {
+		t.Fatalf("AppendDocument: %v", err)
+	}
+
+	expectDocument(t, db, id, []byte("abcdef"))
+	expectToken(t, db, token, id, "user", "rw")
+
+	db.SetExpiration(zwibserve.NoExpiration)
+	expectDocument(t, db, id, []byte("abcdef"))
+
+	testExpiredRemoved(t, db)
+}
+
+// testExpiredRemoved checks that documents which have not been accessed within
+// the expiration time, and expired tokens, are removed.
+func testExpiredRemoved(t *testing.T, db zwibserve.DocumentDB) {
+	db.SetExpiration(1)
+	old := docID(t, "old")
+	expiredToken := docID(t, "expired")
+	if _, _, err := db.GetDocument(old, zwibserve.PossiblyCreate, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetDocumentKey(old, 0, zwibserve.Key{Name: "a", Value: "1", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	err := db.AddToken(expiredToken, old, "user", "rw", expiresIn(-time.Minute), nil)
+	expectError(t, "AddToken", err, nil)
+
+	// Access times are recorded in seconds.
+	time.Sleep(2200 * time.Millisecond)
+
+	id := docID(t, "doc")
+	token := docID(t, "token")
+	err = db.AddToken(token, id, "user", "rw", expiresIn(time.Hour), []byte("abc"))
+	expectError(t, "AddToken", err, nil)
+
+	// Setting the expiration again removes expired items at the next access,
+	// which may happen in the background.
+	db.SetExpiration(1)
+	expectDocument(t, db, id, []byte("abc"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(keyMap(t, db, old)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired document %s was not removed", old)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	_, _, err = db.GetDocument(old, zwibserve.NeverCreate, nil)
+	expectError(t, "GetDocument of expired document", err, zwibserve.ErrMissing)
+	expectToken(t, db, token, id, "user", "rw")
+
+	// The ID of a removed token can be used again.
+	err = db.AddToken(expiredToken, id, "other", "r", expiresIn(time.Hour), nil)
+	expectError(t, "AddToken of removed token", err, nil)
+	expectToken(t, db, expiredToken, id, "other", "r")
+
+	db.SetExpiration(zwibserve.NoExpiration)
+}
+
+func testUpdateUser(t *testing.T, db zwibserve.DocumentDB) {
+	id := docID(t, "doc")
+	user := docID(t, "user")
+	other := docID(t, "other")
+	token1 := docID(t, "token1")
+	token2 := docID(t, "token2")
+	token3 := docID(t, "token3")
+
+	for _, token := range []struct{ id, user string }{{token1, user}, {token2, user}, {token3, other}} {
+		err := db.AddToken(token.id, id, token.user, "r", expiresIn(time.Hour), nil)
+		expectError(t, "AddToken", err, nil)
+	}
+
+	err := db.UpdateUser(user, "rw")
+	expectError(t, "UpdateUser", err, nil)
+
+	expectToken(t, db, token1, id, user, "rw")
+	expectToken(t, db, token2, id, user, "rw")
+	expectToken(t, db, token3, id, other, "r")
+
+	err = db.UpdateUser(docID(t, "nobody"), "rw")
+	expectError(t, "UpdateUser of user without tokens", err, nil)
+}
+
+func testCheckHealth(t *testing.T, db zwibserve.DocumentDB) {
+	if err := db.CheckHealth(); err != nil {
+		t.Fatalf("CheckHealth: %v", err)
+	}
+}
+
+// listDocuments returns the set of document IDs listed by the database.
+func listDocuments(t *testing.T, lister zwibserve.DocumentLister) map[string]bool {
+	t.Helper()
+	listed := make(map[string]bool)
+	err := lister.ListDocuments(context.Background(), func(docID string) error {
+		if listed[docID] {
+			t.Errorf("ListDocuments listed %s twice", docID)
+		}
+		listed[docID] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListDocuments: %v", err)
+	}
+	return listed
+}
+
+func testListDocuments(t *testing.T, db zwibserve.DocumentDB) {
+	lister, ok := db.(zwibserve.DocumentLister)
+	if !ok {
+		t.Skip("the database does not implement DocumentLister")
+	}
+
+	ids := []string{docID(t, "doc1"), docID(t, "doc2"), docID(t, "empty")}
+	for i, id := range ids {
+		contents := []byte("abc")
+		if i == 2 {
+			contents = nil
+		}
+		if _, _, err := db.GetDocument(id, zwibserve.PossiblyCreate, contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed := listDocuments(t, lister)
+	for _, id := range ids {
+		if !listed[id] {
+			t.Fatalf("ListDocuments did not list %s", id)
+		}
+	}
+
+	if err := db.DeleteDocument(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if listed := listDocuments(t, lister); listed[ids[0]] || !listed[ids[1]] {
+		t.Fatalf("after deleting %s, ListDocuments listed it=%v, %s=%v", ids[0], listed[ids[0]], ids[1], listed[ids[1]])
+	}
+
+	// An error from fn stops the listing.
+	stop := errors.New("stop")
+	calls := 0
+	err := lister.ListDocuments(context.Background(), func(docID string) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("ListDocuments returned %v after %d calls; expected the error of the first call", err, calls)
+	}
+}
+
+func testListTokens(t *testing.T, db zwibserve.DocumentDB) {
+	lister, ok := db.(zwibserve.TokenLister)
+	if !ok {
+		t.Skip("the database does not implement TokenLister")
+	}
+
+	id := docID(t, "doc")
+	token := docID(t, "token")
+	expired := docID(t, "expired")
+	expiration := expiresIn(time.Hour)
+	expectError(t, "AddToken", db.AddToken(token, id, "user", "rw", expiration, nil), nil)
+	expectError(t, "AddToken", db.AddToken(expired, id, "user", "rw", expiresIn(-time.Minute), nil), nil)
+
+	var found []zwibserve.TokenInfo
+	err := lister.ListTokens(context.Background(), func(info zwibserve.TokenInfo) error {
+		if info.Token == token || info.Token == expired {
+			found = append(found, info)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListTokens: %v", err)
+	}
+
+	expected := zwibserve.TokenInfo{Token: token, DocID: id, UserID: "user", Permissions: "rw", Expiration: expiration}
+	if len(found) != 1 || found[0] != expected {
+		t.Fatalf("ListTokens listed %v; expected %v", found, expected)
+	}
+
+	stop := errors.New("stop")
+	err = lister.ListTokens(context.Background(), func(info zwibserve.TokenInfo) error {
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("ListTokens returned %v; expected the error of fn", err)
+	}
+}
+
+func testDocumentInfo(t *testing.T, db zwibserve.DocumentDB) {
+	provider, ok := db.(zwibserve.DocumentInfoProvider)
+	if !ok {
+		t.Skip("the database does not implement DocumentInfoProvider")
+	}
+
+	ctx := context.Background()
+	cdb := zwibserve.WithContext(db)
+	id := docID(t, "doc")
+
+	_, err := provider.GetDocumentInfo(ctx, id)
+	expectError(t, "GetDocumentInfo of missing document", err, zwibserve.ErrMissing)
+
+	// Times are recorded in seconds.
+	start := time.Now().Truncate(time.Second)
+	if _, _, err := cdb.GetDocumentContext(zwibserve.WithUserID(ctx, "creator"), id, zwibserve.AlwaysCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := provider.GetDocumentInfo(ctx, id)
+	if err != nil {
+		t.Fatalf("GetDocumentInfo: %v", err)
+	}
+	if info.DocID != id || info.Length != 3 || info.Creator != "creator" || info.Appends != 0 ||
+		info.Created.Before(start) || info.Modified != info.Created || info.LastWriter != "creator" {
+		t.Fatalf("information of new document is %+v", info)
+	}
+
+	for _, data := range []string{"def", "gh"} {
+		doc, _, err := db.GetDocument(id, zwibserve.NeverCreate, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cdb.AppendDocumentContext(zwibserve.WithUserID(ctx, "writer"), id, uint64(len(doc)), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err = provider.GetDocumentInfo(ctx, id)
+	if err != nil {
+		t.Fatalf("GetDocumentInfo: %v", err)
+	}
+	if info.Length != 8 || info.Creator != "creator" || info.LastWriter != "writer" || info.Appends != 2 ||
+		info.Modified.Before(info.Created) {
+		t.Fatalf("information after two appends is %+v", info)
+	}
+
+	if err := db.DeleteDocument(id); err != nil {
+		t.Fatal(err)
+	}
+	_, err = provider.GetDocumentInfo(ctx, id)
+	expectError(t, "GetDocumentInfo of deleted document", err, zwibserve.ErrMissing)
+}
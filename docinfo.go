@@ -0,0 +1,113 @@
+package zwibserve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var errInfoUnsupported = errors.New("the database does not record document information")
+
+// DocumentInfo describes a document, without its contents. Documents created
+// before the database recorded this information have a zero Created and
+// Modified time, and count only the appends made since.
+type DocumentInfo struct {
+	DocID string
+
+	// When the document was created, and the user who created it, if known
+	Created time.Time
+	Creator string
+
+	// Size of the contents in bytes
+	Length uint64
+
+	// When the document was last appended to, and by whom. Until the first
+	// append, these are the same as Created and Creator.
+	Modified   time.Time
+	LastWriter string
+
+	// Number of times the document has been appended to
+	Appends int64
+}
+
+// DocumentInfoProvider is implemented by document databases that record who
+// created and changed each document. All of the included databases do.
+type DocumentInfoProvider interface {
+	// GetDocumentInfo returns the information about the document, or ErrMissing.
+	GetDocumentInfo(ctx context.Context, docID string) (DocumentInfo, error)
+}
+
+type userIDKey struct{}
+
+// WithUserID returns a context that tells the database which user is creating
+// or appending to a document, so that it can be recorded in the DocumentInfo.
+// The server does this for each client that connects with a token.
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// UserIDFromContext returns the user ID given to WithUserID, or "".
+func UserIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDKey{}).(string)
+	return userID
+}
+
+// userDocumentDB is implemented by the included databases that do not take a
+// context, so that contextAdapter can tell them which user is creating or
+// appending to a document.
+type userDocumentDB interface {
+	getDocumentByUser(docID string, mode CreateMode, initialData []byte, userID string) ([]byte, bool, error)
+	appendDocumentByUser(docID string, oldLength uint64, newData []byte, userID string) (uint64, error)
+}
+
+// documentInfoResult is the response of getDocumentInfo. Unknown times are empty.
+type documentInfoResult struct {
+	DocumentID string `json:"documentID"`
+	Created    string `json:"created"`
+	Creator    string `json:"creator"`
+	Length     uint64 `json:"length"`
+	Modified   string `json:"modified"`
+	LastWriter string `json:"lastWriter"`
+	Appends    int64  `json:"appends"`
+}
+
+func formatInfoTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (zh *Handler) handleGetDocumentInfo(w http.ResponseWriter, r *http.Request) {
+	zh.log.info("management request", field("method", "getDocumentInfo"))
+	zh.verifyAuth(r)
+
+	provider, ok := zh.db.db.(DocumentInfoProvider)
+	if !ok {
+		HTTPPanic(501, "The database does not record document information")
+	}
+
+	docID := zh.mustGet(r, "documentID")
+	info, err := provider.GetDocumentInfo(r.Context(), docID)
+	if err == errInfoUnsupported {
+		HTTPPanic(501, "The database does not record document information")
+	} else if err == ErrMissing {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(documentInfoResult{
+		DocumentID: info.DocID,
+		Created:    formatInfoTime(info.Created),
+		Creator:    info.Creator,
+		Length:     info.Length,
+		Modified:   formatInfoTime(info.Modified),
+		LastWriter: info.LastWriter,
+		Appends:    info.Appends,
+	})
+}
@@ -14,6 +14,7 @@ const (
 	errorMessageType          = 0x80
 	ackNackMessageType        = 0x81
 	keyInformationMessageType = 0x82
+	setKeyAckNackMessageType  = 0x83
 
 	serverIdentificationMessageType = 0x84
 	swarmRegisterMessageType        = 0x85
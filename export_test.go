@@ -0,0 +1,4 @@
+package zwibserve
+
+// TempDir is tempDir, for the tests in package zwibserve_test.
+var TempDir = tempDir
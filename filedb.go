@@ -0,0 +1,846 @@
+package zwibserve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileDocumentDB stores documents in a directory, without cgo or an external
+// server. Each document is a file that is only appended to, and its keys are
+// kept in a second file beside it, and the DocumentInfo in a third. The files are spread among 256
+// subdirectories of dir/docs. Tokens are recorded in dir/tokens.log and kept in
+// memory. Every change is synced to disk before it is acknowledged.
+//
+// Only one server may use the directory at a time.
+type FileDocumentDB struct {
+	dir        string
+	expiration int64
+	log        *logger
+	archive    Archive
+
+	// locks protect the files of the documents, chosen by the first byte of
+	// the hash of the document ID.
+	locks [256]sync.Mutex
+
+	tokenMutex sync.Mutex
+	tokens     map[string]*token
+	tokenFile  *os.File
+
+	// number of records in the token file
+	tokenRecords int
+
+	cleanMutex sync.Mutex
+	lastClean  time.Time
+	sweeping   int32
+	sweeps     sync.WaitGroup
+}
+
+// Each document file begins with the length of the document ID (4 bytes) and
+// the document ID, so that the document can be identified from its file.
+const fileDocHeaderSize = 4
+
+// Key files are rewritten when they have this many records more than keys.
+const fileKeysCompactSlack = 64
+
+// Each line of an info file records the time and user of the creation of the
+// document, or of an append to it.
+type fileInfoRecord struct {
+	Time   int64  `json:"time"`
+	UserID string `json:"userID"`
+}
+
+type fileTokenRecord struct {
+	Token       string `json:"token,omitempty"`
+	DocID       string `json:"docID,omitempty"`
+	UserID      string `json:"userID"`
+	Permissions string `json:"permissions"`
+	Expiration  int64  `json:"expiration,omitempty"`
+}
+
+// NewFileDB stores documents in the given directory, which is created if it
+// does not exist.
+func NewFileDB(dir string) (*FileDocumentDB, error) {
+	db := &FileDocumentDB{
+		dir:    dir,
+		log:    newLogger(nil),
+		tokens: make(map[string]*token),
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := db.loadTokens(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// SetLogger sets the destination of log messages.
+func (db *FileDocumentDB) SetLogger(l Logger) {
+	db.log.setOutput(l)
+}
+
+// SetArchive sets where documents are stored before they expire.
+func (db *FileDocumentDB) SetArchive(archive Archive) {
+	db.archive = archive
+}
+
+// SetExpiration ...
+func (db *FileDocumentDB) SetExpiration(seconds int64) {
+	atomic.StoreInt64(&db.expiration, seconds)
+	db.cleanMutex.Lock()
+	db.lastClean = time.Time{}
+	db.cleanMutex.Unlock()
+}
+
+// CheckHealth ...
+func (db *FileDocumentDB) CheckHealth() error {
+	_, err := os.Stat(filepath.Join(db.dir, "docs"))
+	return err
+}
+
+// Close waits for any expiration sweep to finish and closes the token file.
+func (db *FileDocumentDB) Close() error {
+	db.sweeps.Wait()
+	db.tokenMutex.Lock()
+	defer db.tokenMutex.Unlock()
+	return db.tokenFile.Close()
+}
+
+// docPaths returns the hash of the document ID, which names its files, and the
+// path of the document file. The keys file has the same path with .keys
+// instead of .doc.
+func (db *FileDocumentDB) docPaths(docID string) (string, string) {
+	sum := sha256.Sum256([]byte(docID))
+	hash := hex.EncodeToString(sum[:])
+	return hash, filepath.Join(db.dir, "docs", hash[:2], hash+".doc")
+}
+
+func keysPath(docPath string) string {
+	return strings.TrimSuffix(docPath, ".doc") + ".keys"
+}
+
+func infoPath(docPath string) string {
+	return strings.TrimSuffix(docPath, ".doc") + ".info"
+}
+
+// lock locks the files of the document with the given hash, and returns the
+// function that unlocks them.
+func (db *FileDocumentDB) lock(hash string) func() {
+	b, _ := hex.DecodeString(hash[:2])
+	mutex := &db.locks[b[0]]
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// readDocumentID reads only the ID from the header of a document file.
+func readDocumentID(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var header [fileDocHeaderSize]byte
+	if _, err := io.ReadFull(file, header[:]); err != nil {
+		return "", errors.New("document file is too short: " + path)
+	}
+	docID := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(file, docID); err != nil {
+		return "", errors.New("document file is too short: " + path)
+	}
+	return string(docID), nil
+}
+
+// readDocument returns the document ID and contents of a document file.
+func readDocument(path string) (string, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(data) < fileDocHeaderSize {
+		return "", nil, errors.New("document file is too short: " + path)
+	}
+	idLength := int(binary.BigEndian.Uint32(data))
+	if len(data) < fileDocHeaderSize+idLength {
+		return "", nil, errors.New("document file is too short: " + path)
+	}
+
+	return string(data[fileDocHeaderSize : fileDocHeaderSize+idLength]), data[fileDocHeaderSize+idLength:], nil
+}
+
+// writeFile creates or replaces the file with the contents, so that after a
+// crash it contains either the old contents or the new ones.
+func writeFile(path string, contents []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes the creation of files in the directory durable. Some systems
+// cannot sync directories, so errors are ignored.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
+
+// appendFile appends the data to the file and syncs it. If the file has the
+// wrong size, ErrConflict is returned with the size. The file must exist
+// unless create is true.
+func appendFile(path string, size int64, data []byte, create bool) (int64, error) {
+	flags := os.O_WRONLY | os.O_APPEND
+	if create {
+		flags |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if size >= 0 && info.Size() != size {
+		return info.Size(), ErrConflict
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// Do not leave part of the data in the file.
+		f.Truncate(info.Size())
+		return 0, err
+	}
+
+	if create && info.Size() == 0 {
+		syncDir(filepath.Dir(path))
+	}
+	return info.Size() + int64(len(data)), nil
+}
+
+// GetDocument ...
+func (db *FileDocumentDB) GetDocument(docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	return db.getDocumentByUser(docID, mode, initialData, "")
+}
+
+func (db *FileDocumentDB) getDocumentByUser(docID string, mode CreateMode, initialData []byte, userID string) ([]byte, bool, error) {
+	db.log.debug("GetDocument", field(fieldDocument, docID))
+	db.clean()
+
+	return getOrRestore(context.Background(), db.archive, db.log, docID, mode, initialData,
+		func(mode CreateMode, initialData []byte) ([]byte, bool, error) {
+			return db.getDocument(docID, mode, initialData, userID)
+		}, func(key Key) error {
+			return db.SetDocumentKey(docID, 0, key)
+		})
+}
+
+func (db *FileDocumentDB) getDocument(docID string, mode CreateMode, initialData []byte, userID string) ([]byte, bool, error) {
+	hash, path := db.docPaths(docID)
+	defer db.lock(hash)()
+
+	_, doc, err := readDocument(path)
+	if err == nil {
+		if mode == AlwaysCreate {
+			return nil, false, ErrExists
+		}
+
+		// The modification time is the last access time.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return doc, false, nil
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	if mode == NeverCreate {
+		return nil, false, ErrMissing
+	}
+
+	if err = db.createDocument(docID, path, initialData, userID); err != nil {
+		return nil, false, err
+	}
+	return initialData, true, nil
+}
+
+// createDocument writes a new document file and its info file. The document
+// must be locked.
+func (db *FileDocumentDB) createDocument(docID, path string, contents []byte, creator string) error {
+	header := make([]byte, fileDocHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(len(docID)))
+
+	var buffer bytes.Buffer
+	buffer.Write(header)
+	buffer.WriteString(docID)
+	buffer.Write(contents)
+	if err := writeFile(path, buffer.Bytes()); err != nil {
+		return err
+	}
+
+	record, err := json.Marshal(fileInfoRecord{Time: time.Now().Unix(), UserID: creator})
+	if err != nil {
+		return err
+	}
+	return writeFile(infoPath(path), append(record, '\n'))
+}
+
+// appendInfoRecord records an append in the info file. It is not synced,
+// since it is not needed to recover the document. The document must be locked.
+func appendInfoRecord(path string, userID string) error {
+	record, err := json.Marshal(fileInfoRecord{Time: time.Now().Unix(), UserID: userID})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(infoPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(record, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// GetDocumentInfo ...
+func (db *FileDocumentDB) GetDocumentInfo(ctx context.Context, docID string) (DocumentInfo, error) {
+	hash, path := db.docPaths(docID)
+	defer db.lock(hash)()
+
+	info := DocumentInfo{DocID: docID}
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return info, ErrMissing
+	} else if err != nil {
+		return info, err
+	}
+	info.Length = uint64(stat.Size()) - uint64(fileDocHeaderSize+len(docID))
+
+	f, err := os.Open(infoPath(path))
+	if os.IsNotExist(err) {
+		// created by an earlier version
+		return info, nil
+	} else if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	records := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record fileInfoRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// The last record may be incomplete after a crash.
+			continue
+		}
+		if records == 0 {
+			info.Created = time.Unix(record.Time, 0)
+			info.Creator = record.UserID
+		}
+		info.Modified = time.Unix(record.Time, 0)
+		info.LastWriter = record.UserID
+		records++
+	}
+	if records > 0 {
+		info.Appends = int64(records - 1)
+	}
+	return info, scanner.Err()
+}
+
+// AppendDocument ...
+func (db *FileDocumentDB) AppendDocument(docID string, oldLength uint64, newData []byte) (uint64, error) {
+	return db.appendDocumentByUser(docID, oldLength, newData, "")
+}
+
+func (db *FileDocumentDB) appendDocumentByUser(docID string, oldLength uint64, newData []byte, userID string) (uint64, error) {
+	db.log.debug("AppendDocument", field(fieldDocument, docID), field("bytes", len(newData)))
+	db.clean()
+
+	hash, path := db.docPaths(docID)
+	defer db.lock(hash)()
+
+	headerSize := int64(fileDocHeaderSize + len(docID))
+	size, err := appendFile(path, headerSize+int64(oldLength), newData, false)
+	if os.IsNotExist(err) {
+		return 0, ErrMissing
+	} else if err == ErrConflict {
+		return uint64(size - headerSize), ErrConflict
+	} else if err != nil {
+		return 0, err
+	}
+
+	if len(newData) > 0 {
+		if err := appendInfoRecord(path, userID); err != nil {
+			db.log.warn("cannot record append", field(fieldDocument, docID), field(fieldError, err))
+		}
+	}
+	return uint64(size - headerSize), nil
+}
+
+// readKeys returns the keys in the keys file, and the number of records in it.
+// Each record is a key in JSON on its own line, and later records replace
+// earlier ones with the same name.
+func readKeys(path string) ([]Key, int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var keys []Key
+	index := make(map[string]int)
+	records := 0
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var key Key
+		if err := json.Unmarshal(scanner.Bytes(), &key); err != nil {
+			// The last record may be incomplete after a crash.
+			continue
+		}
+		records++
+		if i, ok := index[key.Name]; ok {
+			keys[i] = key
+		} else {
+			index[key.Name] = len(keys)
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, records, scanner.Err()
+}
+
+// SetDocumentKey ...
+func (db *FileDocumentDB) SetDocumentKey(docID string, oldVersion int, key Key) error {
+	hash, path := db.docPaths(docID)
+	defer db.lock(hash)()
+
+	path = keysPath(path)
+	keys, records, err := readKeys(path)
+	if err != nil {
+		return err
+	}
+
+	exists := false
+	for i := range keys {
+		if keys[i].Name == key.Name {
+			if keys[i].Version != oldVersion {
+				return ErrConflict
+			}
+			keys[i] = key
+			exists = true
+		}
+	}
+
+	if !exists && oldVersion != 0 {
+		return ErrConflict
+	} else if !exists {
+		keys = append(keys, key)
+	}
+
+	if records+1 > len(keys)+fileKeysCompactSlack {
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		for _, k := range keys {
+			encoder.Encode(k)
+		}
+		return writeFile(path, buffer.Bytes())
+	}
+
+	record, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = appendFile(path, -1, append(record, '\n'), true)
+	return err
+}
+
+// GetDocumentKeys ...
+func (db *FileDocumentDB) GetDocumentKeys(docID string) ([]Key, error) {
+	hash, path := db.docPaths(docID)
+	defer db.lock(hash)()
+
+	keys, _, err := readKeys(keysPath(path))
+	return keys, err
+}
+
+// DeleteDocument ...
+func (db *FileDocumentDB) DeleteDocument(docID string) error {
+	hash, path := db.docPaths(docID)
+	unlock := db.lock(hash)
+	err := removeDocument(path)
+	unlock()
+
+	if err == nil && db.archive != nil {
+		err = db.archive.DeleteDocument(context.Background(), docID)
+	}
+	return err
+}
+
+// removeDocument removes the files of the document. The document must be locked.
+// ListDocuments ...
+func (db *FileDocumentDB) ListDocuments(ctx context.Context, fn func(docID string) error) error {
+	return filepath.Walk(filepath.Join(db.dir, "docs"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed during the listing
+			return nil
+		} else if err != nil || info.IsDir() || !strings.HasSuffix(path, ".doc") {
+			return err
+		}
+
+		docID, err := readDocumentID(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(docID)
+	})
+}
+
+// ListTokens ...
+func (db *FileDocumentDB) ListTokens(ctx context.Context, fn func(token TokenInfo) error) error {
+	db.tokenMutex.Lock()
+	now := time.Now().Unix()
+	var tokens []TokenInfo
+	for tokenID, token := range db.tokens {
+		if now < token.expiration {
+			tokens = append(tokens, TokenInfo{tokenID, token.docID, token.userID, token.permissions, token.expiration})
+		}
+	}
+	db.tokenMutex.Unlock()
+
+	return listTokensEach(ctx, tokens, fn)
+}
+
+func removeDocument(path string) error {
+	for _, name := range []string{path, keysPath(path), infoPath(path)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTokens reads the token file, and opens it to record changes.
+func (db *FileDocumentDB) loadTokens() error {
+	path := filepath.Join(db.dir, "tokens.log")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	var goodSize int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+
+		var record fileTokenRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			break
+		}
+		goodSize += int64(len(line))
+		db.applyTokenRecord(record)
+	}
+
+	// Remove an incomplete record at the end, written during a crash.
+	if err = f.Truncate(goodSize); err != nil {
+		f.Close()
+		return err
+	}
+
+	db.tokenFile = f
+	return nil
+}
+
+// applyTokenRecord adds a token, or if the record has no token, updates the
+// permissions of the user's tokens.
+func (db *FileDocumentDB) applyTokenRecord(record fileTokenRecord) {
+	db.tokenRecords++
+	if record.Token != "" {
+		db.tokens[record.Token] = &token{
+			docID:       record.DocID,
+			userID:      record.UserID,
+			permissions: record.Permissions,
+			expiration:  record.Expiration,
+		}
+		return
+	}
+
+	for _, token := range db.tokens {
+		if token.userID == record.UserID {
+			token.permissions = record.Permissions
+		}
+	}
+}
+
+// writeTokenRecord records the change in the token file and applies it. The
+// token mutex must be held.
+func (db *FileDocumentDB) writeTokenRecord(record fileTokenRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err = db.tokenFile.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = db.tokenFile.Sync(); err != nil {
+		return err
+	}
+
+	db.applyTokenRecord(record)
+	return nil
+}
+
+// AddToken ...
+func (db *FileDocumentDB) AddToken(tokenID, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	db.tokenMutex.Lock()
+	defer db.tokenMutex.Unlock()
+
+	if _, ok := db.tokens[tokenID]; ok {
+		return ErrExists
+	}
+
+	if len(contents) > 0 {
+		err := func() error {
+			hash, path := db.docPaths(docID)
+			defer db.lock(hash)()
+
+			if _, err := os.Stat(path); err == nil {
+				return ErrConflict
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+			return db.createDocument(docID, path, contents, userID)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.writeTokenRecord(fileTokenRecord{
+		Token:       tokenID,
+		DocID:       docID,
+		UserID:      userID,
+		Permissions: permissions,
+		Expiration:  expirationSeconds,
+	})
+}
+
+// GetToken ...
+func (db *FileDocumentDB) GetToken(tokenID string) (docID, userID, permissions string, err error) {
+	db.tokenMutex.Lock()
+	defer db.tokenMutex.Unlock()
+
+	token, ok := db.tokens[tokenID]
+	if !ok || time.Now().Unix() >= token.expiration {
+		err = ErrMissing
+		return
+	}
+	return token.docID, token.userID, token.permissions, nil
+}
+
+// UpdateUser ...
+func (db *FileDocumentDB) UpdateUser(userID, permissions string) error {
+	db.tokenMutex.Lock()
+	defer db.tokenMutex.Unlock()
+
+	return db.writeTokenRecord(fileTokenRecord{
+		UserID:      userID,
+		Permissions: permissions,
+	})
+}
+
+// clean starts a sweep for expired documents and tokens, at most once an hour.
+func (db *FileDocumentDB) clean() {
+	db.cleanMutex.Lock()
+	defer db.cleanMutex.Unlock()
+
+	if time.Since(db.lastClean).Minutes() < 60 || !atomic.CompareAndSwapInt32(&db.sweeping, 0, 1) {
+		return
+	}
+	db.lastClean = time.Now()
+
+	db.sweeps.Add(1)
+	go func() {
+		defer db.sweeps.Done()
+		defer atomic.StoreInt32(&db.sweeping, 0)
+		if err := db.sweep(); err != nil {
+			db.log.error("cannot remove expired documents", field(fieldError, err))
+		}
+	}()
+}
+
+// sweep removes documents that have not been accessed within the expiration
+// time, and rewrites the token file without expired tokens.
+func (db *FileDocumentDB) sweep() error {
+	if err := db.compactTokens(); err != nil {
+		return err
+	}
+
+	seconds := atomic.LoadInt64(&db.expiration)
+	if seconds == 0 || seconds == NoExpiration {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-time.Duration(seconds) * time.Second)
+	removed := 0
+	err := filepath.Walk(filepath.Join(db.dir, "docs"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed along with its document
+			return nil
+		} else if err != nil || info.IsDir() || !info.ModTime().Before(cutoff) {
+			return err
+		}
+
+		// Keys and info without a document are removed along with documents.
+		name := filepath.Base(path)
+		ext := filepath.Ext(name)
+		if ext != ".doc" && ext != ".keys" && ext != ".info" {
+			return nil
+		}
+		docPath := strings.TrimSuffix(path, ext) + ".doc"
+
+		unlock := db.lock(name[:2])
+		defer unlock()
+
+		// Check again, in case the document was accessed since the walk began.
+		info, err = os.Stat(docPath)
+		if err == nil && !info.ModTime().Before(cutoff) {
+			return nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if docID, data, err := readDocument(docPath); err == nil {
+			if db.archive != nil {
+				keys, _, err := readKeys(keysPath(docPath))
+				if err != nil {
+					return err
+				}
+				if archiveDocument(context.Background(), db.archive, db.log, docID, data, keys) != nil {
+					// try again at the next sweep.
+					return nil
+				}
+			}
+			db.log.info("remove expired document", field(fieldDocument, docID))
+			removed++
+		}
+		return removeDocument(docPath)
+	})
+
+	if removed > 0 {
+		db.log.info("removed expired documents", field("documents", removed))
+	}
+	return err
+}
+
+// compactTokens rewrites the token file with only the tokens that have not expired.
+func (db *FileDocumentDB) compactTokens() error {
+	db.tokenMutex.Lock()
+	defer db.tokenMutex.Unlock()
+
+	now := time.Now().Unix()
+	for id, token := range db.tokens {
+		if token.expiration < now {
+			delete(db.tokens, id)
+		}
+	}
+
+	if db.tokenRecords <= len(db.tokens) {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for id, token := range db.tokens {
+		encoder.Encode(fileTokenRecord{
+			Token:       id,
+			DocID:       token.docID,
+			UserID:      token.userID,
+			Permissions: token.permissions,
+			Expiration:  token.expiration,
+		})
+	}
+
+	path := db.tokenFile.Name()
+	if err := writeFile(path, buffer.Bytes()); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	db.tokenFile.Close()
+	db.tokenFile = f
+	db.tokenRecords = len(db.tokens)
+	return nil
+}
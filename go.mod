@@ -13,6 +13,7 @@ require (
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/lib/pq v1.2.0
 	github.com/mattn/go-sqlite3 v1.14.16
+	go.etcd.io/bbolt v1.3.6
 	go.opentelemetry.io/otel/metric v0.35.0 // indirect
 	go.opentelemetry.io/otel/oteltest v0.18.0 // indirect
 )
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"runtime/debug"
@@ -45,6 +44,10 @@ type HTTPRequestResult struct {
 
 // MakeHTTPRequest makes an HTTP request
 func MakeHTTPRequest(args HTTPRequestArgs, reply interface{}) HTTPRequestResult {
+	return makeHTTPRequest(defaultLog, args, reply)
+}
+
+func makeHTTPRequest(l *logger, args HTTPRequestArgs, reply interface{}) HTTPRequestResult {
 
 	var body io.Reader
 	var length int
@@ -86,7 +89,7 @@ func MakeHTTPRequest(args HTTPRequestArgs, reply interface{}) HTTPRequestResult
 		}
 	}
 
-	log.Printf("uri %s", uri)
+	l.debug("http request", field("method", args.Method), field("uri", args.URI))
 
 	if args.Body != nil {
 		body = bytes.NewReader(args.Body)
@@ -150,9 +153,9 @@ func MakeHTTPRequest(args HTTPRequestArgs, reply interface{}) HTTPRequestResult
 		case *[]byte:
 			*v = responseData
 		default:
-			log.Printf("Content-type: %s", resp.Header.Get("Content-Type"))
-			log.Printf("Response: %v", string(responseData))
-			log.Panic(fmt.Errorf("invalid reply type; need string/byte"))
+			l.warn("unexpected http response", field("contentType", resp.Header.Get("Content-Type")),
+				field("response", string(responseData)))
+			panic(fmt.Errorf("invalid reply type; need string/byte"))
 		}
 	}
 	result.RawReply = responseData
@@ -175,9 +178,17 @@ func MakeAsyncHTTPRequest(args HTTPRequestArgs, reply interface{}) chan HTTPRequ
 // print the stack to the log. Secondly, it will return the internal server error
 // with the status header equal to the error string.
 func RecoverErrors(fn http.Handler) http.HandlerFunc {
+	return recoverErrors(defaultLog, fn)
+}
+
+func recoverErrors(l *logger, fn http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if thing := recover(); thing != nil {
+				if thing == http.ErrAbortHandler {
+					// The response was partly written. Let the server close the connection.
+					panic(thing)
+				}
 				code := http.StatusInternalServerError
 				status := "Internal server error"
 				switch v := thing.(type) {
@@ -186,8 +197,7 @@ func RecoverErrors(fn http.Handler) http.HandlerFunc {
 					status = v.Error()
 				default:
 					status = fmt.Sprintf("%v", thing)
-					log.Printf("%v", thing)
-					log.Println(string(debug.Stack()))
+					l.error("panic handling request", field(fieldError, thing), field("stack", string(debug.Stack())))
 				}
 				w.Header().Set("Status", status)
 				w.WriteHeader(code)
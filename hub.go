@@ -1,13 +1,23 @@
 package zwibserve
 
 import (
-	"log"
+	"context"
+	"errors"
+	"hash/fnv"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type hub struct {
-	ch             chan func()
-	sessions       map[string]*session
+	// Sessions are divided among shards by document ID. Each shard has its own
+	// goroutine, so that a busy document does not delay the others. All
+	// operations on a document run on the same shard, in order. They are
+	// fixed once the hub has started, which is when they are first used.
+	shards         []*hubShard
+	shardsMutex    sync.Mutex
+	started        int32
 	hooks          *webhookQueue
 	webhookURL     string
 	secretUser     string
@@ -15,8 +25,46 @@ type hub struct {
 	jwtKey         string
 	keyIsBase64    bool
 	swarm          HAE
+	metrics        *metrics
+	log            *logger
+	tracer         *tracer
+
+	// closed when the hub goroutines are stopped
+	done chan struct{}
+
+	// keepalive settings for clients
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// time allowed for database operations of clients
+	dbTimeout time.Duration
+
+	// limits of each client's write queue
+	queueLimits QueueLimits
+
+	// if the database caches documents, it is told about changes made by
+	// other servers.
+	invalidator DocumentInvalidator
+}
+
+// hubShard holds the sessions of some of the documents. Its fields must only be
+// accessed by its goroutine.
+type hubShard struct {
+	ch       chan func()
+	sessions map[string]*session
+
+	// if set, the server is shutting down and clients are sent this error.
+	goingAway string
 }
 
+// Default keepalive settings
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 60 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+)
+
 type session struct {
 	clients []*client
 	keys    []clientKey
@@ -27,29 +75,104 @@ type clientKey struct {
 	owner string // clientID or serverID-clientID
 }
 
-func newHub(db DocumentDB) *hub {
+func newHub(db DocumentDB, m *metrics, l *logger, t *tracer) *hub {
 	h := &hub{
-		ch:       make(chan func()),
-		sessions: make(map[string]*session),
-		hooks:    createWebhookQueue(),
+		hooks:   createWebhookQueue(m, l, t),
+		metrics: m,
+		log:     l,
+		tracer:  t,
+		done:    make(chan struct{}),
+
+		pingInterval: defaultPingInterval,
+		pongTimeout:  defaultPongTimeout,
+		writeTimeout: defaultWriteTimeout,
+		dbTimeout:    defaultDBTimeout,
 	}
 	h.swarm = newPeerList(h, db)
+	h.invalidator, _ = db.(DocumentInvalidator)
+	m.addCollector(h.collectMetrics)
+	h.setShards(runtime.GOMAXPROCS(0))
+
+	return h
+}
+
+var errHubStarted = errors.New("the number of hub shards cannot be changed after the hub has started")
 
-	go func() {
-		for fn := range h.ch {
-			fn()
+// setShards replaces the shards of the hub. It fails once the hub has started.
+func (h *hub) setShards(count int) error {
+	if count < 1 {
+		count = 1
+	}
+
+	h.shardsMutex.Lock()
+	defer h.shardsMutex.Unlock()
+	if atomic.LoadInt32(&h.started) != 0 {
+		return errHubStarted
+	}
+
+	old := h.shards
+	h.shards = make([]*hubShard, count)
+	for i := range h.shards {
+		s := &hubShard{
+			ch:       make(chan func()),
+			sessions: make(map[string]*session),
 		}
-	}()
+		h.shards[i] = s
 
-	return h
+		go func() {
+			for {
+				select {
+				case fn := <-s.ch:
+					if fn == nil {
+						return
+					}
+					fn()
+				case <-h.done:
+					return
+				}
+			}
+		}()
+	}
+
+	for _, s := range old {
+		s.ch <- nil
+	}
+	return nil
+}
+
+// getShards returns the shards, and marks the hub as started so that they
+// are not replaced.
+func (h *hub) getShards() []*hubShard {
+	if atomic.LoadInt32(&h.started) == 0 {
+		// wait for any call to setShards to finish.
+		h.shardsMutex.Lock()
+		atomic.StoreInt32(&h.started, 1)
+		h.shardsMutex.Unlock()
+	}
+	return h.shards
+}
+
+// shard returns the shard responsible for the document.
+func (h *hub) shard(docID string) *hubShard {
+	shards := h.getShards()
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(docID))
+	return shards[hash.Sum32()%uint32(len(shards))]
 }
 
 func (h *hub) addClient(docID string, c *client) {
-	h.ch <- func() {
-		log.Printf("Client %v registers for document %v (system has %v clients)", c.id, docID, h.countClients())
-		s := h.sessions[docID]
+	sh := h.shard(docID)
+	h.send(sh, func() {
+		if sh.goingAway != "" {
+			c.notifyGoingAway(sh.goingAway)
+		}
+
+		s := sh.sessions[docID]
 		if s == nil {
-			h.sessions[docID] = &session{
+			sh.sessions[docID] = &session{
 				clients: []*client{c},
 			}
 
@@ -61,24 +184,26 @@ func (h *hub) addClient(docID string, c *client) {
 			s.clients = append(s.clients, c)
 		}
 
+		h.log.debug("client registers for document", append(c.fields(), field("clients", len(sh.sessions[docID].clients)))...)
 		h.swarm.NotifyClientAddRemove(docID, c.id, c.lastEnd, true)
-	}
+	})
 }
 
 // Immediately disconnect all clients and remove records of the document.
 func (h *hub) signalDocumentDeleted(docID string) {
-	h.ch <- func() {
-		sess := h.sessions[docID]
+	sh := h.shard(docID)
+	h.send(sh, func() {
+		sess := sh.sessions[docID]
 		if sess != nil {
-			log.Printf("Document deleted with %v clients: %v", len(sess.clients), docID)
+			h.log.info("document deleted", field(fieldDocument, docID), field("clients", len(sess.clients)))
 			for _, client := range sess.clients {
 				client.notifyLostAccess(errorDoesNotExist)
 				// will be removed through normal mechanism.
 			}
 		} else {
-			log.Printf("Doc %s has no clients.", docID)
+			h.log.debug("deleted document has no clients", field(fieldDocument, docID))
 		}
-	}
+	})
 }
 
 func (h *hub) setWebhook(url, user, password string) {
@@ -88,9 +213,10 @@ func (h *hub) setWebhook(url, user, password string) {
 }
 
 func (h *hub) RemoveClient(docID string, clientID string) {
-	h.ch <- func() {
-		log.Printf("Client %v is removed from document %v", clientID, docID)
-		sess := h.sessions[docID]
+	sh := h.shard(docID)
+	h.send(sh, func() {
+		h.log.debug("client is removed from document", field(fieldClient, clientID), field(fieldDocument, docID))
+		sess := sh.sessions[docID]
 		if sess != nil {
 			list := sess.clients
 			for i, value := range list {
@@ -99,7 +225,7 @@ func (h *hub) RemoveClient(docID string, clientID string) {
 					list = list[:len(list)-1]
 					sess.clients = list
 					if len(list) == 0 {
-						delete(h.sessions, docID)
+						delete(sh.sessions, docID)
 
 						// enqueue webhook
 						if h.webhookURL != "" {
@@ -142,7 +268,7 @@ func (h *hub) RemoveClient(docID string, clientID string) {
 				h.swarm.NotifyClientAddRemove(docID, clientID, 0, false)
 			}
 		}
-	}
+	})
 }
 
 func isRemoteID(id string) bool {
@@ -156,13 +282,30 @@ func isRemoteID(id string) bool {
 }
 
 func (h *hub) Append(docID string, source string, offset uint64, data []uint8) {
-	h.ch <- func() {
-		if _, ok := h.sessions[docID]; ok {
-			log.Printf("client %v (remote=%v) appends %v bytes offset %v, send to %v other clients", source,
-				isRemoteID(source),
-				len(data), offset, len(h.sessions[docID].clients)-1)
+	h.appendContext(context.Background(), docID, source, offset, data)
+}
+
+// appendContext sends the data to all other clients of the document. The fan-out
+// is traced as a child of the span in ctx.
+func (h *hub) appendContext(ctx context.Context, docID string, source string, offset uint64, data []uint8) {
+	if isRemoteID(source) {
+		h.invalidate(docID)
+	}
+
+	queued := time.Now()
+	sh := h.shard(docID)
+	h.send(sh, func() {
+		_, span := h.tracer.start(ctx, "hub.Append", field(fieldDocument, docID),
+			field("wait", time.Since(queued).String()))
+		defer span.end()
 
-			for _, other := range h.sessions[docID].clients {
+		if sess, ok := sh.sessions[docID]; ok {
+			span.setAttributes(field("recipients", len(sess.clients)-1))
+			h.log.debug("client appends", field(fieldClient, source), field(fieldDocument, docID),
+				field("remote", isRemoteID(source)), field("bytes", len(data)), field("offset", offset),
+				field("recipients", len(sess.clients)-1))
+
+			for _, other := range sess.clients {
 				if other.id != source {
 					other.enqueueAppend(data, offset)
 				}
@@ -173,16 +316,29 @@ func (h *hub) Append(docID string, source string, offset uint64, data []uint8) {
 				h.swarm.NotifyAppend(docID, offset, data)
 			}
 		}
-	}
+	})
 }
 
 func (h *hub) Broadcast(docID string, sourceID string, data []uint8) {
-	h.ch <- func() {
-		if _, ok := h.sessions[docID]; ok {
-			log.Printf("client %v broadcasts %v bytes to %v other clients", sourceID,
-				len(data), len(h.sessions[docID].clients)-1)
+	h.broadcastContext(context.Background(), docID, sourceID, data)
+}
 
-			for _, other := range h.sessions[docID].clients {
+// broadcastContext sends the data to all other clients of the document. The
+// fan-out is traced as a child of the span in ctx.
+func (h *hub) broadcastContext(ctx context.Context, docID string, sourceID string, data []uint8) {
+	queued := time.Now()
+	sh := h.shard(docID)
+	h.send(sh, func() {
+		_, span := h.tracer.start(ctx, "hub.Broadcast", field(fieldDocument, docID),
+			field("wait", time.Since(queued).String()))
+		defer span.end()
+
+		if sess, ok := sh.sessions[docID]; ok {
+			span.setAttributes(field("recipients", len(sess.clients)-1))
+			h.log.debug("client broadcasts", field(fieldClient, sourceID), field(fieldDocument, docID),
+				field("bytes", len(data)), field("recipients", len(sess.clients)-1))
+
+			for _, other := range sess.clients {
 				if other.id != sourceID {
 					other.enqueueBroadcast(data)
 				}
@@ -192,13 +348,37 @@ func (h *hub) Broadcast(docID string, sourceID string, data []uint8) {
 				h.swarm.NotifyBroadcast(docID, data)
 			}
 		}
+	})
+}
+
+// invalidate removes the document from the database's cache, if it has one.
+func (h *hub) invalidate(docID string) {
+	if h.invalidator != nil {
+		h.invalidator.InvalidateDocument(docID)
 	}
 }
 
 func (h *hub) SetSessionKey(docID string, sourceID string, key Key) {
-	h.ch <- func() {
-		if _, ok := h.sessions[docID]; ok {
-			for _, other := range h.sessions[docID].clients {
+	h.setSessionKeyContext(context.Background(), docID, sourceID, key)
+}
+
+// setSessionKeyContext sends the key to all other clients of the document. The
+// fan-out is traced as a child of the span in ctx.
+func (h *hub) setSessionKeyContext(ctx context.Context, docID string, sourceID string, key Key) {
+	if isRemoteID(sourceID) {
+		h.invalidate(docID)
+	}
+
+	queued := time.Now()
+	sh := h.shard(docID)
+	h.send(sh, func() {
+		_, span := h.tracer.start(ctx, "hub.SetSessionKey", field(fieldDocument, docID),
+			field("key", key.Name), field("wait", time.Since(queued).String()))
+		defer span.end()
+
+		if sess, ok := sh.sessions[docID]; ok {
+			span.setAttributes(field("recipients", len(sess.clients)-1))
+			for _, other := range sess.clients {
 				if other.id != sourceID {
 					other.notifyKeysUpdated([]Key{key})
 				}
@@ -208,11 +388,11 @@ func (h *hub) SetSessionKey(docID string, sourceID string, key Key) {
 				h.swarm.NotifyKeyUpdated(docID, sourceID, key.Name, key.Value, true)
 			}
 		}
-	}
+	})
 }
 
 func (h *hub) SetClientKey(docID string, sourceID string, oldVersion, newVersion int, name, value string) bool {
-	reply := make(chan bool)
+	reply := make(chan bool, 1)
 
 	newKey := clientKey{
 		owner: sourceID,
@@ -223,11 +403,10 @@ func (h *hub) SetClientKey(docID string, sourceID string, oldVersion, newVersion
 		},
 	}
 
-	h.ch <- func() {
+	sh := h.shard(docID)
+	h.send(sh, func() {
 		found := false
-		if _, ok := h.sessions[docID]; ok {
-
-			sess := h.sessions[docID]
+		if sess, ok := sh.sessions[docID]; ok {
 			for i, k := range sess.keys {
 				if k.Name == name {
 					found = true
@@ -247,7 +426,7 @@ func (h *hub) SetClientKey(docID string, sourceID string, oldVersion, newVersion
 			}
 
 			if found {
-				for _, other := range h.sessions[docID].clients {
+				for _, other := range sess.clients {
 					if other.id != sourceID {
 						other.notifyKeysUpdated([]Key{newKey.Key})
 					}
@@ -260,52 +439,121 @@ func (h *hub) SetClientKey(docID string, sourceID string, oldVersion, newVersion
 		}
 
 		reply <- found
-	}
+	})
 
-	return <-reply
+	select {
+	case ok := <-reply:
+		return ok
+	case <-h.done:
+		return false
+	}
 }
 
 func (h *hub) getClientKeys(docID string) []Key {
-	reply := make(chan bool)
+	reply := make(chan bool, 1)
 	var keys []Key
-	h.ch <- func() {
-		sess := h.sessions[docID]
+	sh := h.shard(docID)
+	h.send(sh, func() {
+		sess := sh.sessions[docID]
+		if sess == nil {
+			reply <- true
+			return
+		}
 
 		for _, k := range sess.keys {
 			keys = append(keys, k.Key)
 		}
 
 		reply <- true
-	}
+	})
 
-	<-reply
-	return keys
+	select {
+	case <-reply:
+		return keys
+	case <-h.done:
+		return nil
+	}
 }
 
 func (h *hub) updatePermissions(userid string, permissions string) {
-	h.ch <- func() {
-		for _, session := range h.sessions {
+	h.sendAll(func(sh *hubShard) {
+		for _, session := range sh.sessions {
 			for _, client := range session.clients {
 				if client.userID == userid {
 					client.notifyPermissionChange(permissions)
 				}
 			}
 		}
-	}
+	})
 }
 
-func (h *hub) run(fn func()) {
-	reply := make(chan bool)
-	h.ch <- func() {
+// run runs the function on the shard and waits for it to complete.
+func (h *hub) run(sh *hubShard, fn func()) {
+	reply := make(chan bool, 1)
+	h.send(sh, func() {
 		fn()
 		reply <- true
+	})
+	select {
+	case <-reply:
+	case <-h.done:
 	}
-	<-reply
+}
+
+// runAll runs the function on each shard in turn, and waits for it to complete.
+func (h *hub) runAll(fn func(sh *hubShard)) {
+	for _, sh := range h.getShards() {
+		sh := sh
+		h.run(sh, func() {
+			fn(sh)
+		})
+	}
+}
+
+// sendAll submits the function to run on every shard.
+func (h *hub) sendAll(fn func(sh *hubShard)) {
+	for _, sh := range h.getShards() {
+		sh := sh
+		h.send(sh, func() {
+			fn(sh)
+		})
+	}
+}
+
+// shutdown sends the message to all clients, and any that connect later, and
+// then disconnects them.
+func (h *hub) shutdown(message string) {
+	h.runAll(func(sh *hubShard) {
+		sh.goingAway = message
+		for _, sess := range sh.sessions {
+			for _, client := range sess.clients {
+				client.notifyGoingAway(message)
+			}
+		}
+	})
+}
+
+// closeClients immediately closes the connections of all clients.
+func (h *hub) closeClients() {
+	h.runAll(func(sh *hubShard) {
+		for _, sess := range sh.sessions {
+			for _, client := range sess.clients {
+				client.ws.Close()
+			}
+		}
+	})
+}
+
+// stop stops the hub goroutines, after completing the operations already
+// submitted. Operations submitted afterwards are ignored.
+func (h *hub) stop() {
+	h.runAll(func(sh *hubShard) {})
+	close(h.done)
 }
 
 func (h *hub) EachKey(fn func(docID, clientID, name, value string, sessionLifetime bool)) {
-	h.run(func() {
-		for docID, sess := range h.sessions {
+	h.runAll(func(sh *hubShard) {
+		for docID, sess := range sh.sessions {
 			for _, key := range sess.keys {
 				clientID := key.owner
 				name := key.Name
@@ -316,17 +564,9 @@ func (h *hub) EachKey(fn func(docID, clientID, name, value string, sessionLifeti
 	})
 }
 
-func (h *hub) countClients() int {
-	var count int
-	for _, sess := range h.sessions {
-		count += len(sess.clients)
-	}
-	return count
-}
-
 func (h *hub) EachClient(fn func(docID, clientID string, docLength uint64)) {
-	h.run(func() {
-		for docID, sess := range h.sessions {
+	h.runAll(func(sh *hubShard) {
+		for docID, sess := range sh.sessions {
 			for _, client := range sess.clients {
 				fn(docID, client.id, client.lastEnd)
 			}
@@ -335,10 +575,11 @@ func (h *hub) EachClient(fn func(docID, clientID string, docLength uint64)) {
 }
 
 func (h *hub) CheckMissedUpdate(docid string, doc []byte, keys []Key) {
-	h.run(func() {
-		sess := h.sessions[docid]
+	sh := h.shard(docid)
+	h.run(sh, func() {
+		sess := sh.sessions[docid]
 		if sess != nil {
-			log.Printf("Check missed updates for doc %s", docid)
+			h.log.debug("check missed updates", field(fieldDocument, docid))
 			for _, client := range sess.clients {
 				if len(doc) > 0 {
 					client.enqueueAppend(doc, 0)
@@ -348,3 +589,42 @@ func (h *hub) CheckMissedUpdate(docid string, doc []byte, keys []Key) {
 		}
 	})
 }
+
+// dbContext returns a context for a database operation made on behalf of a client.
+func (h *hub) dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.dbTimeout > 0 {
+		return context.WithTimeout(ctx, h.dbTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// send submits a function to be run by the goroutine of the shard.
+func (h *hub) send(sh *hubShard, fn func()) {
+	queued := time.Now()
+	select {
+	case sh.ch <- func() {
+		h.metrics.observe("zwibserve_hub_latency_seconds", time.Since(queued))
+		fn()
+	}:
+	case <-h.done:
+	}
+}
+
+func (h *hub) collectMetrics(m *metrics) {
+	m.resetGauge("zwibserve_client_write_queue_messages")
+	m.resetGauge("zwibserve_client_write_queue_bytes")
+	sessions, clients := 0, 0
+	h.runAll(func(sh *hubShard) {
+		sessions += len(sh.sessions)
+		for docID, sess := range sh.sessions {
+			clients += len(sess.clients)
+			for _, client := range sess.clients {
+				messages, bytes := client.queueSize()
+				m.set("zwibserve_client_write_queue_messages", float64(messages), client.id, docID)
+				m.set("zwibserve_client_write_queue_bytes", float64(bytes), client.id, docID)
+			}
+		}
+	})
+	m.set("zwibserve_sessions", float64(sessions))
+	m.set("zwibserve_clients", float64(clients))
+}
@@ -0,0 +1,119 @@
+package zwibserve
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSetHubShardsAfterStart(t *testing.T) {
+	zh := NewHandler(NewMemoryDB())
+	if err := zh.SetHubShards(4); err != nil {
+		t.Fatal(err)
+	}
+	zh.hub.shard("doc")
+	if err := zh.SetHubShards(2); err != errHubStarted {
+		t.Errorf("SetHubShards after start returned %v", err)
+	}
+	if len(zh.hub.shards) != 4 {
+		t.Errorf("hub has %d shards, want 4", len(zh.hub.shards))
+	}
+}
+
+// BenchmarkHubShards relays broadcasts between a pair of clients on each of
+// many documents, to compare one hub shard with one per processor.
+func BenchmarkHubShards(b *testing.B) {
+	counts := []int{1}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		counts = append(counts, n)
+	}
+	for _, shards := range counts {
+		shards := shards
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkHubShards(b, shards, 64)
+		})
+	}
+}
+
+func benchmarkHubShards(b *testing.B, shards, documents int) {
+	zh := NewHandler(NewMemoryDB())
+	zh.SetLogger(NewStdLogger(LogError))
+	if err := zh.SetHubShards(shards); err != nil {
+		b.Fatal(err)
+	}
+	server := httptest.NewServer(zh)
+	defer server.Close()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		zh.Shutdown(ctx)
+	}()
+
+	address := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(docID string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(address, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sendConnectMessage(conn, docID)
+		if _, err := readMessage(conn); err != nil {
+			b.Fatal(err)
+		}
+		return conn
+	}
+
+	senders := make([]*websocket.Conn, documents)
+	receivers := make([]*websocket.Conn, documents)
+	for i := range senders {
+		docID := fmt.Sprintf("bench-%d", i)
+		senders[i] = dial(docID)
+		receivers[i] = dial(docID)
+		defer senders[i].Close()
+		defer receivers[i].Close()
+	}
+
+	data := []byte("0123456789abcdef")
+	message := encode(nil, broadcastMessage{
+		MessageType: broadcastMessageType,
+		DataLength:  uint32(len(data)),
+		Data:        data,
+	})
+
+	var wg sync.WaitGroup
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < documents; i++ {
+		count := b.N / documents
+		if i < b.N%documents {
+			count++
+		}
+
+		wg.Add(2)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				if err := conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(senders[i])
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				if _, err := readMessage(conn); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(receivers[i])
+	}
+	wg.Wait()
+}
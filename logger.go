@@ -0,0 +1,192 @@
+package zwibserve
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	// LogDebug is used for detailed tracing of each message and database call.
+	LogDebug LogLevel = iota
+
+	// LogInfo is used for connections, disconnections and management requests.
+	LogInfo
+
+	// LogWarn is used for unexpected client behaviour and recoverable failures.
+	LogWarn
+
+	// LogError is used for failures that need attention.
+	LogError
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL%d", int(level))
+}
+
+// LogField is a structured key/value pair attached to a log message.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives log messages from the server. You can implement it to
+// send the messages to your own logging system, for example log/slog.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// Names of the fields attached to log messages.
+const (
+	fieldClient      = "client"
+	fieldDocument    = "doc"
+	fieldUser        = "user"
+	fieldMessageType = "type"
+	fieldError       = "err"
+	fieldToken       = "token"
+	fieldPassword    = "password"
+)
+
+// Fields whose values are replaced with redactedValue unless secrets are allowed.
+var secretFields = map[string]bool{
+	fieldToken:    true,
+	fieldPassword: true,
+}
+
+const redactedValue = "[redacted]"
+
+func field(key string, value interface{}) LogField {
+	return LogField{key, value}
+}
+
+type stdLogger struct {
+	minLevel LogLevel
+}
+
+// NewStdLogger returns a Logger that writes messages at or above minLevel
+// using the standard log package, with fields formatted as key=value.
+func NewStdLogger(minLevel LogLevel) Logger {
+	return stdLogger{minLevel}
+}
+
+func (l stdLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if level < l.minLevel {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(level.String())
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for _, f := range fields {
+		value := fmt.Sprintf("%v", f.Value)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(f.Key)
+		sb.WriteByte('=')
+		sb.WriteString(value)
+	}
+	log.Print(sb.String())
+}
+
+// logger is used internally by the server. It redacts secrets and forwards
+// messages to the configured Logger, which can be changed at any time.
+type logger struct {
+	out          atomic.Value // holds loggerOutput
+	allowSecrets int32
+}
+
+type loggerOutput struct {
+	Logger
+}
+
+func newLogger(out Logger) *logger {
+	l := &logger{}
+	l.setOutput(out)
+	return l
+}
+
+// The logger used by components which are not attached to a Handler.
+var defaultLog = newLogger(NewStdLogger(LogInfo))
+
+func (l *logger) setOutput(out Logger) {
+	if out == nil {
+		out = NewStdLogger(LogInfo)
+	}
+	l.out.Store(loggerOutput{out})
+}
+
+func (l *logger) setAllowSecrets(allow bool) {
+	var value int32
+	if allow {
+		value = 1
+	}
+	atomic.StoreInt32(&l.allowSecrets, value)
+}
+
+// Log redacts secret fields and passes the message to the output. It allows
+// the logger to be given to a DocumentDB as a Logger.
+func (l *logger) Log(level LogLevel, msg string, fields ...LogField) {
+	if atomic.LoadInt32(&l.allowSecrets) == 0 {
+		for i, f := range fields {
+			if secretFields[f.Key] {
+				// copy, so that we do not modify the caller's slice.
+				fields = append([]LogField{}, fields...)
+				fields[i].Value = redactedValue
+			}
+		}
+	}
+	l.out.Load().(loggerOutput).Log(level, msg, fields...)
+}
+
+func (l *logger) debug(msg string, fields ...LogField) {
+	l.Log(LogDebug, msg, fields...)
+}
+
+func (l *logger) info(msg string, fields ...LogField) {
+	l.Log(LogInfo, msg, fields...)
+}
+
+func (l *logger) warn(msg string, fields ...LogField) {
+	l.Log(LogWarn, msg, fields...)
+}
+
+func (l *logger) error(msg string, fields ...LogField) {
+	l.Log(LogError, msg, fields...)
+}
+
+// loggerSetter is implemented by document databases which can log using the
+// Handler's logger.
+type loggerSetter interface {
+	SetLogger(l Logger)
+}
+
+// SetLogger sets the destination of log messages from the server. The logger is also
+// given to the DocumentDB, if it has a SetLogger(Logger) method. By default, messages
+// at LogInfo or above are written using the standard log package.
+func (zh *Handler) SetLogger(l Logger) {
+	zh.log.setOutput(l)
+	zh.db.SetLogger(zh.log)
+}
+
+// SetLogSecrets controls whether tokens and passwords are written to the log.
+// By default, they are redacted.
+func (zh *Handler) SetLogSecrets(allow bool) {
+	zh.log.setAllowSecrets(allow)
+}
@@ -3,7 +3,6 @@ package zwibserve
 import (
 	"crypto/subtle"
 	"io"
-	"log"
 	"net/http"
 	"time"
 )
@@ -28,6 +27,14 @@ func (zh *Handler) serveMAPI(w http.ResponseWriter, r *http.Request) bool {
 			zh.handleDumpDocument(w, r, true)
 		case "checkDocument":
 			zh.handleDumpDocument(w, r, false)
+		case "exportDocument":
+			zh.handleExportDocument(w, r)
+		case "exportDocuments":
+			zh.handleExportDocuments(w, r)
+		case "importDocuments":
+			zh.handleImportDocuments(w, r)
+		case "getDocumentInfo":
+			zh.handleGetDocumentInfo(w, r)
 		default:
 			HTTPPanic(400, "Unknown 'method' parameter")
 		}
@@ -41,25 +48,25 @@ func (zh *Handler) verifyAuth(r *http.Request) {
 	eq1 := subtle.ConstantTimeCompare([]byte(username), []byte(zh.secretUser))
 	eq2 := subtle.ConstantTimeCompare([]byte(password), []byte(zh.secretPassword))
 	if !ok || eq1 == 0 || eq2 == 0 || (zh.secretUser == "" && zh.secretPassword == "") {
-		log.Printf("    Request not authorized; got %s/%s", username, password)
+		zh.log.warn("request not authorized", field(fieldUser, username), field(fieldPassword, password))
 		HTTPPanic(401, "Unauthorized")
 	}
 }
 
-func mustGet(r *http.Request, key string) string {
+func (zh *Handler) mustGet(r *http.Request, key string) string {
 	value := r.FormValue(key)
 	if value == "" {
-		log.Printf("    Missing " + key)
+		zh.log.info("management request missing parameter", field("parameter", key))
 		HTTPPanic(400, "Missing "+key)
 	}
 	return value
 }
 
 func (zh *Handler) handleCreateDocument(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Got request for createDocument")
+	zh.log.info("management request", field("method", "createDocument"))
 	zh.verifyAuth(r)
 
-	docID := mustGet(r, "documentID")
+	docID := zh.mustGet(r, "documentID")
 	contents := []byte(r.FormValue("contents"))
 
 	// if there is no string by that name, then try a file.
@@ -77,7 +84,7 @@ func (zh *Handler) handleCreateDocument(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	_, _, err := zh.db.GetDocument(docID, AlwaysCreate, []byte(contents))
+	_, _, err := zh.db.GetDocumentContext(r.Context(), docID, AlwaysCreate, []byte(contents))
 	if err == ErrExists {
 		w.WriteHeader(409)
 		return
@@ -89,12 +96,12 @@ func (zh *Handler) handleCreateDocument(w http.ResponseWriter, r *http.Request)
 }
 
 func (zh *Handler) handleDeleteDocument(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Got request for deleteDocument")
+	zh.log.info("management request", field("method", "deleteDocument"))
 	zh.verifyAuth(r)
 
-	docID := mustGet(r, "documentID")
+	docID := zh.mustGet(r, "documentID")
 	zh.hub.signalDocumentDeleted(docID)
-	err := zh.db.DeleteDocument(docID)
+	err := zh.db.DeleteDocumentContext(r.Context(), docID)
 	if err != nil {
 		panic(err)
 	}
@@ -103,18 +110,19 @@ func (zh *Handler) handleDeleteDocument(w http.ResponseWriter, r *http.Request)
 }
 
 func (zh *Handler) handleDumpDocument(w http.ResponseWriter, r *http.Request, dump bool) {
-	log.Printf("Got request for dumpDocument")
+	zh.log.info("management request", field("method", "dumpDocument"))
 	zh.verifyAuth(r)
 
-	docID := mustGet(r, "documentID")
+	docID := zh.mustGet(r, "documentID")
 
-	contents, _, err := zh.db.GetDocument(docID, NeverCreate, nil)
+	contents, _, err := zh.db.GetDocumentContext(r.Context(), docID, NeverCreate, nil)
 
 	if err == ErrMissing {
 		w.WriteHeader(404)
 		return
 	} else if err != nil {
-		log.Panic(err)
+		zh.log.error("dump document failed", field(fieldDocument, docID), field(fieldError, err))
+		panic(err)
 	}
 
 	if dump {
@@ -126,42 +134,43 @@ func (zh *Handler) handleDumpDocument(w http.ResponseWriter, r *http.Request, du
 }
 
 func (zh *Handler) handleAddToken(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Got request for addToken")
+	zh.log.info("management request", field("method", "addToken"))
 	zh.verifyAuth(r)
-	docID := mustGet(r, "documentID")
-	token := mustGet(r, "token")
-	userID := mustGet(r, "userID")
+	docID := zh.mustGet(r, "documentID")
+	token := zh.mustGet(r, "token")
+	userID := zh.mustGet(r, "userID")
 	permissions := r.FormValue("permissions")
 	contents := r.FormValue("contents")
-	expiration := mustGet(r, "expiration")
+	expiration := zh.mustGet(r, "expiration")
 
 	expirationTime, err := time.Parse(time.RFC1123, expiration)
 	if err != nil {
 		HTTPPanic(400, "Incorrect expires format")
 	}
 
-	err = zh.db.AddToken(token, docID, userID, permissions, expirationTime.Unix(), []byte(contents))
-	log.Printf("AddToken %s for doc %s user %s", token, docID, userID)
+	err = zh.db.AddTokenContext(r.Context(), token, docID, userID, permissions, expirationTime.Unix(), []byte(contents))
+	zh.log.info("add token", field(fieldToken, token), field(fieldDocument, docID), field(fieldUser, userID))
 	if err == ErrExists || err == ErrConflict {
 		w.WriteHeader(409)
 	} else if err != nil {
-		log.Printf("Error is %v", err)
-		log.Panic(err)
+		zh.log.error("add token failed", field(fieldDocument, docID), field(fieldError, err))
+		panic(err)
 	} else {
 		w.WriteHeader(200)
 	}
 }
 
 func (zh *Handler) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Got request for updateUser")
+	zh.log.info("management request", field("method", "updateUser"))
 	zh.verifyAuth(r)
-	userID := mustGet(r, "userID")
+	userID := zh.mustGet(r, "userID")
 	permissions := r.FormValue("permissions")
 
-	err := zh.db.UpdateUser(userID, permissions)
+	err := zh.db.UpdateUserContext(r.Context(), userID, permissions)
 
 	if err != nil {
-		log.Panic(err)
+		zh.log.error("update user failed", field(fieldUser, userID), field(fieldError, err))
+		panic(err)
 	}
 
 	zh.hub.updatePermissions(userID, permissions)
@@ -5,34 +5,59 @@ import (
 	_ "github.com/go-sql-driver/mysql" // include mysql driver
 )
 
+// MariaDB and MySQL cannot index TEXT columns without a length, so identifiers
+// are VARCHAR. The index is declared in the table because MySQL does not
+// support CREATE INDEX IF NOT EXISTS.
 const mariadbSchema = `
 CREATE TABLE IF NOT EXISTS ZwibblerDocs (
-    docID TEXT PRIMARY KEY,
+    docid VARCHAR(255) PRIMARY KEY,
     lastAccess BIGINT,
     data LONGBLOB
 );
 
 CREATE TABLE IF NOT EXISTS ZwibblerKeys (
-    docID TEXT,
-    name TEXT,
+    docid VARCHAR(255),
+    name VARCHAR(255),
     value MEDIUMTEXT,
     version INT,
-    UNIQUE(docID, name),
-    FOREIGN KEY (docID) REFERENCES ZwibblerDocs(docid) ON DELETE CASCADE
+    UNIQUE(docid, name),
+    FOREIGN KEY (docid) REFERENCES ZwibblerDocs(docid) ON DELETE CASCADE
 );
 
 CREATE TABLE IF NOT EXISTS ZwibblerTokens (
-    tokenID TEXT UNIQUE,
-    docID TEXT,
-    userID TEXT,
+    tokenID VARCHAR(255) UNIQUE,
+    docID VARCHAR(255),
+    userID VARCHAR(255),
     permissions TEXT,
-    expiration BIGINT
+    expiration BIGINT,
+    INDEX ZwibblerTokenUserIndex (userID)
 );
-
-CREATE INDEX IF NOT EXISTS ZwibblerTokenUserIndex ON ZwibblerTokens(userID);
 `
 
+var mariadbMigrations = []sqlMigration{
+	{"initial schema", mariadbSchema},
+	// the initial schema already uses consistent names and types.
+	{"consistent key column names and types", ""},
+	{"document information", `
+ALTER TABLE ZwibblerDocs ADD COLUMN created BIGINT;
+ALTER TABLE ZwibblerDocs ADD COLUMN creator VARCHAR(255);
+ALTER TABLE ZwibblerDocs ADD COLUMN modified BIGINT;
+ALTER TABLE ZwibblerDocs ADD COLUMN lastWriter VARCHAR(255);
+ALTER TABLE ZwibblerDocs ADD COLUMN appends BIGINT
+`},
+}
+
+// NewMariaDBConnection connects to MariaDB without TLS.
 func NewMariaDBConnection(server, user, password, dbname string) DocumentDB {
 	mariaInfo := fmt.Sprintf("%s:%s@(%s)/%s?multiStatements=true", user, password, server, dbname)
-	return NewSQLXConnection("mysql", mariaInfo, mariadbSchema, 1, false)
+	return mustConnect(NewSQLXConnectionWithOptions("mysql", mariaInfo, SQLOptions{}))
+}
+
+// NewMariaDBConnectionWithOptions connects to MariaDB using the given options.
+func NewMariaDBConnectionWithOptions(options MySQLOptions) (*SQLxDocumentDB, error) {
+	dsn, err := options.dataSource(true)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLXConnectionWithOptions("mysql", dsn, options.SQLOptions)
 }
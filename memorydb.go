@@ -1,7 +1,8 @@
 package zwibserve
 
 import (
-	"log"
+	"context"
+	"sort"
 	"sync"
 	"time"
 )
@@ -14,11 +15,31 @@ type MemoryDocumentDB struct {
 	tokens     map[string]*token
 	lastClean  time.Time
 	expiration int64
+	log        *logger
+	archive    Archive
 }
 
 type document struct {
 	data       []byte
 	lastAccess time.Time
+
+	created    time.Time
+	creator    string
+	modified   time.Time
+	lastWriter string
+	appends    int64
+}
+
+func newDocument(data []byte, creator string) *document {
+	now := time.Now()
+	return &document{
+		data:       data,
+		lastAccess: now,
+		created:    now,
+		creator:    creator,
+		modified:   now,
+		lastWriter: creator,
+	}
 }
 
 type token struct {
@@ -34,16 +55,32 @@ func NewMemoryDB() DocumentDB {
 		docs:   make(map[string]*document),
 		keys:   make(map[string][]Key),
 		tokens: make(map[string]*token),
+		log:    newLogger(nil),
 	}
 }
 
+// SetLogger sets the destination of log messages.
+func (db *MemoryDocumentDB) SetLogger(l Logger) {
+	db.log.setOutput(l)
+}
+
+// SetArchive sets where documents are stored before they expire.
+func (db *MemoryDocumentDB) SetArchive(archive Archive) {
+	db.mutex.Lock()
+	db.archive = archive
+	db.mutex.Unlock()
+}
+
 func (db *MemoryDocumentDB) CheckHealth() error {
 	return nil
 }
 
 // SetExpiration ...
 func (db *MemoryDocumentDB) SetExpiration(seconds int64) {
+	db.mutex.Lock()
 	db.expiration = seconds
+	db.lastClean = time.Time{}
+	db.mutex.Unlock()
 }
 
 func (db *MemoryDocumentDB) clean() {
@@ -62,7 +99,12 @@ func (db *MemoryDocumentDB) clean() {
 	total := 0
 	for docid, doc := range db.docs {
 		if int64(time.Since(doc.lastAccess).Seconds()) > seconds {
-			log.Printf("Remove expired document %s", docid)
+			if db.archive != nil && archiveDocument(context.Background(), db.archive, db.log, docid, doc.data, db.keys[docid]) != nil {
+				// try again at the next cleaning.
+				total += cap(doc.data)
+				continue
+			}
+			db.log.info("remove expired document", field(fieldDocument, docid))
 			delete(db.docs, docid)
 			delete(db.keys, docid)
 			continue
@@ -72,19 +114,23 @@ func (db *MemoryDocumentDB) clean() {
 	}
 
 	for tokenid, token := range db.tokens {
-		if token.expiration > time.Now().Unix() {
+		if token.expiration < now.Unix() {
 			delete(db.tokens, tokenid)
 		}
 	}
 
 	if total > 0 {
-		log.Printf("%d documents use %d bytes of memory.", len(db.docs), total)
+		db.log.info("memory usage", field("documents", len(db.docs)), field("bytes", total))
 	}
 	db.lastClean = now
 }
 
 // GetDocument ...
 func (db *MemoryDocumentDB) GetDocument(docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	return db.GetDocumentContext(context.Background(), docID, mode, initialData)
+}
+
+func (db *MemoryDocumentDB) getDocument(docID string, mode CreateMode, initialData []byte, userID string) ([]byte, bool, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
@@ -99,9 +145,7 @@ func (db *MemoryDocumentDB) GetDocument(docID string, mode CreateMode, initialDa
 	}
 
 	if doc == nil {
-		doc = &document{
-			data: initialData,
-		}
+		doc = newDocument(initialData, userID)
 		db.docs[docID] = doc
 		created = true
 	}
@@ -112,6 +156,11 @@ func (db *MemoryDocumentDB) GetDocument(docID string, mode CreateMode, initialDa
 
 // AppendDocument ...
 func (db *MemoryDocumentDB) AppendDocument(docID string, oldLength uint64, newData []byte) (uint64, error) {
+	return db.AppendDocumentContext(context.Background(), docID, oldLength, newData)
+}
+
+// AppendDocumentContext ...
+func (db *MemoryDocumentDB) AppendDocumentContext(ctx context.Context, docID string, oldLength uint64, newData []byte) (uint64, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
@@ -129,6 +178,11 @@ func (db *MemoryDocumentDB) AppendDocument(docID string, oldLength uint64, newDa
 
 	doc.lastAccess = time.Now()
 	doc.data = append(doc.data, newData...)
+	if len(newData) > 0 {
+		doc.modified = doc.lastAccess
+		doc.lastWriter = UserIDFromContext(ctx)
+		doc.appends++
+	}
 
 	return uint64(len(doc.data)), nil
 }
@@ -146,9 +200,12 @@ func (db *MemoryDocumentDB) SetDocumentKey(docID string, oldVersion int, key Key
 		}
 	}
 
-	if existing == nil || existing.Version == oldVersion {
+	if existing == nil && oldVersion == 0 {
 		db.keys[docID] = append(db.keys[docID], key)
 		return nil
+	} else if existing != nil && existing.Version == oldVersion {
+		*existing = key
+		return nil
 	}
 
 	return ErrConflict
@@ -158,14 +215,19 @@ func (db *MemoryDocumentDB) SetDocumentKey(docID string, oldVersion int, key Key
 func (db *MemoryDocumentDB) GetDocumentKeys(docID string) ([]Key, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	return db.keys[docID], nil
+	return append([]Key(nil), db.keys[docID]...), nil
 }
 
 func (db *MemoryDocumentDB) DeleteDocument(docID string) error {
 	db.mutex.Lock()
-	defer db.mutex.Unlock()
 	delete(db.docs, docID)
 	delete(db.keys, docID)
+	archive := db.archive
+	db.mutex.Unlock()
+
+	if archive != nil {
+		return archive.DeleteDocument(context.Background(), docID)
+	}
 	return nil
 }
 
@@ -187,11 +249,8 @@ func (db *MemoryDocumentDB) AddToken(tokenIn, docID, userID, permissions string,
 		expiration:  expirationSeconds,
 	}
 
-	if docID != "" {
-		db.docs[docID] = &document{
-			data:       contents,
-			lastAccess: time.Now(),
-		}
+	if len(contents) > 0 {
+		db.docs[docID] = newDocument(contents, userID)
 	}
 	return nil
 }
@@ -201,7 +260,7 @@ func (db *MemoryDocumentDB) GetToken(tokenID string) (docID, userID, permissions
 	defer db.mutex.Unlock()
 	err = ErrMissing
 	if token, ok := db.tokens[tokenID]; ok {
-		if time.Now().Unix() > token.expiration {
+		if time.Now().Unix() >= token.expiration {
 			return
 		}
 
@@ -224,3 +283,103 @@ func (db *MemoryDocumentDB) UpdateUser(userid, permissions string) error {
 	}
 	return nil
 }
+
+// ListDocuments ...
+func (db *MemoryDocumentDB) ListDocuments(ctx context.Context, fn func(docID string) error) error {
+	db.mutex.Lock()
+	docIDs := make([]string, 0, len(db.docs))
+	for docID := range db.docs {
+		docIDs = append(docIDs, docID)
+	}
+	db.mutex.Unlock()
+
+	sort.Strings(docIDs)
+	return listEach(ctx, docIDs, fn)
+}
+
+// ListTokens ...
+func (db *MemoryDocumentDB) ListTokens(ctx context.Context, fn func(token TokenInfo) error) error {
+	db.mutex.Lock()
+	now := time.Now().Unix()
+	var tokens []TokenInfo
+	for tokenID, token := range db.tokens {
+		if now < token.expiration {
+			tokens = append(tokens, TokenInfo{tokenID, token.docID, token.userID, token.permissions, token.expiration})
+		}
+	}
+	db.mutex.Unlock()
+
+	return listTokensEach(ctx, tokens, fn)
+}
+
+// GetDocumentInfo ...
+func (db *MemoryDocumentDB) GetDocumentInfo(ctx context.Context, docID string) (DocumentInfo, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	doc := db.docs[docID]
+	if doc == nil {
+		return DocumentInfo{}, ErrMissing
+	}
+	return DocumentInfo{
+		DocID:      docID,
+		Created:    doc.created,
+		Creator:    doc.creator,
+		Length:     uint64(len(doc.data)),
+		Modified:   doc.modified,
+		LastWriter: doc.lastWriter,
+		Appends:    doc.appends,
+	}, nil
+}
+
+// The memory database never blocks, so its context methods use the context
+// only for the user ID.
+
+// GetDocumentContext ...
+func (db *MemoryDocumentDB) GetDocumentContext(ctx context.Context, docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	db.mutex.Lock()
+	archive := db.archive
+	db.mutex.Unlock()
+
+	return getOrRestore(ctx, archive, db.log, docID, mode, initialData,
+		func(mode CreateMode, initialData []byte) ([]byte, bool, error) {
+			return db.getDocument(docID, mode, initialData, UserIDFromContext(ctx))
+		}, func(key Key) error {
+			return db.SetDocumentKey(docID, 0, key)
+		})
+}
+
+// SetDocumentKeyContext ...
+func (db *MemoryDocumentDB) SetDocumentKeyContext(ctx context.Context, docID string, oldVersion int, key Key) error {
+	return db.SetDocumentKey(docID, oldVersion, key)
+}
+
+// GetDocumentKeysContext ...
+func (db *MemoryDocumentDB) GetDocumentKeysContext(ctx context.Context, docID string) ([]Key, error) {
+	return db.GetDocumentKeys(docID)
+}
+
+// DeleteDocumentContext ...
+func (db *MemoryDocumentDB) DeleteDocumentContext(ctx context.Context, docID string) error {
+	return db.DeleteDocument(docID)
+}
+
+// AddTokenContext ...
+func (db *MemoryDocumentDB) AddTokenContext(ctx context.Context, tokenID, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	return db.AddToken(tokenID, docID, userID, permissions, expirationSeconds, contents)
+}
+
+// GetTokenContext ...
+func (db *MemoryDocumentDB) GetTokenContext(ctx context.Context, tokenID string) (string, string, string, error) {
+	return db.GetToken(tokenID)
+}
+
+// UpdateUserContext ...
+func (db *MemoryDocumentDB) UpdateUserContext(ctx context.Context, userID, permissions string) error {
+	return db.UpdateUser(userID, permissions)
+}
+
+// CheckHealthContext ...
+func (db *MemoryDocumentDB) CheckHealthContext(ctx context.Context) error {
+	return nil
+}
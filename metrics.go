@@ -0,0 +1,468 @@
+package zwibserve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements a small metrics registry that is exposed using the
+// Prometheus text exposition format. It is intentionally simple so that we
+// do not need to pull in the prometheus client library.
+
+// Default histogram buckets, in seconds.
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+
+	// for histograms
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+	order    []string
+
+	// gauges which are computed at the time of collection
+	collectors []func(m *metrics)
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		families: make(map[string]*metricFamily),
+	}
+
+	m.register("zwibserve_sessions", "Number of documents with connected clients.", gaugeMetric)
+	m.register("zwibserve_clients", "Number of connected clients.", gaugeMetric)
+	m.register("zwibserve_messages_received_total", "Messages received from clients, by message type.", counterMetric, "type")
+	m.register("zwibserve_bytes_received_total", "Bytes received from clients, by message type.", counterMetric, "type")
+	m.register("zwibserve_messages_sent_total", "Messages sent to clients, by message type.", counterMetric, "type")
+	m.register("zwibserve_bytes_sent_total", "Bytes sent to clients, by message type.", counterMetric, "type")
+	m.register("zwibserve_appends_total", "Append requests, by result (ack, nack, conflict).", counterMetric, "result")
+	m.register("zwibserve_key_sets_total", "Key set requests, by lifetime and result.", counterMetric, "lifetime", "result")
+	m.register("zwibserve_client_write_queue_messages", "Messages waiting to be written to each client.", gaugeMetric, "client", "document")
+	m.register("zwibserve_client_write_queue_bytes", "Bytes waiting to be written to each client.", gaugeMetric, "client", "document")
+	m.register("zwibserve_queue_overflows_total", "Client write queues that exceeded their limits, by action taken (coalesce, drop, disconnect).", counterMetric, "action")
+	m.register("zwibserve_hub_latency_seconds", "Time between submitting an operation to the hub and its execution.", histogramMetric)
+	m.register("zwibserve_db_operation_duration_seconds", "Latency of DocumentDB operations.", histogramMetric, "backend", "operation")
+	m.register("zwibserve_db_errors_total", "DocumentDB operations that failed with an unexpected error.", counterMetric, "backend", "operation")
+	m.register("zwibserve_webhooks_total", "Webhook deliveries, by event and result.", counterMetric, "event", "result")
+	m.register("zwibserve_cache_requests_total", "Document and key reads of the CachingDB, by result (hit, miss).", counterMetric, "result")
+	m.register("zwibserve_cache_documents", "Documents held by the CachingDB.", gaugeMetric)
+	m.register("zwibserve_cache_bytes", "Bytes held by the CachingDB.", gaugeMetric)
+	return m
+}
+
+func (m *metrics) register(name, help, kind string, labels ...string) {
+	m.families[name] = &metricFamily{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*metricValue),
+	}
+	m.order = append(m.order, name)
+}
+
+// must be locked
+func (m *metrics) get(name string, labelValues []string) *metricValue {
+	family := m.families[name]
+	if family == nil {
+		panic("unregistered metric " + name)
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	value := family.values[key]
+	if value == nil {
+		value = &metricValue{
+			labelValues: labelValues,
+		}
+		if family.kind == histogramMetric {
+			value.buckets = make([]uint64, len(latencyBuckets))
+		}
+		family.values[key] = value
+	}
+	return value
+}
+
+// add adds to a counter or gauge.
+func (m *metrics) add(name string, amount float64, labelValues ...string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.get(name, labelValues).value += amount
+	m.mutex.Unlock()
+}
+
+func (m *metrics) inc(name string, labelValues ...string) {
+	m.add(name, 1, labelValues...)
+}
+
+// observe records a duration in a histogram.
+func (m *metrics) observe(name string, d time.Duration, labelValues ...string) {
+	if m == nil {
+		return
+	}
+	seconds := d.Seconds()
+	m.mutex.Lock()
+	value := m.get(name, labelValues)
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			value.buckets[i]++
+		}
+	}
+	value.count++
+	value.sum += seconds
+	m.mutex.Unlock()
+}
+
+// addCollector registers a function that is called to compute gauges
+// immediately before the metrics are written.
+func (m *metrics) addCollector(fn func(m *metrics)) {
+	m.mutex.Lock()
+	m.collectors = append(m.collectors, fn)
+	m.mutex.Unlock()
+}
+
+// resetGauge removes all values of the gauge, so that stale label
+// combinations (eg, disconnected clients) are not reported.
+func (m *metrics) resetGauge(name string) {
+	m.mutex.Lock()
+	m.families[name].values = make(map[string]*metricValue)
+	m.mutex.Unlock()
+}
+
+func (m *metrics) set(name string, amount float64, labelValues ...string) {
+	m.mutex.Lock()
+	m.get(name, labelValues).value = amount
+	m.mutex.Unlock()
+}
+
+func (m *metrics) recordReceived(message []byte) {
+	if len(message) == 0 {
+		return
+	}
+	name := messageTypeName(message[0])
+	m.inc("zwibserve_messages_received_total", name)
+	m.add("zwibserve_bytes_received_total", float64(len(message)), name)
+}
+
+func (m *metrics) recordSent(message []byte) {
+	if len(message) == 0 {
+		return
+	}
+	name := messageTypeName(message[0])
+	m.inc("zwibserve_messages_sent_total", name)
+	m.add("zwibserve_bytes_sent_total", float64(len(message)), name)
+}
+
+func messageTypeName(messageType byte) string {
+	switch messageType {
+	case initMessageType:
+		return "init"
+	case appendV2MessageType:
+		return "append_v2"
+	case setKeyMessageType:
+		return "set_key"
+	case broadcastMessageType:
+		return "broadcast"
+	case appendMessageType:
+		return "append"
+	case errorMessageType:
+		return "error"
+	case ackNackMessageType:
+		return "ack_nack"
+	case keyInformationMessageType:
+		return "key_information"
+	case setKeyAckNackMessageType:
+		return "set_key_ack_nack"
+	case serverIdentificationMessageType:
+		return "server_identification"
+	case swarmRegisterMessageType:
+		return "swarm_register"
+	case swarmDataMessageType:
+		return "swarm_data"
+	case continuationMessageType:
+		return "continuation"
+	}
+	return "unknown"
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	collectors := m.collectors
+	m.mutex.Unlock()
+
+	for _, fn := range collectors {
+		fn(m)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var sb strings.Builder
+	for _, name := range m.order {
+		family := m.families[name]
+		fmt.Fprintf(&sb, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", family.name, family.kind)
+
+		keys := make([]string, 0, len(family.values))
+		for key := range family.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if len(keys) == 0 && len(family.labels) == 0 && family.kind != histogramMetric {
+			fmt.Fprintf(&sb, "%s 0\n", family.name)
+		}
+
+		for _, key := range keys {
+			value := family.values[key]
+			labels := formatLabels(family.labels, value.labelValues)
+			if family.kind != histogramMetric {
+				fmt.Fprintf(&sb, "%s%s %s\n", family.name, labels, formatFloat(value.value))
+				continue
+			}
+
+			names := append(append([]string{}, family.labels...), "le")
+			for i, bound := range latencyBuckets {
+				values := append(append([]string{}, value.labelValues...), formatFloat(bound))
+				fmt.Fprintf(&sb, "%s_bucket%s %d\n", family.name, formatLabels(names, values), value.buckets[i])
+			}
+			values := append(append([]string{}, value.labelValues...), "+Inf")
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", family.name, formatLabels(names, values), value.count)
+			fmt.Fprintf(&sb, "%s_sum%s %s\n", family.name, labels, formatFloat(value.sum))
+			fmt.Fprintf(&sb, "%s_count%s %d\n", family.name, labels, value.count)
+		}
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// serveMetrics writes the metrics in the Prometheus text exposition format.
+func (zh *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if zh.metricsRequireAuth {
+		zh.verifyAuth(r)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	zh.metrics.WriteTo(w)
+}
+
+// MetricsHandler returns an http.Handler that serves the metrics of the server
+// in the Prometheus text exposition format. The same metrics are also available
+// by making a GET request to the Handler with the "metrics" parameter.
+func (zh *Handler) MetricsHandler() http.Handler {
+	return recoverErrors(zh.log, http.HandlerFunc(zh.serveMetrics))
+}
+
+// SetMetricsAuthRequired requires the metrics endpoint to be accessed using
+// the secret username and password, using HTTP Basic Authentication.
+// By default, metrics are available without authentication.
+func (zh *Handler) SetMetricsAuthRequired(required bool) {
+	zh.metricsRequireAuth = required
+}
+
+// instrumentedDB wraps a DocumentDB and records the latency and errors of each
+// operation. If tracing is enabled, each operation is also recorded as a span
+// that is a child of the span in the context.
+type instrumentedDB struct {
+	db      DocumentDB
+	cdb     ContextDocumentDB
+	backend string
+	metrics *metrics
+	tracer  *tracer
+}
+
+func newInstrumentedDB(db DocumentDB, m *metrics, t *tracer) *instrumentedDB {
+	return &instrumentedDB{
+		db:      db,
+		cdb:     WithContext(db),
+		backend: backendName(db),
+		metrics: m,
+		tracer:  t,
+	}
+}
+
+// backendName returns the name used to identify the database in metrics.
+func backendName(db DocumentDB) string {
+	switch v := db.(type) {
+	case *MemoryDocumentDB:
+		return "memory"
+	case *SQLxDocumentDB:
+		return v.driverName
+	case *RedisDocumentDB:
+		return "redis"
+	case *FileDocumentDB:
+		return "file"
+	case *BoltDocumentDB:
+		return "bolt"
+	case *WriteBehindDB:
+		return "write-behind-" + backendName(v.db)
+	case *CachingDB:
+		return "cache-" + backendName(v.db)
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", db), "*")
+}
+
+type dbOperation struct {
+	name  string
+	start time.Time
+	span  *span
+}
+
+func (db *instrumentedDB) begin(ctx context.Context, name string, docID string) dbOperation {
+	var attrs []LogField
+	if docID != "" {
+		attrs = append(attrs, field(fieldDocument, docID))
+	}
+	_, span := db.tracer.start(ctx, "DocumentDB."+name, append(attrs, field("backend", db.backend))...)
+	return dbOperation{name, time.Now(), span}
+}
+
+// record is deferred by each operation. Expected results such as
+// ErrMissing or ErrConflict are not counted as errors.
+func (db *instrumentedDB) record(op dbOperation, err *error) {
+	db.metrics.observe("zwibserve_db_operation_duration_seconds", time.Since(op.start), db.backend, op.name)
+	if thing := recover(); thing != nil {
+		db.metrics.inc("zwibserve_db_errors_total", db.backend, op.name)
+		op.span.setError(fmt.Errorf("panic: %v", thing))
+		op.span.end()
+		panic(thing)
+	}
+	if *err != nil && *err != ErrMissing && *err != ErrConflict && *err != ErrExists {
+		db.metrics.inc("zwibserve_db_errors_total", db.backend, op.name)
+		op.span.setError(*err)
+	} else if *err != nil {
+		op.span.setAttributes(field("result", (*err).Error()))
+	}
+	op.span.end()
+}
+
+func (db *instrumentedDB) GetDocumentContext(ctx context.Context, docID string, mode CreateMode, initialData []byte) (doc []byte, created bool, err error) {
+	defer db.record(db.begin(ctx, "GetDocument", docID), &err)
+	return db.cdb.GetDocumentContext(ctx, docID, mode, initialData)
+}
+
+func (db *instrumentedDB) AppendDocumentContext(ctx context.Context, docID string, oldLength uint64, newData []byte) (length uint64, err error) {
+	defer db.record(db.begin(ctx, "AppendDocument", docID), &err)
+	return db.cdb.AppendDocumentContext(ctx, docID, oldLength, newData)
+}
+
+func (db *instrumentedDB) SetDocumentKeyContext(ctx context.Context, docID string, oldVersion int, key Key) (err error) {
+	defer db.record(db.begin(ctx, "SetDocumentKey", docID), &err)
+	return db.cdb.SetDocumentKeyContext(ctx, docID, oldVersion, key)
+}
+
+func (db *instrumentedDB) GetDocumentKeysContext(ctx context.Context, docID string) (keys []Key, err error) {
+	defer db.record(db.begin(ctx, "GetDocumentKeys", docID), &err)
+	return db.cdb.GetDocumentKeysContext(ctx, docID)
+}
+
+func (db *instrumentedDB) DeleteDocumentContext(ctx context.Context, docID string) (err error) {
+	defer db.record(db.begin(ctx, "DeleteDocument", docID), &err)
+	return db.cdb.DeleteDocumentContext(ctx, docID)
+}
+
+func (db *instrumentedDB) AddTokenContext(ctx context.Context, token, docID, userID, permissions string, expirationSeconds int64, contents []byte) (err error) {
+	defer db.record(db.begin(ctx, "AddToken", docID), &err)
+	return db.cdb.AddTokenContext(ctx, token, docID, userID, permissions, expirationSeconds, contents)
+}
+
+func (db *instrumentedDB) GetTokenContext(ctx context.Context, token string) (docID, userID, permissions string, err error) {
+	defer db.record(db.begin(ctx, "GetToken", ""), &err)
+	return db.cdb.GetTokenContext(ctx, token)
+}
+
+func (db *instrumentedDB) UpdateUserContext(ctx context.Context, userID, permissions string) (err error) {
+	defer db.record(db.begin(ctx, "UpdateUser", ""), &err)
+	return db.cdb.UpdateUserContext(ctx, userID, permissions)
+}
+
+func (db *instrumentedDB) CheckHealthContext(ctx context.Context) (err error) {
+	defer db.record(db.begin(ctx, "CheckHealth", ""), &err)
+	return db.cdb.CheckHealthContext(ctx)
+}
+
+func (db *instrumentedDB) SetExpiration(seconds int64) {
+	db.db.SetExpiration(seconds)
+}
+
+func (db *instrumentedDB) InvalidateDocument(docID string) {
+	if invalidator, ok := db.db.(DocumentInvalidator); ok {
+		invalidator.InvalidateDocument(docID)
+	}
+}
+
+func (db *instrumentedDB) SetLogger(l Logger) {
+	if setter, ok := db.db.(loggerSetter); ok {
+		setter.SetLogger(l)
+	}
+}
+
+func (db *instrumentedDB) Close() error {
+	if closer, ok := db.db.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package zwibserve
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	zh := NewHandler(NewMemoryDB())
+	zh.SetLogger(NewStdLogger(LogError))
+	server := httptest.NewServer(zh)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendConnectMessage(conn, "metrics")
+	if _, err := readMessage(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(server.URL + "/?metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("status %d: %s", res.StatusCode, body)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Content-Type is %q", res.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"# TYPE zwibserve_clients gauge\n",
+		"\nzwibserve_clients 1\n",
+		"\nzwibserve_sessions 1\n",
+		`zwibserve_messages_received_total{type="init"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	zh := NewHandler(NewMemoryDB())
+	zh.SetLogger(NewStdLogger(LogError))
+	zh.SetSecretUser("user", "secret")
+	zh.SetMetricsAuthRequired(true)
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		url      string
+		username string
+		password string
+		status   int
+	}{
+		{"no credentials", zh, "/?metrics", "", "", 401},
+		{"wrong password", zh, "/?metrics", "user", "wrong", 401},
+		{"credentials", zh, "/?metrics", "user", "secret", 200},
+		{"handler without credentials", zh.MetricsHandler(), "/", "", "", 401},
+		{"handler with credentials", zh.MetricsHandler(), "/", "user", "secret", 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.url, nil)
+			if test.username != "" {
+				r.SetBasicAuth(test.username, test.password)
+			}
+			w := httptest.NewRecorder()
+			test.handler.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			if test.status == 200 && !strings.Contains(w.Body.String(), "zwibserve_clients") {
+				t.Errorf("metrics missing from response:\n%s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package zwibserve
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MigrateOptions configures MigrateDatabase.
+type MigrateOptions struct {
+	// If set, the ID of each document is recorded in this file after it is
+	// copied and verified. When the migration is run again with the same file,
+	// the recorded documents are skipped, so an interrupted migration resumes
+	// where it stopped.
+	ResumeFile string
+
+	// If set, this is called after each document and token is copied.
+	Progress func(progress MigrateProgress)
+
+	// If true, tokens are not copied.
+	SkipTokens bool
+}
+
+// MigrateProgress reports the progress of MigrateDatabase.
+type MigrateProgress struct {
+	// Number of documents copied, and their total size
+	Documents int
+	Bytes     int64
+
+	// Documents that were already in the destination. If the document in the
+	// destination was the beginning of the source document, it was brought up
+	// to date and counted as copied. Otherwise it is listed in Conflicts.
+	Conflicts []string
+
+	// Documents skipped because the resume file shows they were copied before
+	Resumed int
+
+	// Number of tokens copied, and the number that were already in the destination
+	Tokens         int
+	ExistingTokens int
+
+	// The document or token copied most recently
+	DocID string
+	Token string
+}
+
+// MigrateDatabase copies every document and its keys, and the unexpired tokens,
+// from one database to another. The source must implement DocumentLister, and
+// TokenLister unless tokens are skipped. After a document is copied, its length
+// in the destination is checked against the source.
+//
+// The servers using the source should be stopped, or else changes made
+// during the migration may be missed. Run again with the same ResumeFile, a
+// migration copies only the documents that it has not copied before. Run
+// without it, documents that grew in the meantime are brought up to date.
+func MigrateDatabase(ctx context.Context, from, to DocumentDB, options MigrateOptions) (MigrateProgress, error) {
+	var progress MigrateProgress
+	lister, ok := from.(DocumentLister)
+	if !ok {
+		return progress, errListUnsupported
+	}
+	tokenLister, ok := from.(TokenLister)
+	if !ok && !options.SkipTokens {
+		return progress, errListUnsupported
+	}
+
+	report := func() {
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+	}
+
+	var copied map[string]bool
+	var resume *os.File
+	if options.ResumeFile != "" {
+		var err error
+		var partial bool
+		if copied, partial, err = readResumeFile(options.ResumeFile); err != nil {
+			return progress, err
+		}
+		if resume, err = os.OpenFile(options.ResumeFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return progress, err
+		}
+		defer resume.Close()
+		if partial {
+			// end the partly written line, so that it does not spoil the next one.
+			if _, err := resume.WriteString("\n"); err != nil {
+				return progress, err
+			}
+		}
+	}
+
+	src := WithContext(from)
+	dst := WithContext(to)
+
+	err := lister.ListDocuments(ctx, func(docID string) error {
+		if copied[docID] {
+			progress.Resumed++
+			return nil
+		}
+
+		bundle, err := exportBundle(ctx, src, docID)
+		if err == ErrMissing {
+			// deleted since it was listed
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading %s: %w", docID, err)
+		}
+
+		err = importBundle(ctx, dst, bundle, false)
+		if err == ErrExists {
+			_, _, err = updateBundle(ctx, dst, bundle)
+		}
+		if err == ErrConflict {
+			progress.Conflicts = append(progress.Conflicts, docID)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("writing %s: %w", docID, err)
+		}
+
+		// verify
+		contents, _, err := dst.GetDocumentContext(ctx, docID, NeverCreate, nil)
+		if err != nil {
+			return fmt.Errorf("verifying %s: %w", docID, err)
+		} else if len(contents) != bundle.Length {
+			return fmt.Errorf("verifying %s: copied %d bytes but the destination has %d", docID, bundle.Length, len(contents))
+		}
+
+		if resume != nil {
+			if _, err := fmt.Fprintln(resume, strconv.Quote(docID)); err != nil {
+				return err
+			}
+		}
+
+		progress.Documents++
+		progress.Bytes += int64(bundle.Length)
+		progress.DocID = docID
+		report()
+		return nil
+	})
+	if err != nil || options.SkipTokens {
+		return progress, err
+	}
+
+	err = tokenLister.ListTokens(ctx, func(token TokenInfo) error {
+		err := dst.AddTokenContext(ctx, token.Token, token.DocID, token.UserID, token.Permissions, token.Expiration, nil)
+		if err == ErrExists {
+			progress.ExistingTokens++
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("adding token for %s: %w", token.DocID, err)
+		}
+
+		progress.Tokens++
+		progress.Token = token.Token
+		report()
+		return nil
+	})
+	return progress, err
+}
+
+// readResumeFile returns the IDs of the documents recorded in the file. A
+// partly written last line is ignored, and reported.
+func readResumeFile(path string) (map[string]bool, bool, error) {
+	copied := make(map[string]bool)
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return copied, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	lines := strings.Split(string(contents), "\n")
+	for _, line := range lines {
+		if docID, err := strconv.Unquote(line); err == nil {
+			copied[docID] = true
+		}
+	}
+	return copied, lines[len(lines)-1] != "", nil
+}
@@ -0,0 +1,162 @@
+package zwibserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingDB fails to create documents after the first few, and can lose the
+// end of the documents that it returns.
+type failingDB struct {
+	DocumentDB
+	creates  int
+	truncate bool
+}
+
+var errFailingDB = errors.New("the database failed")
+
+func (db *failingDB) GetDocument(docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	if mode == AlwaysCreate {
+		if db.creates == 0 {
+			return nil, false, errFailingDB
+		}
+		db.creates--
+	}
+	doc, created, err := db.DocumentDB.GetDocument(docID, mode, initialData)
+	if db.truncate && len(doc) > 0 {
+		doc = doc[:len(doc)-1]
+	}
+	return doc, created, err
+}
+
+func TestMigrateDatabaseResume(t *testing.T) {
+	const docs = 5
+	src := NewMemoryDB()
+	for i := 0; i < docs; i++ {
+		docID := fmt.Sprintf("doc%d", i)
+		if _, _, err := src.GetDocument(docID, AlwaysCreate, []byte(docID)); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.SetDocumentKey(docID, 0, Key{1, "name", docID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.AddToken("token", "doc0", "user", "rw", time.Now().Add(time.Hour).Unix(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddToken("expired", "doc0", "user", "rw", time.Now().Add(-time.Minute).Unix(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	dst := NewMemoryDB()
+	options := MigrateOptions{ResumeFile: filepath.Join(tempDir(t), "resume")}
+
+	// the destination fails after two documents.
+	progress, err := MigrateDatabase(ctx, src, &failingDB{DocumentDB: dst, creates: 2}, options)
+	if !errors.Is(err, errFailingDB) {
+		t.Fatalf("got error %v, want errFailingDB", err)
+	}
+	if progress.Documents != 2 {
+		t.Fatalf("copied %d documents before failing, want 2", progress.Documents)
+	}
+
+	// the process is killed while recording the next document.
+	file, err := os.OpenFile(options.ResumeFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`"doc`)
+	file.Close()
+
+	var copied []string
+	listed := 0
+	src.(DocumentLister).ListDocuments(ctx, func(docID string) error {
+		listed++
+		if _, _, err := dst.GetDocument(docID, NeverCreate, nil); err == nil {
+			copied = append(copied, docID)
+		}
+		return nil
+	})
+	if len(copied) != 2 || listed != docs {
+		t.Fatalf("copied %v of %d documents", copied, listed)
+	}
+
+	// a copied document grows before the migration is resumed.
+	if _, err := src.AppendDocument(copied[0], uint64(len(copied[0])), []byte("+")); err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err = MigrateDatabase(ctx, src, dst, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Resumed != 2 || progress.Documents != docs-2 || progress.Tokens != 1 || len(progress.Conflicts) != 0 {
+		t.Errorf("resumed migration: progress is %+v", progress)
+	}
+	// the grown document is skipped, since it was copied before.
+	for i := 0; i < docs; i++ {
+		docID := fmt.Sprintf("doc%d", i)
+		if got := mustGetDocument(t, dst, docID); got != docID {
+			t.Errorf("%s is %q, want %q", docID, got, docID)
+		}
+		keys, err := dst.GetDocumentKeys(docID)
+		if err != nil || len(keys) != 1 || keys[0] != (Key{1, "name", docID}) {
+			t.Errorf("%s has keys %v, %v", docID, keys, err)
+		}
+	}
+	if _, _, _, err := dst.GetToken("token"); err != nil {
+		t.Errorf("token was not copied: %v", err)
+	}
+	if _, _, _, err := dst.GetToken("expired"); err != ErrMissing {
+		t.Errorf("expired token: got %v, want ErrMissing", err)
+	}
+
+	// the partly written line does not spoil the records that follow it.
+	progress, err = MigrateDatabase(ctx, src, dst, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Resumed != docs || progress.Documents != 0 {
+		t.Errorf("migration resumed after completing: progress is %+v", progress)
+	}
+
+	// without the resume file, the grown document is brought up to date.
+	progress, err = MigrateDatabase(ctx, src, dst, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Documents != docs || progress.ExistingTokens != 1 || len(progress.Conflicts) != 0 {
+		t.Errorf("repeated migration: progress is %+v", progress)
+	}
+	if got := mustGetDocument(t, dst, copied[0]); got != copied[0]+"+" {
+		t.Errorf("%s is %q after the repeated migration", copied[0], got)
+	}
+}
+
+func TestMigrateDatabaseVerify(t *testing.T) {
+	src := NewMemoryDB()
+	if _, _, err := src.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &failingDB{DocumentDB: NewMemoryDB(), creates: 1, truncate: true}
+	options := MigrateOptions{ResumeFile: filepath.Join(tempDir(t), "resume"), SkipTokens: true}
+	_, err := MigrateDatabase(context.Background(), src, dst, options)
+	if err == nil || !strings.Contains(err.Error(), "verifying doc") {
+		t.Fatalf("got error %v, want a verification error", err)
+	}
+
+	// the document is not recorded as copied.
+	contents, err := ioutil.ReadFile(options.ResumeFile)
+	if err != nil || len(contents) != 0 {
+		t.Errorf("resume file has %q, %v", contents, err)
+	}
+}
@@ -1,13 +1,93 @@
 package zwibserve
 
 import (
+	"crypto/tls"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql" // include mysql driver
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 const mysqlSchema = mariadbSchema // Reuse MariaDB schema
 
+// MySQLOptions configures a connection to MySQL or MariaDB.
+type MySQLOptions struct {
+	SQLOptions
+
+	// The data source name, eg. "user:password@tcp(server)/dbname". If it is
+	// set, Server, User, Password, DBName and TLS are ignored.
+	DSN string
+
+	Server   string
+	User     string
+	Password string
+	DBName   string
+
+	// If set, the connection is encrypted using this configuration, which
+	// may include client certificates.
+	TLS *tls.Config
+}
+
+// The names under which TLS configurations are registered with the driver.
+// Each configuration is registered once.
+var (
+	mysqlTLSMutex sync.Mutex
+	mysqlTLSNames = map[*tls.Config]string{}
+)
+
+// mysqlTLSName registers the configuration with the driver, if it has not
+// been already, and returns its name.
+func mysqlTLSName(config *tls.Config) (string, error) {
+	mysqlTLSMutex.Lock()
+	defer mysqlTLSMutex.Unlock()
+	if name, ok := mysqlTLSNames[config]; ok {
+		return name, nil
+	}
+
+	name := fmt.Sprintf("zwibserve-%d", len(mysqlTLSNames)+1)
+	if err := mysql.RegisterTLSConfig(name, config); err != nil {
+		return "", err
+	}
+	mysqlTLSNames[config] = name
+	return name, nil
+}
+
+// dataSource returns the data source name for the options.
+func (options MySQLOptions) dataSource(multiStatements bool) (string, error) {
+	if options.DSN != "" {
+		return options.DSN, nil
+	}
+
+	config := mysql.NewConfig()
+	config.User = options.User
+	config.Passwd = options.Password
+	config.Net = "tcp"
+	config.Addr = options.Server
+	config.DBName = options.DBName
+	config.MultiStatements = multiStatements
+
+	if options.TLS != nil {
+		name, err := mysqlTLSName(options.TLS)
+		if err != nil {
+			return "", err
+		}
+		config.TLSConfig = name
+	}
+
+	return config.FormatDSN(), nil
+}
+
+// NewMySQLConnection connects to MySQL without TLS.
 func NewMySQLConnection(server, user, password, dbname string) DocumentDB {
 	mysqlInfo := fmt.Sprintf("%s:%s@(%s)/%s", user, password, server, dbname)
-	return NewSQLXConnection("mysql", mysqlInfo, mysqlSchema, 1, false)
+	return mustConnect(NewSQLXConnectionWithOptions("mysql", mysqlInfo, SQLOptions{}))
+}
+
+// NewMySQLConnectionWithOptions connects to MySQL using the given options.
+func NewMySQLConnectionWithOptions(options MySQLOptions) (*SQLxDocumentDB, error) {
+	dsn, err := options.dataSource(false)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLXConnectionWithOptions("mysql", dsn, options.SQLOptions)
 }
@@ -2,6 +2,8 @@ package zwibserve
 
 import (
 	"fmt"
+	"net/url"
+
 	_ "github.com/lib/pq" // include postgresql driver
 )
 
@@ -32,7 +34,114 @@ CREATE TABLE IF NOT EXISTS ZwibblerTokens (
 CREATE INDEX IF NOT EXISTS ZwibblerTokenUserIndex ON ZwibblerTokens(userID);
 `
 
+var postgresqlMigrations = []sqlMigration{
+	{"initial schema", postgresqlSchema},
+	// PostgreSQL folds unquoted names to lower case, and the types were already consistent.
+	{"consistent key column names and types", ""},
+	{"document information", `
+ALTER TABLE ZwibblerDocs ADD COLUMN created BIGINT;
+ALTER TABLE ZwibblerDocs ADD COLUMN creator TEXT;
+ALTER TABLE ZwibblerDocs ADD COLUMN modified BIGINT;
+ALTER TABLE ZwibblerDocs ADD COLUMN lastWriter TEXT;
+ALTER TABLE ZwibblerDocs ADD COLUMN appends BIGINT
+`},
+}
+
+// PostgreSQLOptions configures a connection to PostgreSQL.
+type PostgreSQLOptions struct {
+	SQLOptions
+
+	// The connection string, in URL or key=value form. If it is set, Server,
+	// User, Password, DBName and the SSL options are ignored.
+	DSN string
+
+	Server   string
+	User     string
+	Password string
+	DBName   string
+
+	// The sslmode, eg. "disable", "require" or "verify-full". The default is
+	// that of the driver, which is "require".
+	SSLMode string
+
+	// Files containing the root certificate used to verify the server, and the
+	// client certificate and key used for certificate authentication.
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	// The schema containing the tables. It is set as the search_path of each
+	// connection, and must already exist. It may contain only letters, digits
+	// and underscores, and must not begin with a digit.
+	Schema string
+}
+
+// validSchemaName returns true if the name is an identifier which does not
+// need to be quoted.
+func validSchemaName(name string) bool {
+	for i, ch := range name {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' || i > 0 && ch >= '0' && ch <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// dataSource returns the connection string for the options.
+func (options PostgreSQLOptions) dataSource() (string, error) {
+	if !validSchemaName(options.Schema) {
+		return "", fmt.Errorf("invalid schema name %q", options.Schema)
+	}
+
+	dsn := options.DSN
+	if dsn == "" {
+		params := url.Values{}
+		for name, value := range map[string]string{
+			"sslmode":     options.SSLMode,
+			"sslrootcert": options.SSLRootCert,
+			"sslcert":     options.SSLCert,
+			"sslkey":      options.SSLKey,
+		} {
+			if value != "" {
+				params.Set(name, value)
+			}
+		}
+
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(options.User, options.Password),
+			Host:     options.Server,
+			Path:     "/" + options.DBName,
+			RawQuery: params.Encode(),
+		}
+		dsn = u.String()
+	}
+
+	if options.Schema != "" {
+		// The driver passes unknown parameters to the server as run-time settings.
+		if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+			params := u.Query()
+			params.Set("search_path", options.Schema)
+			u.RawQuery = params.Encode()
+			dsn = u.String()
+		} else {
+			dsn += fmt.Sprintf(" search_path='%s'", options.Schema)
+		}
+	}
+	return dsn, nil
+}
+
+// NewPostgreSQLConnection connects to PostgreSQL without SSL.
 func NewPostgreSQLConnection(server, user, password, dbname string) DocumentDB {
 	psqlInfo := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", user, password, server, dbname)
-	return NewSQLXConnection("postgres", psqlInfo, postgresqlSchema, 1, true)
+	return mustConnect(NewSQLXConnectionWithOptions("postgres", psqlInfo, SQLOptions{}))
+}
+
+// NewPostgreSQLConnectionWithOptions connects to PostgreSQL using the given options.
+func NewPostgreSQLConnectionWithOptions(options PostgreSQLOptions) (*SQLxDocumentDB, error) {
+	dsn, err := options.dataSource()
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLXConnectionWithOptions("postgres", dsn, options.SQLOptions)
 }
@@ -0,0 +1,160 @@
+package zwibserve
+
+// QueuePolicy determines what happens when a client's write queue exceeds its limits.
+type QueuePolicy int
+
+const (
+	// QueueDisconnect sends the client a "client too slow" error, with error code 5,
+	// and closes the connection. The client will reconnect and resume from the
+	// document offset that it has.
+	QueueDisconnect QueuePolicy = iota
+
+	// QueueCoalesce merges consecutive queued appends into a single append of the
+	// combined range. If the queue still exceeds the limits, the client is disconnected.
+	QueueCoalesce
+
+	// QueueDropBroadcasts discards the oldest queued broadcasts, which are transient
+	// and will soon be stale. If the queue still exceeds the limits, the client is disconnected.
+	QueueDropBroadcasts
+)
+
+// QueueLimits limits the messages waiting to be written to each client. A client
+// on a slow connection could otherwise accumulate every change in memory.
+type QueueLimits struct {
+	// The maximum number of queued messages. Zero means no limit.
+	MaxMessages int
+
+	// The maximum number of queued bytes. Zero means no limit.
+	MaxBytes int
+
+	// What to do when a limit is exceeded.
+	Policy QueuePolicy
+}
+
+// SetQueueLimits sets the limits of each client's write queue. By default, the
+// queues are unlimited.
+func (zh *Handler) SetQueueLimits(limits QueueLimits) {
+	zh.hub.queueLimits = limits
+}
+
+// The error description sent to clients which are disconnected because they
+// cannot keep up.
+const errorTextTooSlow = "client too slow"
+
+// queuedMessage is a message waiting to be written by the writeThread. Appends are
+// kept unencoded so that adjacent ones can be merged.
+type queuedMessage struct {
+	messageType byte
+
+	// the encoded message, for all messages except appends.
+	encoded []byte
+
+	// for appends
+	offset uint64
+	data   []byte
+
+	// set if data was allocated by merging, rather than shared with other clients.
+	owned bool
+}
+
+func (m *queuedMessage) isAppend() bool {
+	return m.messageType == appendMessageType || m.messageType == appendV2MessageType
+}
+
+// size returns the number of bytes the message will occupy when sent.
+func (m *queuedMessage) size() int {
+	switch m.messageType {
+	case appendV2MessageType:
+		return 10 + len(m.data) // type, more, offset
+	case appendMessageType:
+		return 14 + len(m.data) // type, more, generation, offset
+	}
+	return len(m.encoded)
+}
+
+func (m *queuedMessage) encode() []byte {
+	switch m.messageType {
+	case appendV2MessageType:
+		return encode(nil, appendMessageV2{
+			MessageType: appendV2MessageType,
+			Offset:      m.offset,
+			Data:        m.data,
+		})
+	case appendMessageType:
+		return encode(nil, appendMessage{
+			MessageType: appendMessageType,
+			Generation:  0, // Future feature
+			Offset:      m.offset,
+			Data:        m.data,
+		})
+	}
+	return m.encoded
+}
+
+// canMerge returns true if next is an append that immediately follows m, and
+// the combined message would be at most maxSize bytes. A maxSize of zero means no limit.
+func (m *queuedMessage) canMerge(next *queuedMessage, maxSize int) bool {
+	return m.isAppend() && next.messageType == m.messageType &&
+		m.offset+uint64(len(m.data)) == next.offset &&
+		(maxSize <= 0 || m.size()+len(next.data) <= maxSize)
+}
+
+// coalesceAppends merges each run of contiguous appends into a single append,
+// as long as the merged message is at most maxSize bytes, so that it does not
+// need to be split into continuations. A maxSize of zero means no limit.
+func coalesceAppends(messages []queuedMessage, maxSize int) []queuedMessage {
+	n := 0
+	for i := range messages {
+		if n > 0 && messages[n-1].canMerge(&messages[i], maxSize) {
+			prev := &messages[n-1]
+			if !prev.owned {
+				// the data is shared with other clients, so it must be copied.
+				merged := make([]byte, 0, len(prev.data)+len(messages[i].data))
+				prev.data = append(merged, prev.data...)
+				prev.owned = true
+			}
+			prev.data = append(prev.data, messages[i].data...)
+			continue
+		}
+		messages[n] = messages[i]
+		n++
+	}
+
+	for i := n; i < len(messages); i++ {
+		messages[i] = queuedMessage{}
+	}
+	return messages[:n]
+}
+
+// dropBroadcasts removes the oldest broadcasts until the queue is within the limits.
+func dropBroadcasts(messages []queuedMessage, limits QueueLimits) []queuedMessage {
+	count, bytes := len(messages), queuedBytes(messages)
+	n := 0
+	for i := range messages {
+		if messages[i].messageType == broadcastMessageType && !withinLimits(count, bytes, limits) {
+			count--
+			bytes -= messages[i].size()
+			continue
+		}
+		messages[n] = messages[i]
+		n++
+	}
+
+	for i := n; i < len(messages); i++ {
+		messages[i] = queuedMessage{}
+	}
+	return messages[:n]
+}
+
+func queuedBytes(messages []queuedMessage) int {
+	bytes := 0
+	for i := range messages {
+		bytes += messages[i].size()
+	}
+	return bytes
+}
+
+func withinLimits(count, bytes int, limits QueueLimits) bool {
+	return (limits.MaxMessages <= 0 || count <= limits.MaxMessages) &&
+		(limits.MaxBytes <= 0 || bytes <= limits.MaxBytes)
+}
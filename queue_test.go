@@ -0,0 +1,213 @@
+package zwibserve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func queuedAppend(offset uint64, data string) queuedMessage {
+	return queuedMessage{messageType: appendV2MessageType, offset: offset, data: []byte(data)}
+}
+
+func queuedBroadcast(size int) queuedMessage {
+	return queuedMessage{messageType: broadcastMessageType, encoded: make([]byte, size)}
+}
+
+// sameMessages compares the type, offset and contents of the messages.
+func sameMessages(a, b []queuedMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].messageType != b[i].messageType || a[i].offset != b[i].offset ||
+			!bytes.Equal(a[i].data, b[i].data) || len(a[i].encoded) != len(b[i].encoded) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCoalesceAppends(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []queuedMessage
+		maxSize  int
+		want     []queuedMessage
+	}{
+		{
+			name:     "contiguous",
+			messages: []queuedMessage{queuedAppend(0, "ab"), queuedAppend(2, "cd"), queuedAppend(4, "e")},
+			want:     []queuedMessage{queuedAppend(0, "abcde")},
+		},
+		{
+			name:     "not contiguous",
+			messages: []queuedMessage{queuedAppend(0, "ab"), queuedAppend(3, "cd")},
+			want:     []queuedMessage{queuedAppend(0, "ab"), queuedAppend(3, "cd")},
+		},
+		{
+			name:     "separated by a broadcast",
+			messages: []queuedMessage{queuedAppend(0, "ab"), queuedBroadcast(5), queuedAppend(2, "cd")},
+			want:     []queuedMessage{queuedAppend(0, "ab"), queuedBroadcast(5), queuedAppend(2, "cd")},
+		},
+		{
+			name: "different types",
+			messages: []queuedMessage{queuedAppend(0, "ab"),
+				{messageType: appendMessageType, offset: 2, data: []byte("cd")}},
+			want: []queuedMessage{queuedAppend(0, "ab"),
+				{messageType: appendMessageType, offset: 2, data: []byte("cd")}},
+		},
+		{
+			name:     "two runs",
+			messages: []queuedMessage{queuedAppend(0, "a"), queuedAppend(1, "b"), queuedBroadcast(5), queuedAppend(2, "c"), queuedAppend(3, "d")},
+			want:     []queuedMessage{queuedAppend(0, "ab"), queuedBroadcast(5), queuedAppend(2, "cd")},
+		},
+		{
+			name:     "size limit",
+			messages: []queuedMessage{queuedAppend(0, "ab"), queuedAppend(2, "cd"), queuedAppend(4, "ef")},
+			maxSize:  14,
+			want:     []queuedMessage{queuedAppend(0, "abcd"), queuedAppend(4, "ef")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := coalesceAppends(test.messages, test.maxSize)
+			if !sameMessages(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCoalesceAppendsCopiesSharedData(t *testing.T) {
+	shared := []byte("ab")
+	messages := []queuedMessage{
+		{messageType: appendV2MessageType, offset: 0, data: shared[:2:2]},
+		queuedAppend(2, "cd"),
+	}
+	coalesceAppends(messages, 0)
+	if string(shared) != "ab" {
+		t.Errorf("shared data was modified to %q", shared)
+	}
+}
+
+func TestDropBroadcasts(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []queuedMessage
+		limits   QueueLimits
+		want     []queuedMessage
+	}{
+		{
+			name:     "within limits",
+			messages: []queuedMessage{queuedBroadcast(10), queuedAppend(0, "ab")},
+			limits:   QueueLimits{MaxMessages: 2},
+			want:     []queuedMessage{queuedBroadcast(10), queuedAppend(0, "ab")},
+		},
+		{
+			name:     "message limit drops the oldest",
+			messages: []queuedMessage{queuedBroadcast(10), queuedAppend(0, "ab"), queuedBroadcast(20), queuedBroadcast(30)},
+			limits:   QueueLimits{MaxMessages: 2},
+			want:     []queuedMessage{queuedAppend(0, "ab"), queuedBroadcast(30)},
+		},
+		{
+			name:     "byte limit",
+			messages: []queuedMessage{queuedBroadcast(100), queuedBroadcast(50), queuedAppend(0, "ab")},
+			limits:   QueueLimits{MaxBytes: 70},
+			want:     []queuedMessage{queuedBroadcast(50), queuedAppend(0, "ab")},
+		},
+		{
+			name:     "appends are kept",
+			messages: []queuedMessage{queuedAppend(0, "ab"), queuedBroadcast(10), queuedAppend(2, "cd")},
+			limits:   QueueLimits{MaxMessages: 1},
+			want:     []queuedMessage{queuedAppend(0, "ab"), queuedAppend(2, "cd")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := dropBroadcasts(test.messages, test.limits)
+			if !sameMessages(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithinLimits(t *testing.T) {
+	tests := []struct {
+		count, bytes int
+		limits       QueueLimits
+		want         bool
+	}{
+		{1000, 1 << 30, QueueLimits{}, true},
+		{10, 0, QueueLimits{MaxMessages: 10}, true},
+		{11, 0, QueueLimits{MaxMessages: 10}, false},
+		{0, 100, QueueLimits{MaxBytes: 100}, true},
+		{0, 101, QueueLimits{MaxBytes: 100}, false},
+		{10, 100, QueueLimits{MaxMessages: 10, MaxBytes: 100}, true},
+		{11, 100, QueueLimits{MaxMessages: 10, MaxBytes: 100}, false},
+		{10, 101, QueueLimits{MaxMessages: 10, MaxBytes: 100}, false},
+	}
+
+	for _, test := range tests {
+		if got := withinLimits(test.count, test.bytes, test.limits); got != test.want {
+			t.Errorf("withinLimits(%d, %d, %+v) = %v, want %v", test.count, test.bytes, test.limits, got, test.want)
+		}
+	}
+}
+
+func TestLimitQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   QueueLimits
+		messages []queuedMessage
+		tooSlow  bool
+	}{
+		{"disconnect", QueueLimits{MaxMessages: 2, Policy: QueueDisconnect},
+			[]queuedMessage{queuedAppend(0, "a"), queuedAppend(1, "b"), queuedAppend(2, "c")}, true},
+		{"coalesce", QueueLimits{MaxMessages: 2, Policy: QueueCoalesce},
+			[]queuedMessage{queuedAppend(0, "a"), queuedAppend(1, "b"), queuedAppend(2, "c")}, false},
+		{"coalesce not enough", QueueLimits{MaxMessages: 2, Policy: QueueCoalesce},
+			[]queuedMessage{queuedAppend(0, "a"), queuedAppend(2, "b"), queuedAppend(4, "c")}, true},
+		{"drop broadcasts", QueueLimits{MaxMessages: 2, Policy: QueueDropBroadcasts},
+			[]queuedMessage{queuedBroadcast(5), queuedAppend(0, "a"), queuedAppend(1, "b")}, false},
+		{"drop broadcasts not enough", QueueLimits{MaxMessages: 2, Policy: QueueDropBroadcasts},
+			[]queuedMessage{queuedAppend(0, "a"), queuedAppend(1, "b"), queuedAppend(2, "c")}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &client{
+				id:  "test",
+				hub: &hub{queueLimits: test.limits, log: newLogger(NewStdLogger(LogError))},
+			}
+			for _, message := range test.messages {
+				c.queued = append(c.queued, message)
+				c.queuedBytes += message.size()
+				c.limitQueue()
+			}
+
+			if c.tooSlow != test.tooSlow {
+				t.Fatalf("tooSlow is %v, want %v", c.tooSlow, test.tooSlow)
+			}
+			if !test.tooSlow {
+				if !withinLimits(len(c.queued), c.queuedBytes, test.limits) {
+					t.Errorf("queue of %d messages exceeds the limits", len(c.queued))
+				}
+				return
+			}
+
+			if len(c.queued) != 1 || c.queued[0].messageType != errorMessageType {
+				t.Fatalf("queue is %+v, want only an error", c.queued)
+			}
+			// type, more, code, description
+			encoded := c.queued[0].encoded
+			code := errorCode(binary.BigEndian.Uint16(encoded[2:]))
+			if code != errorTooSlow || string(encoded[4:]) != errorTextTooSlow {
+				t.Errorf("error is %d %q, want %d %q", code, encoded[4:], errorTooSlow, errorTextTooSlow)
+			}
+		})
+	}
+}
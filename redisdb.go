@@ -1,68 +1,460 @@
 package zwibserve
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"context"
-
 	"github.com/go-redis/redis/v9"
 )
 
-var ctx = context.Background()
-
 // RedisDocumentDB is a document database using Redis
+// Each key name begins with the KeyPrefix of the RedisOptions, if any.
 // The documents are stored as a string with the key "zwibbler:"+docID
 // The keys for the document are stored as an HKEY with the key "zwibbler-keys:"+docID
+// The DocumentInfo is stored as an HKEY with the key "zwibbler-info:"+docID
 // The tokens are stored as an hkey under the name:
-// zwibbler-token: and have docID, userID, permissions.
-// zwibbler-user: maps from userid to a set of tokens associated with the user.
+// zwibbler-token:{tokenID} and have docID, userID, permissions.
+// zwibbler-user:{userID} is the set of the names of the tokens associated with the user.
+// Each token and each user has its own hash tag, so that in a cluster they are
+// spread over the nodes. Earlier versions put all of them in the slot of the
+// hash tag {token}, as zwibbler-token:{token}:tokenID and zwibbler-user:{token}:userID,
+// or zwibbler-user:userID before that; these are still read.
 // The zwibbler-user keys must be periodically cleaned because they do not automatically expire,
-// but the tokens do.
+// but the tokens do. One server at a time does this, while it holds the zwibbler-maintenance lock.
 type RedisDocumentDB struct {
 	expiration int64
 	rdb        redis.UniversalClient
+	reader     redis.UniversalClient
 	isCluster  bool
+	prefix     string
+	timeout    time.Duration
+	log        *logger
+	stop       chan struct{}
+	closeOnce  sync.Once
+
+	archive     Archive
+	archiveOnce sync.Once
+}
+
+// Results of the scripts
+const (
+	redisOK       = 0
+	redisMissing  = 1
+	redisConflict = 2
+	redisExists   = 3
+)
+
+// Each operation that must check a value before changing it is done by a
+// script, so that it is atomic without retrying a WATCH transaction.
+// Script.Run uses EVALSHA, and loads the script only if redis does not have it.
+var (
+	// KEYS: document, [keys of the document, info of the document]
+	// ARGV: expected length, data, expiration seconds or 0, writer, time
+	// Returns {status, length}
+	redisAppendScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {1, 0}
+end
+local length = redis.call("STRLEN", KEYS[1])
+if length ~= tonumber(ARGV[1]) then
+	return {2, length}
+end
+length = redis.call("APPEND", KEYS[1], ARGV[2])
+if KEYS[3] and ARGV[2] ~= "" then
+	redis.call("HSET", KEYS[3], "modified", ARGV[5], "lastWriter", ARGV[4])
+	redis.call("HINCRBY", KEYS[3], "appends", 1)
+end
+local expiration = tonumber(ARGV[3])
+if expiration > 0 then
+	redis.call("EXPIRE", KEYS[1], expiration)
+	if KEYS[2] then
+		redis.call("EXPIRE", KEYS[2], expiration)
+		redis.call("EXPIRE", KEYS[3], expiration)
+	end
+end
+return {0, length}
+`)
+
+	// KEYS: keys of the document
+	// ARGV: name, old version, key as JSON, expiration seconds or 0
+	redisSetKeyScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], ARGV[1])
+if current then
+	if cjson.decode(current)["Version"] ~= tonumber(ARGV[2]) then
+		return 2
+	end
+elseif tonumber(ARGV[2]) ~= 0 then
+	return 2
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+local expiration = tonumber(ARGV[4])
+if expiration > 0 then
+	redis.call("EXPIRE", KEYS[1], expiration)
+end
+return 0
+`)
+
+	// KEYS: token, [tokens of the user, [document]]
+	// ARGV: userID, docID, permissions, expiration time, create document ("1" or "0"),
+	// contents, document expiration seconds or 0
+	redisAddTokenScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 3
+end
+if ARGV[5] == "1" then
+	if redis.call("EXISTS", KEYS[3]) == 1 then
+		return 2
+	end
+	redis.call("SET", KEYS[3], ARGV[6])
+	local expiration = tonumber(ARGV[7])
+	if expiration > 0 then
+		redis.call("EXPIRE", KEYS[3], expiration)
+	end
+end
+redis.call("HSET", KEYS[1], "userID", ARGV[1], "docID", ARGV[2], "permissions", ARGV[3])
+redis.call("EXPIREAT", KEYS[1], ARGV[4])
+if KEYS[2] then
+	redis.call("SADD", KEYS[2], KEYS[1])
+end
+return 0
+`)
+
+	// KEYS: sets of the tokens of the user
+	// ARGV: permissions
+	redisUpdateUserScript = redis.NewScript(`
+for _, set in ipairs(KEYS) do
+	for _, token in ipairs(redis.call("SMEMBERS", set)) do
+		if redis.call("EXISTS", token) == 1 then
+			redis.call("HSET", token, "permissions", ARGV[1])
+		end
+	end
+end
+return 0
+`)
+
+	// KEYS: token
+	// ARGV: permissions
+	redisSetPermissionsScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HSET", KEYS[1], "permissions", ARGV[1])
+end
+return 0
+`)
+
+	// KEYS: tokens of the user
+	// ARGV: cursor, count
+	// Returns {next cursor, number of expired tokens removed}
+	redisCleanUserScript = redis.NewScript(`
+local result = redis.call("SSCAN", KEYS[1], ARGV[1], "COUNT", ARGV[2])
+local removed = 0
+for _, token in ipairs(result[2]) do
+	if redis.call("EXISTS", token) == 0 then
+		removed = removed + redis.call("SREM", KEYS[1], token)
+	end
+end
+return {result[1], removed}
+`)
+
+	// KEYS: lock
+	// ARGV: owner, milliseconds
+	// Returns 1 if the lock is still held by the owner, and extends it.
+	redisExtendLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+	// KEYS: lock
+	// ARGV: owner
+	redisUnlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+)
+
+// Maintenance is attempted by every server this often, but only one at a time
+// holds the lock, and after it finishes, the lock is kept until the next
+// maintenance is due. If the server stops, the lease expires and another takes over.
+const (
+	redisMaintenanceCheck    = time.Hour
+	redisMaintenanceInterval = 24 * time.Hour
+	redisMaintenanceLease    = 10 * time.Minute
+)
+
+// Number of keys requested from each SCAN or SSCAN
+const redisBatchSize = 100
+
+// Documents are archived when their time to live is less than twice this.
+const redisArchiveInterval = time.Hour
+
+var errRedisLockLost = errors.New("lost the redis maintenance lock")
+
+// RedisOptions configures a RedisDocumentDB created by NewRedisDBWithClient.
+type RedisOptions struct {
+	// This is added to the beginning of the name of every key, eg. "staging:",
+	// to share a Redis server with other applications or environments. It may
+	// not contain the characters {}*?[]\
+	KeyPrefix string
+
+	// Each operation is cancelled if it takes longer than this. The default is
+	// no limit other than the context of the caller.
+	OperationTimeout time.Duration
+
+	// If set, tokens are read using this client, and so are the scans that
+	// list and archive the documents. For example, use redis.NewFailoverClient
+	// with ReplicaOnly set to read from replicas. A token that is missing is
+	// read again using the main client, since the replica may not have it yet.
+	// For a cluster, set ReadOnly in the redis.ClusterOptions instead.
+	ReadClient redis.UniversalClient
 }
 
 // NewRedisDB creates a new document storage based on Redis
 func NewRedisDB(options *redis.Options) DocumentDB {
-	return newGeneralRedisDB(redis.NewClient(options), false)
+	return newGeneralRedisDB(redis.NewClient(options), RedisOptions{})
 }
 
 // NewRedisClusterDB creates a new document storage based on Redis cluster
 func NewRedisClusterDB(options *redis.ClusterOptions) DocumentDB {
-	return newGeneralRedisDB(redis.NewClusterClient(options), true)
+	return newGeneralRedisDB(redis.NewClusterClient(options), RedisOptions{})
+}
+
+// NewRedisDBWithClient creates a new document storage using a client that you
+// have created, such as one from redis.NewFailoverClient for Sentinel, or
+// redis.NewUniversalClient. Choose the logical database in the options of the
+// client. The client is closed by the Close method.
+func NewRedisDBWithClient(client redis.UniversalClient, options RedisOptions) (*RedisDocumentDB, error) {
+	if strings.ContainsAny(options.KeyPrefix, "{}*?[]\\") {
+		return nil, fmt.Errorf("invalid redis key prefix %q", options.KeyPrefix)
+	}
+	return newGeneralRedisDB(client, options), nil
 }
 
-func newGeneralRedisDB(rdb redis.UniversalClient, isCluster bool) DocumentDB {
+func newGeneralRedisDB(rdb redis.UniversalClient, options RedisOptions) *RedisDocumentDB {
+	_, isCluster := rdb.(*redis.ClusterClient)
 	db := &RedisDocumentDB{
 		rdb:       rdb,
+		reader:    rdb,
 		isCluster: isCluster,
+		prefix:    options.KeyPrefix,
+		timeout:   options.OperationTimeout,
+		log:       newLogger(nil),
+		stop:      make(chan struct{}),
+	}
+	if options.ReadClient != nil {
+		db.reader = options.ReadClient
+	}
+
+	go db.maintenanceThread()
+	return db
+}
+
+// withTimeout limits an operation to the OperationTimeout.
+func (db *RedisDocumentDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.timeout > 0 {
+		return context.WithTimeout(ctx, db.timeout)
 	}
+	return ctx, func() {}
+}
+
+func (db *RedisDocumentDB) maintenanceThread() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-db.stop
+		cancel()
+	}()
+
+	for {
+		if err := db.runMaintenance(ctx); err != nil && ctx.Err() == nil {
+			db.log.error("redis maintenance failed", field(fieldError, err))
+		}
+
+		select {
+		case <-time.After(redisMaintenanceCheck):
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// SetLogger sets the destination of log messages.
+func (db *RedisDocumentDB) SetLogger(l Logger) {
+	db.log.setOutput(l)
+}
+
+// SetArchive sets where documents are stored before they expire. Redis
+// removes documents itself when their time to live is over, so they are
+// archived periodically once it is nearly over.
+func (db *RedisDocumentDB) SetArchive(archive Archive) {
+	db.archive = archive
+	db.archiveOnce.Do(func() {
+		go db.archiveThread()
+	})
+}
+
+func (db *RedisDocumentDB) archiveThread() {
+	for {
+		// Scan often enough that every document is seen before it expires.
+		interval := redisArchiveInterval
+		expiration := db.getRedisExpiration()
+		if expiration > 0 && expiration/4 < interval {
+			interval = expiration / 4
+		}
 
-	if !isCluster {
-		go func() {
-			for {
-				func() {
-					defer func() {
-						err := recover()
-						if err != nil {
-							log.Printf("Error: %v", err)
-						}
-					}()
-					db.runMaintenance()
-				}()
-				time.Sleep(time.Hour * 24)
+		if expiration > 0 {
+			if err := db.archiveExpiring(context.Background(), 2*interval); err != nil {
+				db.log.error("cannot archive expiring documents", field(fieldError, err))
 			}
-		}()
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-db.stop:
+			return
+		}
 	}
+}
 
-	return db
+// archiveExpiring stores the documents that will expire within the given time.
+// If a document is accessed after it is archived, its time to live is extended
+// and it will be archived again.
+func (db *RedisDocumentDB) archiveExpiring(ctx context.Context, within time.Duration) error {
+	return db.scan(ctx, db.docKey("*"), func(names []string) error {
+		for _, name := range names {
+			// TTL is rounded to seconds, so the expiration could be off by one.
+			ttl, err := db.reader.PTTL(ctx, name).Result()
+			if err != nil {
+				return err
+			} else if ttl < 0 || ttl > within {
+				// no expiration, or not yet
+				continue
+			}
+
+			data, err := db.reader.Get(ctx, name).Bytes()
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			docID := strings.TrimPrefix(name, db.docKey(""))
+			keys, err := db.GetDocumentKeysContext(ctx, docID)
+			if err != nil {
+				return err
+			}
+
+			// failures are tried again at the next scan.
+			archiveDocument(ctx, db.archive, db.log, docID, data, keys)
+		}
+		return nil
+	})
+}
+
+// ListDocuments ...
+func (db *RedisDocumentDB) ListDocuments(ctx context.Context, fn func(docID string) error) error {
+	return db.scan(ctx, db.docKey("*"), func(names []string) error {
+		for i, name := range names {
+			names[i] = strings.TrimPrefix(name, db.docKey(""))
+		}
+		return listEach(ctx, names, fn)
+	})
+}
+
+// ListTokens ...
+func (db *RedisDocumentDB) ListTokens(ctx context.Context, fn func(token TokenInfo) error) error {
+	return db.scan(ctx, db.prefix+"zwibbler-token:*", func(names []string) error {
+		for _, name := range names {
+			m, err := db.reader.HGetAll(ctx, name).Result()
+			if err != nil {
+				return err
+			}
+			// TTL is rounded to seconds, so the expiration could be off by one.
+			ttl, err := db.reader.PTTL(ctx, name).Result()
+			if err != nil {
+				return err
+			} else if len(m) == 0 || ttl <= 0 {
+				// expired
+				continue
+			}
+
+			err = fn(TokenInfo{
+				Token:       db.tokenID(name),
+				DocID:       m["docID"],
+				UserID:      m["userID"],
+				Permissions: m["permissions"],
+				Expiration:  time.Now().Add(ttl).Round(time.Second).Unix(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return ctx.Err()
+	})
+}
+
+// scan calls fn with the names of the keys matching the pattern. In a cluster,
+// each master is scanned concurrently, but fn is called by one at a time.
+func (db *RedisDocumentDB) scan(ctx context.Context, match string, fn func(names []string) error) error {
+	var mutex sync.Mutex
+	scanClient := func(ctx context.Context, client redis.Cmdable) error {
+		var cursor uint64
+		for {
+			names, next, err := client.Scan(ctx, cursor, match, redisBatchSize).Result()
+			if err != nil {
+				return err
+			}
+			mutex.Lock()
+			err = fn(names)
+			mutex.Unlock()
+			if err != nil {
+				return err
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+
+	if cluster, ok := db.rdb.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scanClient(ctx, client)
+		})
+	}
+	return scanClient(ctx, db.reader)
+}
+
+// Close stops the maintenance goroutine and closes the connection to redis.
+// Calling it again has no effect.
+func (db *RedisDocumentDB) Close() error {
+	var err error
+	db.closeOnce.Do(func() {
+		close(db.stop)
+		if db.reader != db.rdb {
+			db.reader.Close()
+		}
+		err = db.rdb.Close()
+	})
+	return err
 }
 
 func (db *RedisDocumentDB) CheckHealth() error {
+	return db.CheckHealthContext(context.Background())
+}
+
+// CheckHealthContext ...
+func (db *RedisDocumentDB) CheckHealthContext(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	_, err := db.rdb.Ping(ctx).Result()
 	return err
 }
@@ -72,30 +464,94 @@ func (db *RedisDocumentDB) SetExpiration(seconds int64) {
 	db.expiration = seconds
 }
 
-func getDocID(docID string) string {
-	return "zwibbler:" + docID
+func (db *RedisDocumentDB) docKey(docID string) string {
+	return db.prefix + "zwibbler:" + docID
 }
 
-func getKeys(docID string) string {
-	return "zwibbler-keys:" + docID
+func (db *RedisDocumentDB) keysKey(docID string) string {
+	return db.prefix + "zwibbler-keys:" + docID
+}
+
+func (db *RedisDocumentDB) infoKey(docID string) string {
+	return db.prefix + "zwibbler-info:" + docID
 }
 
 // We are going to keep all of the tokens on one server in the cluster.
-// This is to make the Watch in updatePermissions work.
-func getToken(tokenID string) string {
-	return "zwibbler-token:{token}:" + tokenID
+// This is so that the scripts can change a user's set and their tokens together.
+func (db *RedisDocumentDB) tokenKey(tokenID string) string {
+	return db.prefix + "zwibbler-token:{" + tokenID + "}"
+}
+
+// legacyTokenKey is the name of the token in earlier versions.
+func (db *RedisDocumentDB) legacyTokenKey(tokenID string) string {
+	return db.prefix + "zwibbler-token:{token}:" + tokenID
+}
+
+// tokenID returns the ID of the token with the given key name.
+func (db *RedisDocumentDB) tokenID(name string) string {
+	name = strings.TrimPrefix(name, db.prefix+"zwibbler-token:")
+	if strings.HasPrefix(name, "{token}:") {
+		return strings.TrimPrefix(name, "{token}:")
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+}
+
+func (db *RedisDocumentDB) userKey(userID string) string {
+	return db.prefix + "zwibbler-user:{" + userID + "}"
+}
+
+// userKeys returns the names of the sets of the user's tokens, including
+// those of earlier versions.
+func (db *RedisDocumentDB) userKeys(userID string) []string {
+	return []string{
+		db.userKey(userID),
+		db.prefix + "zwibbler-user:{token}:" + userID,
+		db.prefix + "zwibbler-user:" + userID,
+	}
+}
+
+// userID returns the ID of the user with the given set name, in any version.
+func (db *RedisDocumentDB) userID(name string) string {
+	name = strings.TrimPrefix(name, db.prefix+"zwibbler-user:")
+	if strings.HasPrefix(name, "{token}:") {
+		return strings.TrimPrefix(name, "{token}:")
+	} else if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
+
+func (db *RedisDocumentDB) lockKey() string {
+	return db.prefix + "zwibbler-maintenance"
 }
 
 // GetDocument ...
 func (db *RedisDocumentDB) GetDocument(docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	return db.GetDocumentContext(context.Background(), docID, mode, initialData)
+}
 
-	docID = getDocID(docID)
+// GetDocumentContext ...
+func (db *RedisDocumentDB) GetDocumentContext(ctx context.Context, docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	return getOrRestore(ctx, db.archive, db.log, docID, mode, initialData,
+		func(mode CreateMode, initialData []byte) ([]byte, bool, error) {
+			return db.getDocument(ctx, docID, mode, initialData, UserIDFromContext(ctx))
+		}, func(key Key) error {
+			return db.SetDocumentKeyContext(ctx, docID, 0, key)
+		})
+}
+
+func (db *RedisDocumentDB) getDocument(ctx context.Context, docIDin string, mode CreateMode, initialData []byte, userID string) ([]byte, bool, error) {
+
+	docID := db.docKey(docIDin)
 	var doc []byte
 	var created bool
 	var err error
 
 	// handle possibly and always create using a transaction.
-	err = db.executeWatch(func(tx *redis.Tx) error {
+	err = db.executeWatch(ctx, func(tx *redis.Tx) error {
 		doc, err = tx.Get(ctx, docID).Bytes()
 
 		// if the key exists
@@ -133,10 +589,34 @@ func (db *RedisDocumentDB) GetDocument(docID string, mode CreateMode, initialDat
 		return nil, false, err
 	}
 
+	if created {
+		db.recordCreation(ctx, docIDin, userID)
+	}
 	return doc, created, nil
 
 }
 
+// recordCreation stores the DocumentInfo of a new document. The document may
+// be on another node in a cluster, so it is stored after the document is
+// created. The information is only advisory, so failures are logged.
+func (db *RedisDocumentDB) recordCreation(ctx context.Context, docID, creator string) {
+	now := time.Now().Unix()
+	infoKey := db.infoKey(docID)
+	_, err := db.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, infoKey, "created", now, "creator", creator)
+		// A writer may have appended already.
+		pipe.HSetNX(ctx, infoKey, "modified", now)
+		pipe.HSetNX(ctx, infoKey, "lastWriter", creator)
+		if expiration := db.getRedisExpiration(); expiration > 0 {
+			pipe.Expire(ctx, infoKey, expiration)
+		}
+		return nil
+	})
+	if err != nil {
+		db.log.warn("cannot record document creation", field(fieldDocument, docID), field(fieldError, err))
+	}
+}
+
 func (db *RedisDocumentDB) getRedisExpiration() time.Duration {
 	if db.expiration == 0 || db.expiration == NoExpiration {
 		return 0
@@ -146,44 +626,68 @@ func (db *RedisDocumentDB) getRedisExpiration() time.Duration {
 
 // AppendDocument ...
 func (db *RedisDocumentDB) AppendDocument(docIDin string, oldLength uint64, newData []byte) (uint64, error) {
-	var actualLength uint64
-	var err error
+	return db.AppendDocumentContext(context.Background(), docIDin, oldLength, newData)
+}
 
-	docID := getDocID(docIDin)
+// AppendDocumentContext ...
+func (db *RedisDocumentDB) AppendDocumentContext(ctx context.Context, docIDin string, oldLength uint64, newData []byte) (uint64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
-	err = db.executeWatch(func(tx *redis.Tx) error {
-		actualLength, err = tx.StrLen(ctx, docID).Uint64()
+	// Outside of a cluster, the keys and info are changed in the same script.
+	// In a cluster, they may be on another node.
+	keys := []string{db.docKey(docIDin)}
+	if !db.isCluster {
+		keys = append(keys, db.keysKey(docIDin), db.infoKey(docIDin))
+	}
 
-		if err != nil {
-			return err
-		} else if actualLength != oldLength {
-			return ErrConflict
-		}
+	writer := UserIDFromContext(ctx)
+	now := time.Now().Unix()
+	expiration := int64(db.getRedisExpiration() / time.Second)
+	result, err := redisAppendScript.Run(ctx, db.rdb, keys, oldLength, newData, expiration, writer, now).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
 
-		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.Append(ctx, docID, string(newData))
-			expiration := db.getRedisExpiration()
+	if db.isCluster && result[0] == redisOK {
+		_, err := db.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			infoKey := db.infoKey(docIDin)
+			if len(newData) > 0 {
+				pipe.HSet(ctx, infoKey, "modified", now, "lastWriter", writer)
+				pipe.HIncrBy(ctx, infoKey, "appends", 1)
+			}
 			if expiration > 0 {
-				pipe.Expire(ctx, docID, db.getRedisExpiration())
-				pipe.Expire(ctx, getKeys(docIDin), db.getRedisExpiration())
+				pipe.Expire(ctx, db.keysKey(docIDin), db.getRedisExpiration())
+				pipe.Expire(ctx, infoKey, db.getRedisExpiration())
 			}
-
-			actualLength = oldLength + uint64(len(newData))
-
-			return err
+			return nil
 		})
+		if err != nil {
+			db.log.warn("cannot record append", field(fieldDocument, docIDin), field(fieldError, err))
+		}
+	}
 
-		return err
-	}, docID)
-
-	return actualLength, err
+	switch result[0] {
+	case redisMissing:
+		return 0, ErrMissing
+	case redisConflict:
+		return uint64(result[1]), ErrConflict
+	}
+	return uint64(result[1]), nil
 }
 
 // GetDocumentKeys ...
 func (db *RedisDocumentDB) GetDocumentKeys(docID string) ([]Key, error) {
+	return db.GetDocumentKeysContext(context.Background(), docID)
+}
+
+// GetDocumentKeysContext ...
+func (db *RedisDocumentDB) GetDocumentKeysContext(ctx context.Context, docID string) ([]Key, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
 	var keys []Key
-	docID = getKeys(docID)
+	docID = db.keysKey(docID)
 	m, err := db.rdb.HGetAll(ctx, docID).Result()
 	if err != nil {
 		return nil, err
@@ -202,70 +706,56 @@ func (db *RedisDocumentDB) GetDocumentKeys(docID string) ([]Key, error) {
 
 // SetDocumentKey ...
 func (db *RedisDocumentDB) SetDocumentKey(docIDin string, oldVersion int, key Key) error {
-	// Keys are stored as hash maps as JSON
+	return db.SetDocumentKeyContext(context.Background(), docIDin, oldVersion, key)
+}
 
-	// create the key
-	keysID := getKeys(docIDin)
-	newJSON, err := json.Marshal(key)
+// SetDocumentKeyContext ...
+func (db *RedisDocumentDB) SetDocumentKeyContext(ctx context.Context, docIDin string, oldVersion int, key Key) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
+	// Keys are stored as hash maps as JSON
+	newJSON, err := json.Marshal(key)
 	if err != nil {
 		return err
 	}
 
-	// in a transaction, set the key if it matches the old version
-	return db.executeWatch(func(tx *redis.Tx) error {
-		var currentKey Key
-		exists := true
-		currentJSON, err := tx.HGet(ctx, keysID, key.Name).Bytes()
-
-		if err == redis.Nil {
-			err = nil
-			exists = false
-		}
-
-		// if key exists and the old version does not match, return conflict.
-		if exists {
-			err = json.Unmarshal(currentJSON, &currentKey)
-			if err != nil {
-				return err
-			}
-
-			if currentKey.Version != oldVersion {
-				return ErrConflict
-			}
-
-			// if key does not exists and the older version is not zero, it is also a conflict.
-		} else if oldVersion != 0 {
-			return ErrConflict
-		}
-
-		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HSet(ctx, keysID, key.Name, newJSON)
-			expiration := db.getRedisExpiration()
-			if expiration > 0 {
-				pipe.Expire(ctx, keysID, expiration)
-			}
-			return nil
-		})
-
+	expiration := int64(db.getRedisExpiration() / time.Second)
+	result, err := redisSetKeyScript.Run(ctx, db.rdb, []string{db.keysKey(docIDin)}, key.Name, oldVersion, newJSON, expiration).Int64()
+	if err != nil {
 		return err
-	}, keysID)
+	} else if result == redisConflict {
+		return ErrConflict
+	}
+	return nil
 }
 
 func (db *RedisDocumentDB) DeleteDocument(docID string) error {
+	return db.DeleteDocumentContext(context.Background(), docID)
+}
+
+// DeleteDocumentContext ...
+func (db *RedisDocumentDB) DeleteDocumentContext(ctx context.Context, docID string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	_, err := db.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.Del(ctx, getDocID(docID))
-		pipe.Del(ctx, getKeys(docID))
+		pipe.Del(ctx, db.docKey(docID))
+		pipe.Del(ctx, db.keysKey(docID))
+		pipe.Del(ctx, db.infoKey(docID))
 		return nil
 	})
+	if err == nil && db.archive != nil {
+		err = db.archive.DeleteDocument(ctx, docID)
+	}
 	return err
 }
 
-func (db *RedisDocumentDB) executeWatch(watchfn func(tx *redis.Tx) error, keys ...string) error {
+func (db *RedisDocumentDB) executeWatch(ctx context.Context, watchfn func(tx *redis.Tx) error, keys ...string) error {
 	var err error
 	for {
 		err = db.rdb.Watch(ctx, watchfn, keys...)
-		if err == redis.TxFailedErr {
+		if err == redis.TxFailedErr && ctx.Err() == nil {
 			continue
 		}
 
@@ -276,60 +766,122 @@ func (db *RedisDocumentDB) executeWatch(watchfn func(tx *redis.Tx) error, keys .
 
 // AddToken ...
 func (db *RedisDocumentDB) AddToken(tokenID, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
-	if db.isCluster {
-		log.Panicf("addToken not supported with clusters. Use JWT instead.")
-	}
-
-	tokenID = getToken(tokenID)
-
-	err := db.executeWatch(func(tx *redis.Tx) error {
+	return db.AddTokenContext(context.Background(), tokenID, docID, userID, permissions, expirationSeconds, contents)
+}
 
-		// check if token already exists
-		m, err := tx.HGetAll(ctx, tokenID).Result()
-		if err == nil && len(m) > 0 {
+// AddTokenContext ...
+func (db *RedisDocumentDB) AddTokenContext(ctx context.Context, tokenID, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	keys := []string{db.tokenKey(tokenID), db.userKey(userID), db.docKey(docID)}
+	create := len(contents) > 0
+	createdFirst := false
+	if db.isCluster && create {
+		// The document may be on another node, so it is created first, and
+		// removed if the token cannot be added.
+		if exists, err := db.rdb.Exists(ctx, keys[0]).Result(); err != nil {
+			return err
+		} else if exists == 1 {
 			return ErrExists
 		}
 
-		// check if document id exists
-		if len(contents) != 0 {
-			exists, err := tx.Exists(ctx, getDocID(docID)).Result()
-			if err != nil {
-				return err
-			}
-			if exists > 0 {
-				return ErrConflict
-			}
+		created, err := db.rdb.SetNX(ctx, keys[2], contents, db.getRedisExpiration()).Result()
+		if err != nil {
+			return err
+		} else if !created {
+			return ErrConflict
 		}
+		createdFirst = true
+	}
+	if db.isCluster {
+		// The user's set is in another slot, so it is changed afterward.
+		keys = keys[:1]
+		create = false
+	}
 
-		expiration := time.Until(time.Unix(expirationSeconds, 0))
-
-		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			// Create document if required.
-			if len(contents) > 0 {
-				pipe.Set(ctx, getDocID(docID), string(contents), db.getRedisExpiration())
-			}
-
-			pipe.HSet(ctx, tokenID, "userID", userID, "docID", docID,
-				"permissions", permissions)
-			pipe.Expire(ctx, tokenID, expiration)
-			pipe.SAdd(ctx, "zwibbler-user:"+userID, tokenID)
-			return nil
-		})
-
+	result, err := redisAddTokenScript.Run(ctx, db.rdb, keys, userID, docID, permissions, expirationSeconds,
+		create, contents, int64(db.getRedisExpiration()/time.Second)).Int64()
+	if err == nil && result == redisOK && db.isCluster {
+		if err = db.rdb.SAdd(ctx, db.userKey(userID), db.tokenKey(tokenID)).Err(); err != nil {
+			db.rdb.Del(context.Background(), db.tokenKey(tokenID))
+		}
+	}
+	if createdFirst && (err != nil || result != redisOK) {
+		db.rdb.Del(context.Background(), db.docKey(docID))
+	}
+	if err != nil {
 		return err
+	}
 
-		// This watch should really have getDocID(docID) too but we can't because
-		// we might be using a cluster. Instead we deprecate AddToken.
-	}, tokenID)
+	switch result {
+	case redisExists:
+		return ErrExists
+	case redisConflict:
+		return ErrConflict
+	}
 
-	return err
+	if len(contents) > 0 {
+		db.recordCreation(ctx, docID, userID)
+	}
+	return nil
+}
 
+// GetDocumentInfo ...
+func (db *RedisDocumentDB) GetDocumentInfo(ctx context.Context, docID string) (DocumentInfo, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	info := DocumentInfo{DocID: docID}
+	var exists *redis.IntCmd
+	var length *redis.IntCmd
+	var fields *redis.MapStringStringCmd
+	_, err := db.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Exists(ctx, db.docKey(docID))
+		length = pipe.StrLen(ctx, db.docKey(docID))
+		fields = pipe.HGetAll(ctx, db.infoKey(docID))
+		return nil
+	})
+	if err != nil {
+		return info, err
+	} else if exists.Val() == 0 {
+		return info, ErrMissing
+	}
+
+	m := fields.Val()
+	info.Length = uint64(length.Val())
+	info.Creator = m["creator"]
+	info.LastWriter = m["lastWriter"]
+	info.Appends, _ = strconv.ParseInt(m["appends"], 10, 64)
+	if seconds, err := strconv.ParseInt(m["created"], 10, 64); err == nil {
+		info.Created = time.Unix(seconds, 0)
+	}
+	if seconds, err := strconv.ParseInt(m["modified"], 10, 64); err == nil {
+		info.Modified = time.Unix(seconds, 0)
+	}
+	return info, nil
 }
 
 // Given a token, returns docID, userID, permissions. If it does not exist or is expired,
 // the error is ErrMissing
 func (db *RedisDocumentDB) GetToken(token string) (docID, userID, permissions string, err error) {
-	m, err := db.rdb.HGetAll(ctx, getToken(token)).Result()
+	return db.GetTokenContext(context.Background(), token)
+}
+
+// GetTokenContext ...
+func (db *RedisDocumentDB) GetTokenContext(ctx context.Context, token string) (docID, userID, permissions string, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	m, err := db.reader.HGetAll(ctx, db.tokenKey(token)).Result()
+	if err == nil && len(m) == 0 && db.reader != db.rdb {
+		// it may not have reached the replica yet
+		m, err = db.rdb.HGetAll(ctx, db.tokenKey(token)).Result()
+	}
+	if err == nil && len(m) == 0 {
+		// it may have been added by an earlier version
+		m, err = db.rdb.HGetAll(ctx, db.legacyTokenKey(token)).Result()
+	}
 
 	if err == nil && len(m) > 0 {
 		docID = m["docID"]
@@ -343,137 +895,161 @@ func (db *RedisDocumentDB) GetToken(token string) (docID, userID, permissions st
 
 // If the user has any tokens, the permissions of all of them are updated.
 func (db *RedisDocumentDB) UpdateUser(userID, permissions string) error {
-	if db.isCluster {
-		log.Panicf("updateUser not supported with clusters. Use JWT instead.")
-	}
+	return db.UpdateUserContext(context.Background(), userID, permissions)
+}
 
-	tokens, err := db.rdb.SMembers(ctx, "zwibbler-user:"+userID).Result()
-	if err != nil {
-		panic(err)
-	}
+// UpdateUserContext ...
+func (db *RedisDocumentDB) UpdateUserContext(ctx context.Context, userID, permissions string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
-	return db.executeWatch(func(tx *redis.Tx) error {
-		// for each key, if it exists, then set the permissions
+	db.log.debug("update permissions", field(fieldUser, userID), field("permissions", permissions))
+	if !db.isCluster {
+		return redisUpdateUserScript.Run(ctx, db.rdb, db.userKeys(userID), permissions).Err()
+	}
 
+	// In a cluster, the tokens are in other slots than the sets, so each is
+	// changed separately.
+	for _, set := range db.userKeys(userID) {
+		tokens, err := db.rdb.SMembers(ctx, set).Result()
+		if err != nil {
+			return err
+		}
 		for _, token := range tokens {
-			exists, err := tx.Exists(ctx, token).Result()
-			if err != nil {
+			if err := redisSetPermissionsScript.Run(ctx, db.rdb, []string{token}, permissions).Err(); err != nil {
 				return err
 			}
-
-			if exists > 0 {
-				log.Printf("Update permissions for token %s to %s", token, permissions)
-				tx.HSet(ctx, token, "permissions", permissions)
-			}
 		}
-		return nil
-	}, tokens...)
+	}
+	return nil
 }
 
-func (db *RedisDocumentDB) runMaintenance() {
-	// not called if using redis-cluster
-	log.Printf("Running Redis maintenance")
-	// We used a zwibbler-user: key to quickly lookup the tokens for a given user.
-	// But there is no way to expire a member of a set. So once a day, go through them
-	// all and remove any that are all expired.
-
-	// get a list of all the user keys
-	var cursor uint64
-	var userkeys []string
-	for {
-		var keys []string
-		var err error
-		keys, cursor, err = db.rdb.Scan(ctx, cursor, "zwibbler-user:*", 10).Result()
-		if err != nil {
-			panic(err)
-		}
-		userkeys = append(userkeys, keys...)
-		if cursor == 0 {
-			break
-		}
+// runMaintenance removes expired tokens from the sets of the users, if no
+// other server has done so recently.
+func (db *RedisDocumentDB) runMaintenance(ctx context.Context) error {
+	owner := randomHex(16)
+	locked, err := db.rdb.SetNX(ctx, db.lockKey(), owner, redisMaintenanceLease).Result()
+	if err != nil || !locked {
+		return err
 	}
 
-	// get the tokens of every user and put the into this structure
-	userTokens := make(map[string][]string)
-	results, err := db.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		for _, key := range userkeys {
-			pipe.SMembers(ctx, key)
-		}
-		return nil
-	})
-
-	if err != nil {
-		panic(err)
+	db.log.info("running redis maintenance")
+	if err := db.cleanUserTokens(ctx, owner); err != nil {
+		// let another server try
+		redisUnlockScript.Run(context.Background(), db.rdb, []string{db.lockKey()}, owner)
+		return err
 	}
 
-	for i, result := range results {
-		slice, err := result.(*redis.StringSliceCmd).Result()
+	return redisExtendLockScript.Run(ctx, db.rdb, []string{db.lockKey()}, owner,
+		redisMaintenanceInterval.Milliseconds()).Err()
+}
+
+// cleanUserTokens goes through the zwibbler-user: sets on every master, a batch
+// at a time. There is no way to expire a member of a set, so the tokens that no
+// longer exist are removed, and a set is removed with its last token.
+func (db *RedisDocumentDB) cleanUserTokens(ctx context.Context, owner string) error {
+	sets, removed := 0, 0
+	err := db.scan(ctx, db.prefix+"zwibbler-user:*", func(names []string) error {
+		// keep the lock for as long as it takes
+		extended, err := redisExtendLockScript.Run(ctx, db.rdb, []string{db.lockKey()}, owner,
+			redisMaintenanceLease.Milliseconds()).Int()
 		if err != nil {
-			panic(err)
+			return err
+		} else if extended == 0 {
+			return errRedisLockLost
 		}
-		userTokens[userkeys[i]] = slice
-	}
 
-	// build a unique list of tokens to check existence for
-	have := make(map[string]bool)
-	var checked []string
-	for _, tokenList := range userTokens {
-		for _, token := range tokenList {
-			if !have[token] {
-				have[token] = true
-				checked = append(checked, token)
+		for _, name := range names {
+			if newName := db.userKey(db.userID(name)); name != newName {
+				if err := db.moveUserTokens(ctx, name, newName); err != nil {
+					return err
+				}
+				name = newName
 			}
-		}
-	}
 
-	// check existence
-	results, err = db.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		for _, token := range checked {
-			pipe.Exists(ctx, token)
+			count, err := db.cleanUserSet(ctx, name)
+			if err != nil {
+				return err
+			}
+			removed += count
+			sets++
 		}
-		return nil
+		return ctx.Err()
 	})
 
-	if err != nil {
-		panic(err)
-	}
+	db.log.info("finished redis maintenance", field("sets", sets), field("removed", removed))
+	return err
+}
 
-	// make have[token] = true if the key still exists
-	have = make(map[string]bool)
-	for i, result := range results {
-		ok, err := result.(*redis.IntCmd).Result()
-		if err != nil {
-			panic(err)
+// cleanUserSet removes the tokens that no longer exist from the set, a batch at
+// a time, and returns how many were removed.
+func (db *RedisDocumentDB) cleanUserSet(ctx context.Context, name string) (int, error) {
+	removed := 0
+	var cursor uint64
+	for {
+		if !db.isCluster {
+			result, err := redisCleanUserScript.Run(ctx, db.rdb, []string{name}, cursor, redisBatchSize).Slice()
+			if err != nil {
+				return removed, err
+			}
+			next, _ := result[0].(string)
+			count, _ := result[1].(int64)
+			removed += int(count)
+			if cursor, err = strconv.ParseUint(next, 10, 64); err != nil {
+				return removed, err
+			}
+		} else {
+			// In a cluster, the tokens are in other slots than the set.
+			tokens, next, err := db.rdb.SScan(ctx, name, cursor, "", redisBatchSize).Result()
+			if err != nil {
+				return removed, err
+			}
+			for _, token := range tokens {
+				exists, err := db.rdb.Exists(ctx, token).Result()
+				if err != nil {
+					return removed, err
+				} else if exists == 0 {
+					count, err := db.rdb.SRem(ctx, name, token).Result()
+					if err != nil {
+						return removed, err
+					}
+					removed += int(count)
+				}
+			}
+			cursor = next
 		}
 
-		if ok == 1 {
-			have[checked[i]] = true
+		if cursor == 0 {
+			return removed, nil
 		}
 	}
+}
 
-	_, err = db.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-
-		// go through all the user->token set mappings, and remove entries that no longer
-		// exist. If all tokens don't exist, then remove the zwibbler-user: entry.
-		for userid, tokenList := range userTokens {
-			removed := 0
-			for _, token := range tokenList {
-				if !have[token] {
-					log.Printf("Remove from %s set: %s", userid, token)
-					pipe.SRem(ctx, userid, token)
-					removed++
-				}
-			}
-
-			if removed == len(tokenList) {
-				log.Printf("Remove key %s", userid)
-				pipe.Del(ctx, userid)
-			}
-		}
-		return nil
-	})
+// moveUserTokens moves a set created by an earlier version, which was in the
+// slot of all of the tokens, to the set named for the user.
+func (db *RedisDocumentDB) moveUserTokens(ctx context.Context, name, newName string) error {
+	if !db.isCluster {
+		_, err := db.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SUnionStore(ctx, newName, newName, name)
+			pipe.Del(ctx, name)
+			return nil
+		})
+		return err
+	}
 
+	// In a cluster, the sets are in different slots.
+	tokens, err := db.rdb.SMembers(ctx, name).Result()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if len(tokens) > 0 {
+		members := make([]interface{}, len(tokens))
+		for i, token := range tokens {
+			members[i] = token
+		}
+		if err := db.rdb.SAdd(ctx, newName, members...).Err(); err != nil {
+			return err
+		}
 	}
+	return db.rdb.Del(ctx, name).Err()
 }
@@ -0,0 +1,22 @@
+package zwibserve_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/smhanov/zwibserve"
+	"github.com/smhanov/zwibserve/dbtest"
+)
+
+// BenchmarkRedisContention runs the contention benchmarks against the Redis
+// server at REDIS_ADDR, eg. "localhost:6379".
+func BenchmarkRedisContention(b *testing.B) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		b.Skip("REDIS_ADDR is not set")
+	}
+	dbtest.RunContentionBenchmarks(b, func(b *testing.B) zwibserve.DocumentDB {
+		return zwibserve.NewRedisDB(&redis.Options{Addr: addr})
+	})
+}
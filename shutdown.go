@@ -0,0 +1,69 @@
+package zwibserve
+
+import (
+	"context"
+)
+
+// SetAlternateServer sets the url of another server, which is given to clients
+// in the error message they receive when this server shuts down.
+func (zh *Handler) SetAlternateServer(url string) {
+	zh.alternateServer = url
+}
+
+// Shutdown gracefully stops the handler. It stops accepting new connections,
+// sends each client a "server going away" error and closes its connection after
+// its queued messages are written. Then it delivers any pending webhooks, waits
+// for deliveries already in progress, stops the background goroutines, and
+// closes the DocumentDB if it implements io.Closer.
+//
+// If the context expires before the clients have disconnected, their connections
+// are closed immediately and the context's error is returned.
+func (zh *Handler) Shutdown(ctx context.Context) error {
+	zh.mutex.Lock()
+	if zh.shuttingDown {
+		zh.mutex.Unlock()
+		return nil
+	}
+	zh.shuttingDown = true
+	zh.mutex.Unlock()
+
+	message := "server going away"
+	if zh.alternateServer != "" {
+		message += "; reconnect to " + zh.alternateServer
+	}
+
+	zh.log.info("shutting down")
+	zh.hub.shutdown(message)
+
+	// wait for all of the clients to disconnect.
+	done := make(chan struct{})
+	go func() {
+		zh.connections.Wait()
+		close(done)
+	}()
+
+	var result error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		zh.log.warn("closing remaining connections", field(fieldError, ctx.Err()))
+		zh.hub.closeClients()
+		result = ctx.Err()
+	}
+
+	// wait for the hub to process the client removals, which queue the
+	// idle-session webhooks.
+	zh.hub.runAll(func(sh *hubShard) {})
+
+	if err := zh.hub.hooks.flush(ctx); err != nil && result == nil {
+		result = err
+	}
+	zh.hub.stop()
+
+	if err := zh.db.Close(); err != nil && result == nil {
+		result = err
+	}
+
+	zh.log.info("shutdown complete")
+	return result
+}
@@ -0,0 +1,127 @@
+package zwibserve
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readUntilError reads messages until the server sends an error, and returns it.
+func readUntilError(t *testing.T, conn *websocket.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			t.Fatalf("reading error message: %v", err)
+		}
+		if msg[0] == errorMessageType {
+			return msg
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	db, err := NewSQLXConnectionWithOptions("sqlite3", "file:shutdown?mode=memory&cache=shared", SQLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zh := NewHandler(db)
+	zh.SetLogger(NewStdLogger(LogError))
+	zh.SetAlternateServer("wss://other.example.com")
+	server := httptest.NewServer(zh)
+	defer server.Close()
+
+	address := "ws" + strings.TrimPrefix(server.URL, "http")
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(address, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		sendConnectMessage(conn, "shutdown")
+		if _, err := readMessage(conn); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- zh.Shutdown(ctx)
+	}()
+
+	for _, conn := range conns {
+		msg := readUntilError(t, conn)
+		if !bytes.Contains(msg, []byte("server going away; reconnect to wss://other.example.com")) {
+			t.Errorf("unexpected error message %q", msg)
+		}
+		// the server closes the connection after the error.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); err == nil {
+			t.Error("connection was not closed")
+		}
+	}
+
+	if err := <-result; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// new connections are refused.
+	if _, _, err := websocket.DefaultDialer.Dial(address, nil); err == nil {
+		t.Error("connected after shutdown")
+	}
+
+	// the database was closed by Shutdown, and closing it again does nothing.
+	if err := db.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestShutdownWaitsForWebhooks(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	var delivered int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		atomic.StoreInt32(&delivered, 1)
+	}))
+	defer hook.Close()
+	defer releaseOnce.Do(func() { close(release) })
+
+	whq := createWebhookQueue(nil, newLogger(NewStdLogger(LogError)), nil)
+	whq.add(webhookEvent{name: "idle-session", url: hook.URL, documentID: "doc", sendBy: time.Now()})
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		done <- whq.flush(context.Background())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("flush returned before the delivery in progress finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&delivered) == 0 {
+		t.Error("webhook was not delivered")
+	}
+}
@@ -1,11 +1,13 @@
 package zwibserve
 
 import (
+	"context"
 	"errors"
-	"log"
 	"net/http"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -67,7 +69,8 @@ type DocumentDB interface {
 	GetDocumentKeys(docID string) ([]Key, error)
 
 	// SetExpirationTime sets the number of seconds that a document is kept without any activity
-	// before it is deleted. The zero value is the default (never)
+	// before it is deleted. The zero value is the default (never). Expired documents
+	// and tokens are removed at the next access, and then periodically.
 	SetExpiration(seconds int64)
 
 	DeleteDocument(docID string) error
@@ -89,6 +92,62 @@ type DocumentDB interface {
 	CheckHealth() error
 }
 
+// DocumentLister is implemented by databases that can enumerate their
+// documents. All of the included databases implement it.
+type DocumentLister interface {
+	// ListDocuments calls fn with the ID of each document, stopping early if
+	// fn returns an error. The database may be used from fn. Documents created
+	// or deleted during the listing may or may not be included.
+	ListDocuments(ctx context.Context, fn func(docID string) error) error
+}
+
+// TokenLister is implemented by databases that can enumerate their tokens. All
+// of the included databases implement it.
+type TokenLister interface {
+	// ListTokens calls fn with each unexpired token, stopping early if fn
+	// returns an error. The database may be used from fn.
+	ListTokens(ctx context.Context, fn func(token TokenInfo) error) error
+}
+
+// TokenInfo describes a token that was added using AddToken.
+type TokenInfo struct {
+	Token       string
+	DocID       string
+	UserID      string
+	Permissions string
+
+	// Unix time in seconds
+	Expiration int64
+}
+
+var errListUnsupported = errors.New("the database cannot list its documents or tokens")
+
+// listTokensEach calls fn with each of the tokens.
+func listTokensEach(ctx context.Context, tokens []TokenInfo, fn func(token TokenInfo) error) error {
+	for _, token := range tokens {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listEach calls fn with each of the document IDs.
+func listEach(ctx context.Context, docIDs []string, fn func(docID string) error) error {
+	for _, docID := range docIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(docID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Key is a key that can be set by clients, related to the session.
 type Key struct {
 	Version int
@@ -125,21 +184,40 @@ type Hub interface {
 // Handler is an HTTP handler that will
 // enable collaboration between clients.
 type Handler struct {
-	db               DocumentDB
+	db               *instrumentedDB
 	hub              *hub
 	allowCompression bool
 	secretUser       string
 	secretPassword   string
 	webhookURL       string
+
+	metrics            *metrics
+	metricsRequireAuth bool
+
+	log *logger
+
+	// protects shuttingDown and the addition of connections
+	mutex           sync.Mutex
+	shuttingDown    bool
+	connections     sync.WaitGroup
+	alternateServer string
 }
 
 // NewHandler returns a new Zwibbler Handler. You must pass it a document database to use.
 // You may use one of MemoryDocumentDB, SQLITEDocumentDB or create your own.
 func NewHandler(db DocumentDB) *Handler {
+	m := newMetrics()
+	l := newLogger(NewStdLogger(LogInfo))
+	t := newTracer()
+	if c, ok := db.(*CachingDB); ok {
+		m.addCollector(c.collectMetrics)
+	}
 	return &Handler{
-		db:               db,
-		hub:              newHub(db),
+		db:               newInstrumentedDB(db, m, t),
+		hub:              newHub(db, m, l, t),
 		allowCompression: true,
+		metrics:          m,
+		log:              l,
 	}
 }
 
@@ -176,6 +254,30 @@ func (zh *Handler) SetJWTKey(key string, keyIsBase64 bool) {
 	zh.hub.swarm.SetSecurityInfo(zh.hub.secretUser, zh.hub.secretPassword, zh.hub.jwtKey, zh.hub.keyIsBase64)
 }
 
+// SetKeepalive configures how the server detects connections that have silently
+// died. A websocket ping is sent to each client every pingInterval, and a client
+// that sends nothing, not even a pong, for the timeout is disconnected.
+// The default is a ping every 30 seconds with a timeout of 60 seconds.
+// A pingInterval of zero disables pings and read timeouts.
+func (zh *Handler) SetKeepalive(pingInterval, timeout time.Duration) {
+	zh.hub.pingInterval = pingInterval
+	zh.hub.pongTimeout = timeout
+}
+
+// SetWriteTimeout sets the maximum time allowed to write a message to a client
+// before it is disconnected. The default is 10 seconds. Zero disables the timeout.
+func (zh *Handler) SetWriteTimeout(timeout time.Duration) {
+	zh.hub.writeTimeout = timeout
+}
+
+// SetHubShards sets the number of goroutines that relay messages between the
+// clients of a document. Documents are divided among them, so that a busy
+// document does not delay the others. The default is GOMAXPROCS. It must be
+// called before the handler serves any connections, and fails afterwards.
+func (zh *Handler) SetHubShards(count int) error {
+	return zh.hub.setShards(count)
+}
+
 // SetSwarmURLs sets the urls of other servers in the swarm.
 func (zh *Handler) SetSwarmURLs(urls []string) {
 	zh.hub.swarm.SetUrls(urls)
@@ -208,14 +310,16 @@ func (zh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if !strings.Contains(upgradeHeader, "websocket") {
 		var handled bool
-		RecoverErrors(CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recoverErrors(zh.log, CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			handled = zh.serveMAPI(w, r)
 		})))(w, r)
 
 		// if the request has a parameter "ping" then call the health check of the database
 		// and if successful, return the 200 response. Otherwise, return 500.
-		if !handled && r.Method == "GET" && r.URL.Query().Has("ping") {
-			if err := zh.db.CheckHealth(); err != nil {
+		if !handled && r.Method == "GET" && r.URL.Query().Has("metrics") {
+			zh.MetricsHandler().ServeHTTP(w, r)
+		} else if !handled && r.Method == "GET" && r.URL.Query().Has("ping") {
+			if err := zh.db.CheckHealthContext(r.Context()); err != nil {
 				http.Error(w, "Database health check failed", http.StatusInternalServerError)
 				return
 			}
@@ -228,21 +332,31 @@ func (zh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Got a connection\n")
+	zh.mutex.Lock()
+	if zh.shuttingDown {
+		zh.mutex.Unlock()
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	zh.connections.Add(1)
+	zh.mutex.Unlock()
+	defer zh.connections.Done()
+
+	zh.log.debug("got a connection", field("remote", r.RemoteAddr))
 	upgrader := globalUpgrader // copy
 
 	// compression not supported on Windows Server 2016.
 	if runtime.GOOS == "windows" || compression == "0" || !zh.allowCompression {
-		log.Printf("Disabling socket compression")
+		zh.log.debug("disabling socket compression")
 		upgrader.EnableCompression = false
 	}
 
 	// Upgrade initial GET request to a websocket
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		zh.log.warn("websocket upgrade failed", field(fieldError, err))
 		return
 	}
 
-	runClient(zh.hub, zh.db, ws)
+	runClient(zh.hub.tracer.extract(r), zh.hub, zh.db, ws)
 }
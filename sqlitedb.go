@@ -34,7 +34,71 @@ CREATE TABLE IF NOT EXISTS ZwibblerTokens (
 CREATE INDEX IF NOT EXISTS ZwibblerTokenUserIndex ON ZwibblerTokens(userID);
 `
 
+// Make the types and names of ZwibblerKeys consistent with the other tables.
+// SQLite cannot alter columns, so the table is recreated.
+const sqliteKeysSchema = `
+CREATE TABLE ZwibblerKeysNew (
+	docid TEXT,
+	name TEXT,
+	value TEXT,
+	version INTEGER,
+	UNIQUE(docid, name),
+	FOREIGN KEY (docid) REFERENCES ZwibblerDocs(docid) ON DELETE CASCADE
+);
+
+INSERT INTO ZwibblerKeysNew (docid, name, value, version)
+	SELECT docID, name, value, version FROM ZwibblerKeys;
+
+DROP TABLE ZwibblerKeys;
+
+ALTER TABLE ZwibblerKeysNew RENAME TO ZwibblerKeys;
+`
+
+// Record who created and changed each document. The length is not stored.
+const sqliteInfoSchema = `
+ALTER TABLE ZwibblerDocs ADD COLUMN created INTEGER;
+ALTER TABLE ZwibblerDocs ADD COLUMN creator TEXT;
+ALTER TABLE ZwibblerDocs ADD COLUMN modified INTEGER;
+ALTER TABLE ZwibblerDocs ADD COLUMN lastWriter TEXT;
+ALTER TABLE ZwibblerDocs ADD COLUMN appends INTEGER
+`
+
+var sqliteMigrations = []sqlMigration{
+	{"initial schema", sqliteSchema},
+	{"consistent key column names and types", sqliteKeysSchema},
+	{"document information", sqliteInfoSchema},
+}
+
+// SQLiteOptions configures a SQLite database.
+type SQLiteOptions struct {
+	SQLOptions
+
+	// The name of the database file. It is created if it does not exist.
+	Filename string
+
+	// The data source name, including any options for the driver. If it is
+	// set, Filename is ignored.
+	DSN string
+}
+
 // NewSQLITEDB creates a new document storage based on SQLITE
 func NewSQLITEDB(filename string) DocumentDB {
-	return NewSQLXConnection("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&mode=rwc&_journal_mode=WAL&cache=shared", filename), sqliteSchema, 1, false)
+	return mustConnect(NewSQLXConnectionWithOptions("sqlite3", sqliteDataSource(filename), SQLOptions{}))
+}
+
+// NewSQLiteDBWithOptions creates a new document storage based on SQLite using
+// the given options.
+func NewSQLiteDBWithOptions(options SQLiteOptions) (*SQLxDocumentDB, error) {
+	dsn := options.DSN
+	if dsn == "" {
+		dsn = sqliteDataSource(options.Filename)
+	}
+	return NewSQLXConnectionWithOptions("sqlite3", dsn, options.SQLOptions)
+}
+func sqliteDataSource(filename string) string {
+	// foreign keys must be enabled on each connection, not in the schema.
+	// Transactions take the write lock when they begin, so that with more than
+	// one connection, a transaction that reads and then writes waits for other
+	// writers instead of failing.
+	return fmt.Sprintf("file:%s?_busy_timeout=5000&mode=rwc&_journal_mode=WAL&_foreign_keys=on&_txlock=immediate", filename)
 }
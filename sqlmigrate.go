@@ -0,0 +1,129 @@
+package zwibserve
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqlMigration changes the schema of a SQL database from one version to the
+// next. The version of a migration is its position in the list, starting at 1.
+type sqlMigration struct {
+	description string
+
+	// statements separated by semicolons. It may be empty if the change is not
+	// needed for this database.
+	statements string
+}
+
+// ErrSchemaTooNew is returned when the database has been migrated by a newer
+// version of the server, and SQLOptions.RefuseNewerSchema is set.
+var ErrSchemaTooNew = fmt.Errorf("database schema is newer than this server supports")
+
+const schemaVersionTable = `
+CREATE TABLE IF NOT EXISTS ZwibblerSchemaVersion (
+	version INTEGER PRIMARY KEY,
+	description VARCHAR(255),
+	applied BIGINT
+)`
+
+// migrationsForDriver returns the migrations of the built-in databases.
+func migrationsForDriver(driverName string) []sqlMigration {
+	switch driverName {
+	case "sqlite3":
+		return sqliteMigrations
+	case "postgres":
+		return postgresqlMigrations
+	case "mysql":
+		return mariadbMigrations
+	}
+	return nil
+}
+
+// schemaVersion returns the version of the last migration applied to the database.
+func (db *SQLxDocumentDB) schemaVersion() (int, error) {
+	var version int
+	err := db.conn.Get(&version, db.query("SELECT COALESCE(MAX(version), 0) FROM ZwibblerSchemaVersion"))
+	return version, err
+}
+
+// migrate brings the schema of the database up to date, applying each migration
+// that has not been applied in its own transaction.
+func (db *SQLxDocumentDB) migrate(migrations []sqlMigration, refuseNewer bool) error {
+	if _, err := db.conn.Exec(db.query(schemaVersionTable)); err != nil {
+		return err
+	}
+
+	current, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latest := len(migrations)
+	if current > latest {
+		if refuseNewer {
+			return fmt.Errorf("%w: database is version %d, server supports %d", ErrSchemaTooNew, current, latest)
+		}
+		db.log.warn("database schema is newer than this server", field("version", current), field("supported", latest))
+		return nil
+	}
+
+	for version := current + 1; version <= latest; version++ {
+		migration := migrations[version-1]
+		db.log.info("migrating database schema", field("version", version), field("description", migration.description))
+		err := db.applyMigration(version, migration)
+		if err != nil {
+			// If another server applied it at the same time, carry on.
+			if applied, verr := db.schemaVersion(); verr == nil && applied >= version {
+				continue
+			}
+			return fmt.Errorf("schema migration %d (%s): %w", version, migration.description, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs the statements of the migration and records its version.
+// MySQL commits each change to a table immediately, so if a migration fails
+// part way it cannot be rolled back. When it is applied again, columns that
+// were already added are skipped.
+func (db *SQLxDocumentDB) applyMigration(version int, migration sqlMigration) error {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range strings.Split(migration.statements, ";") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		if _, err = tx.Exec(db.query(statement)); err != nil {
+			if isAddColumn(statement) && isDuplicateColumn(err) {
+				db.log.info("column already exists", field("version", version), field(fieldError, err))
+				continue
+			}
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(db.query("INSERT INTO ZwibblerSchemaVersion (version, description, applied) VALUES (?, ?, ?)"),
+		version, migration.description, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func isAddColumn(statement string) bool {
+	return strings.Contains(strings.ToUpper(statement), " ADD COLUMN ")
+}
+
+// isDuplicateColumn returns true for the error of MySQL and SQLite when a
+// column is added twice. PostgreSQL rolls back the whole migration instead.
+func isDuplicateColumn(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "duplicate column")
+}
@@ -0,0 +1,144 @@
+package zwibserve
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// openUnmigrated connects to a SQLite database without migrating it.
+func openUnmigrated(t *testing.T, filename string) *SQLxDocumentDB {
+	t.Helper()
+	conn, err := sqlx.Connect("sqlite3", sqliteDataSource(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	db := newSQLxDocumentDB(conn, "sqlite3")
+	db.SetLogger(NewStdLogger(LogError))
+	return db
+}
+
+func mustSchemaVersion(t *testing.T, db *SQLxDocumentDB) int {
+	t.Helper()
+	version, err := db.schemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrateOldSchema(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.db")
+	old := openUnmigrated(t, filename)
+	if err := old.migrate(sqliteMigrations[:1], false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.conn.Exec("INSERT INTO ZwibblerDocs (docid, lastAccess, data) VALUES ('doc', 0, 'abc')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.conn.Exec("INSERT INTO ZwibblerKeys (docid, name, value, version) VALUES ('doc', 'name', 'value', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	old.conn.Close()
+
+	db, err := NewSQLiteDBWithOptions(SQLiteOptions{Filename: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if version := mustSchemaVersion(t, db); version != len(sqliteMigrations) {
+		t.Errorf("schema version is %d, want %d", version, len(sqliteMigrations))
+	}
+	if !db.hasInfo {
+		t.Error("the document information columns were not added")
+	}
+	if got := mustGetDocument(t, db, "doc"); got != "abc" {
+		t.Errorf("document is %q", got)
+	}
+	keys, err := db.GetDocumentKeys("doc")
+	if err != nil || len(keys) != 1 || keys[0] != (Key{1, "name", "value"}) {
+		t.Errorf("keys are %v, %v", keys, err)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.db")
+	db, err := NewSQLiteDBWithOptions(SQLiteOptions{Filename: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a newer server has added a migration.
+	newer := len(sqliteMigrations) + 1
+	if _, err := db.conn.Exec("INSERT INTO ZwibblerSchemaVersion (version, description, applied) VALUES (?, 'future', 0)", newer); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = NewSQLiteDBWithOptions(SQLiteOptions{
+		SQLOptions: SQLOptions{RefuseNewerSchema: true},
+		Filename:   filename,
+	})
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("with RefuseNewerSchema, got error %v, want ErrSchemaTooNew", err)
+	}
+
+	db, err = NewSQLiteDBWithOptions(SQLiteOptions{Filename: filename})
+	if err != nil {
+		t.Fatalf("without RefuseNewerSchema: %v", err)
+	}
+	defer db.Close()
+	if version := mustSchemaVersion(t, db); version != newer {
+		t.Errorf("schema version is %d, want %d", version, newer)
+	}
+}
+
+func TestMigrationFailure(t *testing.T) {
+	db := openUnmigrated(t, filepath.Join(tempDir(t), "test.db"))
+	if err := db.migrate(sqliteMigrations, false); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := append(append([]sqlMigration{}, sqliteMigrations...), sqlMigration{"broken", `
+ALTER TABLE ZwibblerDocs ADD COLUMN extra INTEGER;
+NOT A STATEMENT`})
+	if err := db.migrate(migrations, false); err == nil {
+		t.Fatal("broken migration succeeded")
+	}
+
+	if version := mustSchemaVersion(t, db); version != len(sqliteMigrations) {
+		t.Errorf("schema version is %d after a failed migration, want %d", version, len(sqliteMigrations))
+	}
+	if _, err := db.conn.Exec("SELECT extra FROM ZwibblerDocs"); err == nil {
+		t.Error("the failed migration was not rolled back")
+	}
+}
+
+// TestMigrationPartlyApplied checks that a migration which added some of its
+// columns before failing, as happens in MySQL, can be applied again.
+func TestMigrationPartlyApplied(t *testing.T) {
+	db := openUnmigrated(t, filepath.Join(tempDir(t), "test.db"))
+	if err := db.migrate(sqliteMigrations, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.conn.Exec("ALTER TABLE ZwibblerDocs ADD COLUMN first INTEGER"); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := append(append([]sqlMigration{}, sqliteMigrations...), sqlMigration{"two columns", `
+ALTER TABLE ZwibblerDocs ADD COLUMN first INTEGER;
+ALTER TABLE ZwibblerDocs ADD COLUMN second INTEGER`})
+	if err := db.migrate(migrations, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if version := mustSchemaVersion(t, db); version != len(migrations) {
+		t.Errorf("schema version is %d, want %d", version, len(migrations))
+	}
+	if _, err := db.conn.Exec("SELECT first, second FROM ZwibblerDocs"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,419 @@
+package zwibserve
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// In chunked storage, the contents of each document are stored as a series of rows
+// in ZwibblerChunks, so that appending does not rewrite the entire document.
+// The data column of ZwibblerDocs is left empty.
+var chunkSchemas = map[string]string{
+	"sqlite3": `
+CREATE TABLE IF NOT EXISTS ZwibblerChunks (
+	docid TEXT,
+	chunkOffset INTEGER,
+	data BLOB,
+	PRIMARY KEY (docid, chunkOffset)
+);`,
+	"postgres": `
+CREATE TABLE IF NOT EXISTS ZwibblerChunks (
+	docid TEXT,
+	chunkOffset BIGINT,
+	data BYTEA,
+	PRIMARY KEY (docid, chunkOffset)
+);`,
+	"mysql": `
+CREATE TABLE IF NOT EXISTS ZwibblerChunks (
+    docid VARCHAR(255),
+    chunkOffset BIGINT,
+    data LONGBLOB,
+    PRIMARY KEY (docid, chunkOffset)
+);`,
+}
+
+// Chunks smaller than this are merged together by the compactor.
+const compactChunkSize = 256 * 1024
+
+// A document is compacted when it has more than this many chunks.
+const compactMinChunks = 16
+
+// How often the compactor runs
+const compactInterval = 10 * time.Minute
+
+// When the migration to chunked storage has finished, a row with this version
+// is added to ZwibblerSchemaVersion. It is negative so that it is not taken
+// for the version of the schema.
+const chunkedStorageVersion = -1
+
+// EnableChunkedStorage converts the database to store documents as a series
+// of appended chunks, instead of a single value that is rewritten on every
+// change. Existing documents are migrated. The conversion is permanent, and
+// is detected automatically the next time the database is opened. If it is
+// interrupted, it is finished then. Other operations wait until it is done.
+//
+// Deprecated: Set ChunkedStorage in SQLOptions instead, so that the database
+// is converted before it is used.
+func (db *SQLxDocumentDB) EnableChunkedStorage() error {
+	db.modeMutex.Lock()
+	defer db.modeMutex.Unlock()
+	if db.chunked {
+		return nil
+	}
+
+	if err := db.createChunkTable(); err != nil {
+		return err
+	}
+	return db.finishChunkedStorage()
+}
+
+// createChunkTable creates the chunk table, if it does not exist.
+func (db *SQLxDocumentDB) createChunkTable() error {
+	schema, ok := chunkSchemas[db.driverName]
+	if !ok {
+		return errUnsupportedDriver(db.driverName)
+	}
+
+	_, err := db.conn.Exec(db.query(schema))
+	return err
+}
+
+// finishChunkedStorage migrates the documents that are not yet in the chunk
+// table, unless that has been recorded as done, and starts using it. It is
+// called before the database is used, or with modeMutex held.
+func (db *SQLxDocumentDB) finishChunkedStorage() error {
+	done, err := db.chunkMigrationDone()
+	if err != nil {
+		return err
+	}
+
+	if !done {
+		if err := db.migrateToChunks(); err != nil {
+			return err
+		}
+		_, err := db.conn.Exec(db.query("INSERT INTO ZwibblerSchemaVersion (version, description, applied) VALUES (?, ?, ?)"),
+			chunkedStorageVersion, "chunked storage", time.Now().Unix())
+		if err != nil {
+			// Another server may have finished at the same time.
+			if done, derr := db.chunkMigrationDone(); derr != nil || !done {
+				return err
+			}
+		}
+	}
+
+	db.chunked = true
+	go db.compactThread()
+	return nil
+}
+
+// chunkMigrationDone returns true if the migration to chunked storage has
+// been recorded as finished.
+func (db *SQLxDocumentDB) chunkMigrationDone() (bool, error) {
+	// A schema given to NewSQLXConnection does not have the version table.
+	if _, err := db.conn.Exec(db.query(schemaVersionTable)); err != nil {
+		return false, err
+	}
+
+	var count int
+	err := db.conn.Get(&count, db.query("SELECT COUNT(*) FROM ZwibblerSchemaVersion WHERE version=?"), chunkedStorageVersion)
+	return count > 0, err
+}
+
+type errUnsupportedDriver string
+
+func (e errUnsupportedDriver) Error() string {
+	return "chunked storage is not supported by driver " + string(e)
+}
+
+// hasChunkTable returns true if a previous call to EnableChunkedStorage created
+// the chunk table.
+func (db *SQLxDocumentDB) hasChunkTable() bool {
+	rows, err := db.conn.Query(db.query("SELECT 1 FROM ZwibblerChunks WHERE 1=0"))
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// migrateToChunks moves the contents of each document into the chunk table.
+func (db *SQLxDocumentDB) migrateToChunks() error {
+	var docIDs []string
+	err := db.conn.Select(&docIDs, db.query("SELECT docid FROM ZwibblerDocs WHERE LENGTH(data) > 0"))
+	if err != nil {
+		return err
+	}
+
+	for _, docID := range docIDs {
+		tx, err := db.conn.Beginx()
+		if err != nil {
+			return err
+		}
+
+		var data []byte
+		err = tx.Get(&data, db.query("SELECT data FROM ZwibblerDocs WHERE docid=?"), docID)
+		if err == nil && len(data) > 0 {
+			_, err = tx.Exec(db.query("INSERT INTO ZwibblerChunks (docid, chunkOffset, data) VALUES (?, ?, ?)"),
+				docID, 0, data)
+		}
+		if err == nil {
+			_, err = tx.Exec(db.query("UPDATE ZwibblerDocs SET data=? WHERE docid=?"), []byte{}, docID)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	if len(docIDs) > 0 {
+		db.log.info("migrated documents to chunked storage", field("documents", len(docIDs)))
+	}
+	return nil
+}
+
+// chunkedLength returns the length of a document in chunked storage.
+func (db *SQLxDocumentDB) chunkedLength(ctx context.Context, q sqlx.QueryerContext, docID string) (uint64, error) {
+	rows, err := q.QueryContext(ctx, db.query("SELECT chunkOffset, LENGTH(data) FROM ZwibblerChunks WHERE docid=? ORDER BY chunkOffset DESC LIMIT 1"), docID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var offset, length uint64
+	if rows.Next() {
+		if err = rows.Scan(&offset, &length); err != nil {
+			return 0, err
+		}
+	}
+	return offset + length, rows.Err()
+}
+
+// readChunks returns the contents of a document in chunked storage.
+func (db *SQLxDocumentDB) readChunks(ctx context.Context, q sqlx.QueryerContext, docID string) ([]byte, error) {
+	rows, err := q.QueryContext(ctx, db.query("SELECT data FROM ZwibblerChunks WHERE docid=? ORDER BY chunkOffset"), docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	doc := []byte{}
+	for rows.Next() {
+		var chunk []byte
+		if err = rows.Scan(&chunk); err != nil {
+			return nil, err
+		}
+		doc = append(doc, chunk...)
+	}
+	return doc, rows.Err()
+}
+
+func (db *SQLxDocumentDB) getChunkedDocument(ctx context.Context, docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	var doc []byte
+	created := false
+	err := db.inTx(ctx, func(tx *sqlx.Tx) error {
+		var count int
+		if err := tx.GetContext(ctx, &count, db.query("SELECT COUNT(*) FROM ZwibblerDocs WHERE docid=?"), docID); err != nil {
+			return err
+		}
+
+		exists := count > 0
+		if !exists && mode == NeverCreate {
+			return ErrMissing
+		} else if exists && mode == AlwaysCreate {
+			return ErrExists
+		}
+
+		if !exists {
+			doc = initialData
+			created = true
+			return db.insertChunkedDocument(ctx, tx, docID, initialData, UserIDFromContext(ctx))
+		}
+
+		_, err := tx.ExecContext(ctx, db.query("UPDATE ZwibblerDocs set lastAccess=? WHERE docid=?"), time.Now().Unix(), docID)
+		if err != nil {
+			return err
+		}
+		doc, err = db.readChunks(ctx, tx, docID)
+		return err
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+	return doc, created, nil
+}
+
+func (db *SQLxDocumentDB) insertChunkedDocument(ctx context.Context, tx *sqlx.Tx, docID string, contents []byte, creator string) error {
+	err := db.insertDocument(ctx, tx, docID, []byte{}, creator)
+	if err == nil && len(contents) > 0 {
+		_, err = tx.ExecContext(ctx, db.query("INSERT INTO ZwibblerChunks (docid, chunkOffset, data) VALUES (?, ?, ?)"),
+			docID, 0, contents)
+	}
+	return err
+}
+
+func (db *SQLxDocumentDB) appendChunkedDocument(ctx context.Context, docID string, oldLength uint64, newData []byte) (uint64, error) {
+	tx, err := db.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	if err := tx.GetContext(ctx, &count, db.query("SELECT COUNT(*) FROM ZwibblerDocs WHERE docid=?"), docID); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if count == 0 {
+		tx.Rollback()
+		return 0, ErrMissing
+	}
+
+	length, err := db.chunkedLength(ctx, tx, docID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if length != oldLength {
+		tx.Rollback()
+		return length, ErrConflict
+	}
+
+	// If another server appends at the same time, the primary key prevents
+	// both chunks from being inserted. Empty appends only touch the document.
+	if len(newData) > 0 {
+		_, err = tx.ExecContext(ctx, db.query("INSERT INTO ZwibblerChunks (docid, chunkOffset, data) VALUES (?, ?, ?)"),
+			docID, oldLength, newData)
+	}
+	if err != nil {
+		tx.Rollback()
+		if isUniqueViolation(err) {
+			length, err = db.chunkedLength(ctx, db.conn, docID)
+			if err != nil {
+				return 0, err
+			}
+			return length, ErrConflict
+		}
+		return 0, err
+	}
+
+	columns, args := db.appendColumns(ctx, newData)
+	_, err = tx.ExecContext(ctx, db.query("UPDATE ZwibblerDocs SET "+columns+" WHERE docid=?"), append(args, docID)...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return oldLength + uint64(len(newData)), nil
+}
+
+func isUniqueViolation(err error) bool {
+	text := strings.ToLower(err.Error())
+	return strings.Contains(text, "unique") || strings.Contains(text, "duplicate")
+}
+
+// compactThread periodically merges small chunks until the database is closed.
+func (db *SQLxDocumentDB) compactThread() {
+	for {
+		select {
+		case <-time.After(compactInterval):
+		case <-db.stop:
+			return
+		}
+
+		if err := db.compact(); err != nil {
+			db.log.error("cannot compact chunks", field(fieldError, err))
+		}
+	}
+}
+
+// compact merges the small chunks of documents that have many of them.
+func (db *SQLxDocumentDB) compact() error {
+	var docIDs []string
+	err := db.conn.Select(&docIDs, db.query("SELECT docid FROM ZwibblerChunks GROUP BY docid HAVING COUNT(*) > ? LIMIT 1000"),
+		compactMinChunks)
+	if err != nil {
+		return err
+	}
+
+	for _, docID := range docIDs {
+		if err := db.compactDocument(docID); err != nil {
+			return err
+		}
+	}
+
+	if len(docIDs) > 0 {
+		db.log.debug("compacted chunks", field("documents", len(docIDs)))
+	}
+	return nil
+}
+
+type chunkInfo struct {
+	Offset uint64 `db:"chunkOffset"`
+	Length uint64 `db:"length"`
+}
+
+// compactDocument merges each run of small chunks of the document into one.
+// If anything fails, none of the chunks are changed.
+func (db *SQLxDocumentDB) compactDocument(docID string) error {
+	ctx := context.Background()
+	return db.inTx(ctx, func(tx *sqlx.Tx) error {
+		var chunks []chunkInfo
+		err := tx.SelectContext(ctx, &chunks, db.query("SELECT chunkOffset, LENGTH(data) AS length FROM ZwibblerChunks WHERE docid=? ORDER BY chunkOffset"), docID)
+		if err != nil {
+			return err
+		}
+
+		merge := func(run []chunkInfo) error {
+			if len(run) < 2 {
+				return nil
+			}
+			first := run[0].Offset
+			last := run[len(run)-1].Offset
+
+			var parts [][]byte
+			err := tx.SelectContext(ctx, &parts, db.query("SELECT data FROM ZwibblerChunks WHERE docid=? AND chunkOffset>=? AND chunkOffset<=? ORDER BY chunkOffset"),
+				docID, first, last)
+			if err != nil {
+				return err
+			}
+
+			var data []byte
+			for _, part := range parts {
+				data = append(data, part...)
+			}
+
+			_, err = tx.ExecContext(ctx, db.query("DELETE FROM ZwibblerChunks WHERE docid=? AND chunkOffset>=? AND chunkOffset<=?"),
+				docID, first, last)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, db.query("INSERT INTO ZwibblerChunks (docid, chunkOffset, data) VALUES (?, ?, ?)"),
+				docID, first, data)
+			return err
+		}
+
+		var run []chunkInfo
+		var size uint64
+		for _, chunk := range chunks {
+			if size+chunk.Length > compactChunkSize {
+				if err := merge(run); err != nil {
+					return err
+				}
+				run = nil
+				size = 0
+			}
+			run = append(run, chunk)
+			size += chunk.Length
+		}
+		return merge(run)
+	})
+}
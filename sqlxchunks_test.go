@@ -0,0 +1,144 @@
+package zwibserve
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChunkedStorageOption(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.db")
+	open := func(chunked bool) *SQLxDocumentDB {
+		db, err := NewSQLiteDBWithOptions(SQLiteOptions{
+			SQLOptions: SQLOptions{ChunkedStorage: chunked},
+			Filename:   filename,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	db := open(false)
+	if _, _, err := db.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AppendDocument("doc", 3, []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = open(true)
+	if !db.chunked {
+		t.Fatal("the database was not converted")
+	}
+	if got := mustGetDocument(t, db, "doc"); got != "abcdef" {
+		t.Errorf("converted document is %q", got)
+	}
+	if _, err := db.AppendDocument("doc", 6, []byte("ghi")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// the conversion is detected without the option.
+	db = open(false)
+	defer db.Close()
+	if !db.chunked {
+		t.Fatal("the conversion was not detected")
+	}
+	if got := mustGetDocument(t, db, "doc"); got != "abcdefghi" {
+		t.Errorf("document is %q", got)
+	}
+}
+
+// TestEnableChunkedStorageWhileAppending converts the database while clients
+// append to its documents, and checks that no append is lost.
+func TestEnableChunkedStorageWhileAppending(t *testing.T) {
+	const docs = 4
+	const writers = 2
+	const appends = 30
+
+	db, err := NewSQLiteDBWithOptions(SQLiteOptions{
+		SQLOptions: SQLOptions{MaxOpenConns: 4},
+		Filename:   filepath.Join(tempDir(t), "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for d := 0; d < docs; d++ {
+		if _, _, err := db.GetDocument(fmt.Sprintf("doc%d", d), AlwaysCreate, []byte("start")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record := func(writer, i int) string {
+		return fmt.Sprintf("[%d:%02d]", writer, i)
+	}
+
+	var wg sync.WaitGroup
+	started := make(chan struct{}, docs*writers)
+	errs := make(chan error, docs*writers)
+	for d := 0; d < docs; d++ {
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(docID string, w int) {
+				defer wg.Done()
+				for i := 0; i < appends; i++ {
+					for {
+						doc, _, err := db.GetDocument(docID, NeverCreate, nil)
+						if err != nil {
+							errs <- err
+							return
+						}
+						_, err = db.AppendDocument(docID, uint64(len(doc)), []byte(record(w, i)))
+						if err == nil {
+							break
+						} else if err != ErrConflict {
+							errs <- err
+							return
+						}
+					}
+					if i == appends/4 {
+						started <- struct{}{}
+					}
+				}
+			}(fmt.Sprintf("doc%d", d), w)
+		}
+	}
+
+	<-started
+	if err := db.EnableChunkedStorage(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for d := 0; d < docs; d++ {
+		doc := mustGetDocument(t, db, fmt.Sprintf("doc%d", d))
+		if !strings.HasPrefix(doc, "start") {
+			t.Fatalf("doc%d is %q", d, doc)
+		}
+		for w := 0; w < writers; w++ {
+			var expected strings.Builder
+			for i := 0; i < appends; i++ {
+				expected.WriteString(record(w, i))
+			}
+			var got strings.Builder
+			for offset := len("start"); offset < len(doc); offset += len(record(0, 0)) {
+				if r := doc[offset : offset+len(record(0, 0))]; strings.HasPrefix(r, fmt.Sprintf("[%d:", w)) {
+					got.WriteString(r)
+				}
+			}
+			if got.String() != expected.String() {
+				t.Errorf("doc%d has appends %q from writer %d, want %q", d, got.String(), w, expected.String())
+			}
+		}
+	}
+}
@@ -1,30 +1,91 @@
 package zwibserve
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 type SQLxDocumentDB struct {
+	cleanMutex sync.Mutex
 	lastClean  time.Time
+	sweeping   int32
+	sweeps     sync.WaitGroup
+
 	conn       *sqlx.DB
 	expiration int64
-}
+	driverName string
+	log        *logger
 
-var shouldRebind = false
+	// queries use $1 instead of ?
+	rebind bool
 
-func rebindQuery(query string) string {
-	if shouldRebind {
-		return sqlx.Rebind(sqlx.DOLLAR, query)
-	}
-	return query
+	// added to the name of each table
+	tablePrefix string
+
+	// maximum time for each operation, or 0
+	statementTimeout time.Duration
+
+	// documents are stored in ZwibblerChunks. Operations hold modeMutex for
+	// reading, so that EnableChunkedStorage can change it while in use.
+	chunked   bool
+	modeMutex sync.RWMutex
+
+	// ZwibblerDocs has the columns of DocumentInfo
+	hasInfo bool
+
+	// expired documents are stored here, or nil
+	archive Archive
+
+	// closed to stop the compactor
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// SQLOptions configures a connection to a SQL database.
+type SQLOptions struct {
+	// If true, the connection fails with ErrSchemaTooNew when the database has been
+	// migrated by a newer version of the server. Otherwise, a warning is logged
+	// and the server continues.
+	RefuseNewerSchema bool
+
+	// Maximum number of open connections. The default is 1.
+	MaxOpenConns int
+
+	// Maximum number of idle connections. The default is that of database/sql.
+	MaxIdleConns int
+
+	// Connections are closed after this amount of time. The default is to reuse
+	// them forever.
+	ConnMaxLifetime time.Duration
+
+	// Each database operation is cancelled if it takes longer than this. The
+	// default is no limit.
+	StatementTimeout time.Duration
+
+	// This is added to the name of each table, to share a database with
+	// another application. It may contain only letters, digits and underscores.
+	TablePrefix string
+
+	// If true, documents are stored as a series of appended chunks, instead of
+	// a single value that is rewritten on every change. Existing documents are
+	// converted when connecting. The conversion is permanent, and is detected
+	// automatically the next time the database is opened. All servers sharing
+	// the database must be converted before they serve clients.
+	ChunkedStorage bool
 }
 
+// NewSQLXConnection connects to a SQL database and executes the schema. Use
+// NewSQLXConnectionWithOptions instead for the built-in databases, so that the
+// schema is kept up to date.
 func NewSQLXConnection(driverName, dataSourceName string, schema string, maxOpenConnections int, rebind bool) DocumentDB {
-	shouldRebind = rebind
 	sqldb, err := sqlx.Connect(driverName, dataSourceName)
 
 	if err != nil {
@@ -35,233 +96,794 @@ func NewSQLXConnection(driverName, dataSourceName string, schema string, maxOpen
 
 	sqldb.MustExec(schema)
 
-	db := &SQLxDocumentDB{
-		conn: sqldb,
+	db := newSQLxDocumentDB(sqldb, driverName)
+	db.rebind = rebind
+	if err = db.start(); err != nil {
+		log.Panic(err)
 	}
+	return db
+}
 
-	db.clean()
+// NewSQLXConnectionWithOptions connects to one of the built-in SQL databases,
+// which are "sqlite3", "postgres", and "mysql" (for MySQL and MariaDB). The
+// schema is created, or migrated to the current version.
+func NewSQLXConnectionWithOptions(driverName, dataSourceName string, options SQLOptions) (*SQLxDocumentDB, error) {
+	migrations := migrationsForDriver(driverName)
+	if migrations == nil {
+		return nil, fmt.Errorf("unsupported database driver %s", driverName)
+	}
+
+	if !validTablePrefix(options.TablePrefix) {
+		return nil, fmt.Errorf("invalid table prefix %q", options.TablePrefix)
+	}
+
+	sqldb, err := sqlx.Connect(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	maxOpen := options.MaxOpenConns
+	if maxOpen == 0 {
+		maxOpen = 1
+	}
+	sqldb.SetMaxOpenConns(maxOpen)
+	if options.MaxIdleConns != 0 {
+		sqldb.SetMaxIdleConns(options.MaxIdleConns)
+	}
+	sqldb.SetConnMaxLifetime(options.ConnMaxLifetime)
+
+	db := newSQLxDocumentDB(sqldb, driverName)
+	db.rebind = driverName == "postgres"
+	db.tablePrefix = options.TablePrefix
+	db.statementTimeout = options.StatementTimeout
+	if err = db.migrate(migrations, options.RefuseNewerSchema); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+
+	if options.ChunkedStorage {
+		// start finishes the conversion when it finds the chunk table.
+		if err = db.createChunkTable(); err != nil {
+			sqldb.Close()
+			return nil, err
+		}
+	}
+
+	if err = db.start(); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func validTablePrefix(prefix string) bool {
+	for _, ch := range prefix {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// query adds the table prefix to the table names in the query, and changes
+// its placeholders to those of the database.
+func (db *SQLxDocumentDB) query(query string) string {
+	if db.tablePrefix != "" {
+		query = strings.Replace(query, "Zwibbler", db.tablePrefix+"Zwibbler", -1)
+	}
+	if db.rebind {
+		return sqlx.Rebind(sqlx.DOLLAR, query)
+	}
+	return query
+}
+
+// withTimeout limits the time of an operation to the statement timeout.
+func (db *SQLxDocumentDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.statementTimeout > 0 {
+		return context.WithTimeout(ctx, db.statementTimeout)
+	}
+	return ctx, func() {}
+}
+
+// mustConnect panics if the connection failed.
+func mustConnect(db *SQLxDocumentDB, err error) DocumentDB {
+	if err != nil {
+		log.Panic(err)
+	}
 	return db
 }
 
+func newSQLxDocumentDB(conn *sqlx.DB, driverName string) *SQLxDocumentDB {
+	return &SQLxDocumentDB{
+		conn:       conn,
+		driverName: driverName,
+		log:        newLogger(nil),
+		stop:       make(chan struct{}),
+	}
+}
+
+// start prepares the database for use, once the schema is in place. If a
+// migration to chunked storage was interrupted, it is finished first.
+func (db *SQLxDocumentDB) start() error {
+	db.hasInfo = db.hasInfoColumns()
+	if db.hasChunkTable() {
+		if err := db.finishChunkedStorage(); err != nil {
+			return err
+		}
+	}
+
+	db.clean()
+	return nil
+}
+
+// SetLogger sets the destination of log messages.
+func (db *SQLxDocumentDB) SetLogger(l Logger) {
+	db.log.setOutput(l)
+}
+
+// Close stops any expiration sweep and closes the database connections.
+// Calling it again has no effect.
+func (db *SQLxDocumentDB) Close() error {
+	var err error
+	db.closeOnce.Do(func() {
+		close(db.stop)
+		db.sweeps.Wait()
+		err = db.conn.Close()
+	})
+	return err
+}
+
+// SetArchive sets where documents are stored before they expire.
+func (db *SQLxDocumentDB) SetArchive(archive Archive) {
+	db.archive = archive
+}
+
 // SetExpiration ...
 func (db *SQLxDocumentDB) SetExpiration(seconds int64) {
-	log.Printf("SetExpiration")
+	db.log.debug("SetExpiration", field("seconds", seconds))
 	db.expiration = seconds
+	db.cleanMutex.Lock()
+	db.lastClean = time.Time{}
+	db.cleanMutex.Unlock()
 }
 
 func (db *SQLxDocumentDB) CheckHealth() error {
-	log.Printf("CheckHealth")
-	tx := db.conn.MustBegin()
-	return tx.Commit()
+	return db.CheckHealthContext(context.Background())
+}
+
+// CheckHealthContext ...
+func (db *SQLxDocumentDB) CheckHealthContext(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	db.log.debug("CheckHealth")
+	return db.conn.PingContext(ctx)
 }
 
+// inTx runs fn in a transaction. The transaction is committed unless fn returns
+// an unexpected error.
+func (db *SQLxDocumentDB) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil && err != ErrMissing && err != ErrConflict && err != ErrExists {
+		tx.Rollback()
+		return err
+	}
+
+	if cerr := tx.Commit(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// clean starts a sweep for expired documents and tokens, at most once an hour.
+// It runs in the background, so that it is not limited by the timeout of the
+// operation which started it.
 func (db *SQLxDocumentDB) clean() {
-	log.Printf("clean")
 	seconds := db.expiration
 	if seconds == 0 || seconds == NoExpiration {
 		return
 	}
 
-	now := time.Now()
-	if time.Since(db.lastClean).Minutes() < 60 {
+	db.cleanMutex.Lock()
+	defer db.cleanMutex.Unlock()
+
+	if time.Since(db.lastClean).Minutes() < 60 || !atomic.CompareAndSwapInt32(&db.sweeping, 0, 1) {
 		return
 	}
+	db.lastClean = time.Now()
+
+	db.sweeps.Add(1)
+	go func() {
+		defer db.sweeps.Done()
+		defer atomic.StoreInt32(&db.sweeping, 0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-db.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		if err := db.sweep(ctx, seconds); err != nil {
+			db.log.error("cannot remove expired documents", field(fieldError, err))
+		}
+	}()
+}
 
-	db.conn.MustExec(rebindQuery("DELETE FROM ZwibblerDocs WHERE lastAccess < ?"), now.Unix()-seconds)
-	db.conn.MustExec(rebindQuery("DELETE FROM ZwibblerTokens WHERE expiration < ?"), now.Unix())
-	db.lastClean = now
+// sweep removes documents that have not been accessed within the expiration
+// time, and expired tokens.
+func (db *SQLxDocumentDB) sweep(ctx context.Context, seconds int64) error {
+	db.modeMutex.RLock()
+	defer db.modeMutex.RUnlock()
+
+	now := time.Now()
+	db.log.debug("remove expired documents and tokens")
+	statements := []string{
+		"DELETE FROM ZwibblerDocs WHERE lastAccess < ?",
+		"DELETE FROM ZwibblerTokens WHERE expiration < ?",
+	}
+	args := []interface{}{now.Unix() - seconds, now.Unix()}
+	if db.archive != nil {
+		// Documents are removed only after they are archived.
+		if err := db.archiveExpired(ctx, now.Unix()-seconds); err != nil {
+			return err
+		}
+		statements, args = statements[1:], args[1:]
+	}
+	if db.chunked {
+		statements = append(statements, "DELETE FROM ZwibblerChunks WHERE docid NOT IN (SELECT docid FROM ZwibblerDocs)")
+	}
+
+	for i, statement := range statements {
+		var err error
+		if i < len(args) {
+			_, err = db.conn.ExecContext(ctx, db.query(statement), args[i])
+		} else {
+			_, err = db.conn.ExecContext(ctx, db.query(statement))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetDocument ...
 func (db *SQLxDocumentDB) GetDocument(docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
-	log.Printf("GetDocument")
+	return db.GetDocumentContext(context.Background(), docID, mode, initialData)
+}
+
+// GetDocumentContext ...
+func (db *SQLxDocumentDB) GetDocumentContext(ctx context.Context, docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	db.log.debug("GetDocument", field(fieldDocument, docID))
 	db.clean()
 
-	tx := db.conn.MustBegin()
-	defer tx.Commit()
+	return getOrRestore(ctx, db.archive, db.log, docID, mode, initialData,
+		func(mode CreateMode, initialData []byte) ([]byte, bool, error) {
+			return db.getDocument(ctx, docID, mode, initialData)
+		}, func(key Key) error {
+			return db.SetDocumentKeyContext(ctx, docID, 0, key)
+		})
+}
 
-	rows, err := tx.Query(rebindQuery("SELECT data FROM ZwibblerDocs WHERE docid=?"), docID)
-	if err != nil {
-		tx.Rollback()
-		log.Panic(err)
+func (db *SQLxDocumentDB) getDocument(ctx context.Context, docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	db.modeMutex.RLock()
+	defer db.modeMutex.RUnlock()
+	if db.chunked {
+		return db.getChunkedDocument(ctx, docID, mode, initialData)
 	}
-	defer rows.Close()
 
-	created := true
 	var doc []byte
-	if rows.Next() {
-		err = rows.Scan(&doc)
+	created := false
+	err := db.inTx(ctx, func(tx *sqlx.Tx) error {
+		rows, err := tx.QueryContext(ctx, db.query("SELECT data FROM ZwibblerDocs WHERE docid=?"), docID)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		created = false
-	}
-	rows.Close() // Necessary for postgresql
+		defer rows.Close()
 
-	if doc == nil && mode == NeverCreate {
-		return nil, false, ErrMissing
-	} else if doc != nil && mode == AlwaysCreate {
-		return nil, false, ErrExists
-	}
+		found := rows.Next()
+		if found {
+			err = rows.Scan(&doc)
+			if err != nil {
+				return err
+			}
+		}
+		rows.Close() // Necessary for postgresql
 
-	if doc == nil {
-		doc = initialData
-		tx.MustExec(rebindQuery("INSERT INTO ZwibblerDocs (docid, lastAccess, data) VALUES (?, ?, ?)"), docID, time.Now().Unix(), doc)
-	} else {
-		tx.MustExec(rebindQuery("UPDATE ZwibblerDocs set lastAccess=? WHERE docid=?"), time.Now().Unix(), docID)
-	}
+		if !found && mode == NeverCreate {
+			return ErrMissing
+		} else if found && mode == AlwaysCreate {
+			return ErrExists
+		}
 
-	return doc, created, nil
+		if !found {
+			doc = initialData
+			created = true
+			err = db.insertDocument(ctx, tx, docID, doc, UserIDFromContext(ctx))
+		} else {
+			_, err = tx.ExecContext(ctx, db.query("UPDATE ZwibblerDocs set lastAccess=? WHERE docid=?"), time.Now().Unix(), docID)
+		}
+		return err
+	})
 
+	if err != nil {
+		return nil, false, err
+	}
+	return doc, created, nil
 }
 
 // AppendDocument ...
 func (db *SQLxDocumentDB) AppendDocument(docID string, oldLength uint64, newData []byte) (uint64, error) {
-	log.Printf("AppendDocument")
+	return db.AppendDocumentContext(context.Background(), docID, oldLength, newData)
+}
+
+// AppendDocumentContext ...
+func (db *SQLxDocumentDB) AppendDocumentContext(ctx context.Context, docID string, oldLength uint64, newData []byte) (uint64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	db.log.debug("AppendDocument", field(fieldDocument, docID), field("bytes", len(newData)))
 	db.clean()
-	tx := db.conn.MustBegin()
-	defer tx.Commit()
 
-	rows, err := tx.Query(rebindQuery("SELECT data FROM ZwibblerDocs WHERE docid=?"), docID)
-	if err != nil {
-		log.Panic(err)
+	db.modeMutex.RLock()
+	defer db.modeMutex.RUnlock()
+	if db.chunked {
+		return db.appendChunkedDocument(ctx, docID, oldLength, newData)
 	}
-	defer rows.Close()
 
-	var doc []byte
-	if rows.Next() {
-		err = rows.Scan(&doc)
+	if query, ok := atomicAppendQueries[db.driverName]; ok {
+		return db.appendAtomically(ctx, query, docID, oldLength, newData)
+	}
+
+	var length uint64
+	err := db.inTx(ctx, func(tx *sqlx.Tx) error {
+		rows, err := tx.QueryContext(ctx, db.query("SELECT data FROM ZwibblerDocs WHERE docid=?"), docID)
 		if err != nil {
-			log.Panic(err)
+			return err
+		}
+		defer rows.Close()
+
+		var doc []byte
+		found := rows.Next()
+		if found {
+			err = rows.Scan(&doc)
+			if err != nil {
+				return err
+			}
+		}
+		rows.Close() // Necessary for postgresql
+
+		if !found {
+			return ErrMissing
+		}
+
+		length = uint64(len(doc))
+		if length != oldLength {
+			return ErrConflict
 		}
+
+		doc = append(doc, newData...)
+		length = uint64(len(doc))
+		columns, args := db.appendColumns(ctx, newData)
+		args = append([]interface{}{doc}, args...)
+		_, err = tx.ExecContext(ctx, db.query("UPDATE ZwibblerDocs SET data=?, "+columns+" WHERE docid=?"), append(args, docID)...)
+		return err
+	})
+
+	if err != nil && err != ErrConflict {
+		return 0, err
 	}
-	rows.Close() // Necessary for postgresql
+	return length, err
+}
 
-	if doc == nil {
-		return 0, ErrMissing
+// insertDocument adds the row of a new document.
+func (db *SQLxDocumentDB) insertDocument(ctx context.Context, tx *sqlx.Tx, docID string, data []byte, creator string) error {
+	now := time.Now().Unix()
+	if !db.hasInfo {
+		_, err := tx.ExecContext(ctx, db.query("INSERT INTO ZwibblerDocs (docid, lastAccess, data) VALUES (?, ?, ?)"), docID, now, data)
+		return err
+	}
+	_, err := tx.ExecContext(ctx, db.query(`INSERT INTO ZwibblerDocs (docid, lastAccess, data, created, creator, modified, lastWriter, appends)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0)`), docID, now, data, now, creator, now, creator)
+	return err
+}
+
+// appendColumns returns the assignments to make to the row of a document when
+// it is appended to, and their arguments.
+func (db *SQLxDocumentDB) appendColumns(ctx context.Context, newData []byte) (string, []interface{}) {
+	now := time.Now().Unix()
+	if !db.hasInfo || len(newData) == 0 {
+		return "lastAccess=?", []interface{}{now}
+	}
+	return "lastAccess=?, modified=?, lastWriter=?, appends=COALESCE(appends, 0)+1",
+		[]interface{}{now, now, UserIDFromContext(ctx)}
+}
+
+// hasInfoColumns returns true if the migration that adds the columns of
+// DocumentInfo has been applied. A schema given to NewSQLXConnection may not have them.
+func (db *SQLxDocumentDB) hasInfoColumns() bool {
+	rows, err := db.conn.Query(db.query("SELECT appends FROM ZwibblerDocs WHERE 1=0"))
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// GetDocumentInfo ...
+func (db *SQLxDocumentDB) GetDocumentInfo(ctx context.Context, docID string) (DocumentInfo, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	db.modeMutex.RLock()
+	defer db.modeMutex.RUnlock()
+
+	info := DocumentInfo{DocID: docID}
+	var created, modified int64
+	var row *sqlx.Row
+	if db.hasInfo {
+		row = db.conn.QueryRowxContext(ctx, db.query(`SELECT COALESCE(LENGTH(data), 0), COALESCE(created, 0), COALESCE(creator, ''),
+			COALESCE(modified, 0), COALESCE(lastWriter, ''), COALESCE(appends, 0) FROM ZwibblerDocs WHERE docid=?`), docID)
+	} else {
+		row = db.conn.QueryRowxContext(ctx, db.query("SELECT COALESCE(LENGTH(data), 0), 0, '', 0, '', 0 FROM ZwibblerDocs WHERE docid=?"), docID)
+	}
+	err := row.Scan(&info.Length, &created, &info.Creator, &modified, &info.LastWriter, &info.Appends)
+	if err == sql.ErrNoRows {
+		return info, ErrMissing
+	} else if err != nil {
+		return info, err
+	}
+
+	if db.chunked {
+		if info.Length, err = db.chunkedLength(ctx, db.conn, docID); err != nil {
+			return info, err
+		}
+	}
+	if created != 0 {
+		info.Created = time.Unix(created, 0)
+	}
+	if modified != 0 {
+		info.Modified = time.Unix(modified, 0)
+	}
+	return info, nil
+}
+
+// Reading the document and writing it back in a transaction does not prevent
+// two servers from appending at the same length, unless the database locks the
+// row. These databases append in a single statement, which fails if the length
+// has changed. SQLite locks the whole database when writing. The columns to set
+// are added by appendAtomically.
+var atomicAppendQueries = map[string]string{
+	"postgres": "UPDATE ZwibblerDocs SET data=COALESCE(data, ''::bytea) || ?, %s WHERE docid=? AND OCTET_LENGTH(COALESCE(data, ''::bytea))=?",
+	"mysql":    "UPDATE ZwibblerDocs SET data=CONCAT(COALESCE(data, ''), ?), %s WHERE docid=? AND LENGTH(COALESCE(data, ''))=?",
+}
+
+// appendAtomically appends using one of the atomicAppendQueries. If no row was
+// changed, the current length tells whether the document is missing or was changed.
+func (db *SQLxDocumentDB) appendAtomically(ctx context.Context, query, docID string, oldLength uint64, newData []byte) (uint64, error) {
+	columns, args := db.appendColumns(ctx, newData)
+	args = append([]interface{}{newData}, args...)
+	args = append(args, docID, oldLength)
+	result, err := db.conn.ExecContext(ctx, db.query(fmt.Sprintf(query, columns)), args...)
+	if err != nil {
+		return 0, err
 	}
 
-	if uint64(len(doc)) != oldLength {
-		return uint64(len(doc)), ErrConflict
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if changed > 0 {
+		return oldLength + uint64(len(newData)), nil
 	}
 
-	doc = append(doc, newData...)
-	tx.MustExec(rebindQuery("UPDATE ZwibblerDocs SET data=? WHERE docid=?"), doc, docID)
-	tx.MustExec(rebindQuery("UPDATE ZwibblerDocs SET lastAccess=? WHERE docid=?"), time.Now().Unix(), docID)
+	var lengths []uint64
+	err = db.conn.SelectContext(ctx, &lengths, db.query("SELECT LENGTH(COALESCE(data, ?)) FROM ZwibblerDocs WHERE docid=?"), []byte{}, docID)
+	if err != nil {
+		return 0, err
+	} else if len(lengths) == 0 {
+		return 0, ErrMissing
+	} else if lengths[0] != oldLength {
+		return lengths[0], ErrConflict
+	}
 
-	return uint64(len(doc)), nil
+	// MySQL does not count rows that were matched but not changed, as when
+	// appending nothing within the same second.
+	return oldLength + uint64(len(newData)), nil
 }
 
 // GetDocumentKeys ...
 func (db *SQLxDocumentDB) GetDocumentKeys(docID string) ([]Key, error) {
-	log.Printf("GetDocumentKeys")
-	var keys []Key
+	return db.GetDocumentKeysContext(context.Background(), docID)
+}
 
-	tx := db.conn.MustBegin()
-	defer tx.Commit()
+// GetDocumentKeysContext ...
+func (db *SQLxDocumentDB) GetDocumentKeysContext(ctx context.Context, docID string) ([]Key, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	db.log.debug("GetDocumentKeys", field(fieldDocument, docID))
 
-	rows, err := tx.Query(rebindQuery("SELECT name, value, version FROM ZwibblerKeys WHERE docid=?"), docID)
+	rows, err := db.conn.QueryContext(ctx, db.query("SELECT name, value, version FROM ZwibblerKeys WHERE docid=?"), docID)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 	defer rows.Close()
 
+	var keys []Key
 	for rows.Next() {
 		var key Key
 		err = rows.Scan(&key.Name, &key.Value, &key.Version)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 		keys = append(keys, key)
 	}
 
-	return keys, nil
+	return keys, rows.Err()
 }
 
 // SetDocumentKey ...
 func (db *SQLxDocumentDB) SetDocumentKey(docID string, oldVersion int, key Key) error {
-	tx := db.conn.MustBegin()
-	defer tx.Commit()
+	return db.SetDocumentKeyContext(context.Background(), docID, oldVersion, key)
+}
 
-	var dbVersion int
-	exists := false
+// SetDocumentKeyContext ...
+func (db *SQLxDocumentDB) SetDocumentKeyContext(ctx context.Context, docID string, oldVersion int, key Key) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return db.inTx(ctx, func(tx *sqlx.Tx) error {
+		var dbVersion int
+		exists := false
 
-	rows, err := tx.Query(rebindQuery("SELECT version FROM ZwibblerKeys WHERE docid=? AND name=?"), docID, key.Name)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer rows.Close()
-	if rows.Next() {
-		exists = true
-		err = rows.Scan(&dbVersion)
+		rows, err := tx.QueryContext(ctx, db.query("SELECT version FROM ZwibblerKeys WHERE docid=? AND name=?"), docID, key.Name)
 		if err != nil {
-			log.Panic(err)
+			return err
+		}
+		defer rows.Close()
+		if rows.Next() {
+			exists = true
+			err = rows.Scan(&dbVersion)
+			if err != nil {
+				return err
+			}
+		}
+		rows.Close() // Necessary for postgresql
+
+		// if the key exists, and the old version does not match, then fail.
+		if exists && dbVersion != oldVersion {
+			return ErrConflict
+		} else if !exists && oldVersion != 0 {
+			return ErrConflict
+		}
+
+		// if the key exists, perform update. otherwise, perform insert.
+		if exists {
+			_, err = tx.ExecContext(ctx, db.query("UPDATE ZwibblerKeys SET value=?, version=? WHERE docID=? AND name=?"),
+				key.Value, key.Version, docID, key.Name)
+		} else {
+			_, err = tx.ExecContext(ctx, db.query("INSERT INTO ZwibblerKeys(docID, name, value, version) VALUES (?, ?, ?, ?)"),
+				docID, key.Name, key.Value, key.Version)
+		}
+		return err
+	})
+}
+
+func (db *SQLxDocumentDB) DeleteDocument(docID string) error {
+	return db.DeleteDocumentContext(context.Background(), docID)
+}
+
+// DeleteDocumentContext ...
+func (db *SQLxDocumentDB) DeleteDocumentContext(ctx context.Context, docID string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	db.modeMutex.RLock()
+	err := db.inTx(ctx, func(tx *sqlx.Tx) error {
+		// Keys are deleted explicitly, in case foreign keys are not enforced.
+		_, err := tx.ExecContext(ctx, db.query("DELETE FROM ZwibblerKeys WHERE docid=?"), docID)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, db.query("DELETE FROM ZwibblerDocs WHERE docid=?"), docID)
+		}
+		if err == nil && db.chunked {
+			_, err = tx.ExecContext(ctx, db.query("DELETE FROM ZwibblerChunks WHERE docid=?"), docID)
 		}
+		return err
+	})
+	db.modeMutex.RUnlock()
+	if err == nil && db.archive != nil {
+		err = db.archive.DeleteDocument(ctx, docID)
 	}
-	rows.Close() // Necessary for postgresql
+	return err
+}
 
-	// if the key exists, and the old version does not match, then fail.
-	if exists && dbVersion != oldVersion {
-		return ErrConflict
-	} else if !exists && oldVersion != 0 {
-		return ErrConflict
+// ListDocuments ...
+func (db *SQLxDocumentDB) ListDocuments(ctx context.Context, fn func(docID string) error) error {
+	// The documents are read a page at a time, so that fn can use the
+	// connection.
+	after := ""
+	for {
+		var docIDs []string
+		qctx, cancel := db.withTimeout(ctx)
+		err := db.conn.SelectContext(qctx, &docIDs, db.query("SELECT docid FROM ZwibblerDocs WHERE docid > ? ORDER BY docid LIMIT 1000"), after)
+		cancel()
+		if err != nil || len(docIDs) == 0 {
+			return err
+		}
+
+		if err := listEach(ctx, docIDs, fn); err != nil {
+			return err
+		}
+		after = docIDs[len(docIDs)-1]
 	}
+}
 
-	// if the key exists, perform update. otherwise, perform insert.
-	if exists {
-		tx.MustExec(rebindQuery("UPDATE ZwibblerKeys SET value=?, version=? WHERE docID=? AND name=?"),
-			key.Value, key.Version, docID, key.Name)
-	} else {
-		tx.MustExec(rebindQuery( "INSERT INTO ZwibblerKeys(docID, name, value, version) VALUES (?, ?, ?, ?)"),
-			docID, key.Name, key.Value, key.Version)
+// ListTokens ...
+func (db *SQLxDocumentDB) ListTokens(ctx context.Context, fn func(token TokenInfo) error) error {
+	after := ""
+	for {
+		tokens, err := db.tokenPage(ctx, after)
+		if err != nil || len(tokens) == 0 {
+			return err
+		}
+
+		if err := listTokensEach(ctx, tokens, fn); err != nil {
+			return err
+		}
+		after = tokens[len(tokens)-1].Token
 	}
+}
 
-	return nil
+// tokenPage returns the unexpired tokens that follow the given one.
+func (db *SQLxDocumentDB) tokenPage(ctx context.Context, after string) ([]TokenInfo, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.QueryContext(ctx, db.query("SELECT tokenID, docID, userID, permissions, expiration FROM ZwibblerTokens WHERE tokenID > ? AND expiration > ? ORDER BY tokenID LIMIT 1000"),
+		after, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []TokenInfo
+	for rows.Next() {
+		var t TokenInfo
+		if err := rows.Scan(&t.Token, &t.DocID, &t.UserID, &t.Permissions, &t.Expiration); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
 }
 
-func (db *SQLxDocumentDB) DeleteDocument(docID string) error {
-	db.conn.MustExec(rebindQuery("DELETE FROM ZwibblerDocs WHERE docID=?"), docID)
+// archiveExpired stores each document that was last accessed before the
+// cutoff in the archive, and then removes it. Documents that cannot be
+// archived are tried again at the next cleaning.
+func (db *SQLxDocumentDB) archiveExpired(ctx context.Context, cutoff int64) error {
+	var docIDs []string
+	if err := db.conn.SelectContext(ctx, &docIDs, db.query("SELECT docid FROM ZwibblerDocs WHERE lastAccess < ?"), cutoff); err != nil {
+		return err
+	}
+
+	for _, docID := range docIDs {
+		var data []byte
+		var err error
+		if db.chunked {
+			data, err = db.readChunks(ctx, db.conn, docID)
+		} else {
+			err = db.conn.GetContext(ctx, &data, db.query("SELECT data FROM ZwibblerDocs WHERE docid=?"), docID)
+		}
+		if err == sql.ErrNoRows {
+			// deleted since it was listed
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		keys, err := db.GetDocumentKeysContext(ctx, docID)
+		if err != nil {
+			return err
+		}
+
+		if archiveDocument(ctx, db.archive, db.log, docID, data, keys) != nil {
+			continue
+		}
+
+		err = db.inTx(ctx, func(tx *sqlx.Tx) error {
+			// It is not removed if it was accessed since it was archived.
+			result, err := tx.ExecContext(ctx, db.query("DELETE FROM ZwibblerDocs WHERE docid=? AND lastAccess < ?"), docID, cutoff)
+			if err != nil {
+				return err
+			}
+			if n, err := result.RowsAffected(); err != nil || n == 0 {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, db.query("DELETE FROM ZwibblerKeys WHERE docid=?"), docID)
+			if err == nil && db.chunked {
+				_, err = tx.ExecContext(ctx, db.query("DELETE FROM ZwibblerChunks WHERE docid=?"), docID)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // AddToken ...
 func (db *SQLxDocumentDB) AddToken(tokenID, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
-	tx := db.conn.MustBegin()
-	defer tx.Commit()
+	return db.AddTokenContext(context.Background(), tokenID, docID, userID, permissions, expirationSeconds, contents)
+}
+
+// AddTokenContext ...
+func (db *SQLxDocumentDB) AddTokenContext(ctx context.Context, tokenID, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	db.modeMutex.RLock()
+	defer db.modeMutex.RUnlock()
+	tx, err := db.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
 
 	// check if doc exists
 	if len(contents) > 0 {
-		rows, err := tx.Query(rebindQuery("SELECT data FROM ZwibblerDocs WHERE docid=?"), docID)
+		var count int
+		err = tx.GetContext(ctx, &count, db.query("SELECT COUNT(*) FROM ZwibblerDocs WHERE docid=?"), docID)
 		if err != nil {
-			log.Panic(err)
+			tx.Rollback()
+			return err
 		}
-		defer rows.Close()
-		if rows.Next() {
+		if count > 0 {
+			tx.Rollback()
 			return ErrConflict
 		}
 
-		tx.MustExec(rebindQuery("INSERT INTO ZwibblerDocs (docid, lastAccess, data) VALUES (?, ?, ?)"),
-			docID, time.Now().Unix(), contents)
+		if db.chunked {
+			err = db.insertChunkedDocument(ctx, tx, docID, contents, userID)
+		} else {
+			err = db.insertDocument(ctx, tx, docID, contents, userID)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 
-	_, err := tx.Exec(rebindQuery("INSERT INTO ZwibblerTokens(tokenID, docID, userID, permissions, expiration) VALUES (?, ?, ?, ?, ?)"),
+	_, err = tx.ExecContext(ctx, db.query("INSERT INTO ZwibblerTokens(tokenID, docID, userID, permissions, expiration) VALUES (?, ?, ?, ?, ?)"),
 		tokenID, docID, userID, permissions, expirationSeconds)
 
 	if err != nil {
 		tx.Rollback()
-		if strings.Contains(err.Error(), "UNIQUE") {
+		if isUniqueViolation(err) {
 			err = ErrExists
 		}
+		return err
 	}
 
-	return err
+	return tx.Commit()
 }
 
 func (db *SQLxDocumentDB) GetToken(token string) (docID, userID, permissions string, err error) {
-	tx := db.conn.MustBegin()
-	defer tx.Commit()
+	return db.GetTokenContext(context.Background(), token)
+}
+
+// GetTokenContext ...
+func (db *SQLxDocumentDB) GetTokenContext(ctx context.Context, token string) (docID, userID, permissions string, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 	now := time.Now().Unix()
-	rows, err := tx.Query(rebindQuery("SELECT docID, userID, permissions FROM ZwibblerTokens WHERE tokenID=? AND expiration > ?"),
+	rows, err := db.conn.QueryContext(ctx, db.query("SELECT docID, userID, permissions FROM ZwibblerTokens WHERE tokenID=? AND expiration > ?"),
 		token, now)
 	if err != nil {
 		return
@@ -270,7 +892,7 @@ func (db *SQLxDocumentDB) GetToken(token string) (docID, userID, permissions str
 
 	if rows.Next() {
 		err = rows.Scan(&docID, &userID, &permissions)
-	} else {
+	} else if err = rows.Err(); err == nil {
 		err = ErrMissing
 	}
 
@@ -278,8 +900,13 @@ func (db *SQLxDocumentDB) GetToken(token string) (docID, userID, permissions str
 }
 
 func (db *SQLxDocumentDB) UpdateUser(userID, permissions string) error {
-	tx := db.conn.MustBegin()
-	defer tx.Commit()
-	tx.MustExec(rebindQuery("UPDATE ZwibblerTokens SET permissions=? WHERE userID=?"), userID, permissions)
-	return nil
+	return db.UpdateUserContext(context.Background(), userID, permissions)
+}
+
+// UpdateUserContext ...
+func (db *SQLxDocumentDB) UpdateUserContext(ctx context.Context, userID, permissions string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	_, err := db.conn.ExecContext(ctx, db.query("UPDATE ZwibblerTokens SET permissions=? WHERE userID=?"), permissions, userID)
+	return err
 }
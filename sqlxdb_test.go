@@ -0,0 +1,140 @@
+package zwibserve
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLiteConcurrentAppend(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		chunked := chunked
+		t.Run(fmt.Sprintf("chunked=%v", chunked), func(t *testing.T) {
+			db, err := NewSQLiteDBWithOptions(SQLiteOptions{
+				SQLOptions: SQLOptions{MaxOpenConns: 4, ChunkedStorage: chunked},
+				Filename:   filepath.Join(tempDir(t), "test.db"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			testConcurrentAppend(t, db)
+		})
+	}
+}
+
+// tempDir returns a directory which is removed when the test finishes.
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "zwibserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestPostgreSQLConcurrentAppend(t *testing.T) {
+	dsn := os.Getenv("ZWIBSERVE_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("ZWIBSERVE_POSTGRES_DSN is not set")
+	}
+	db, err := NewPostgreSQLConnectionWithOptions(PostgreSQLOptions{
+		SQLOptions: SQLOptions{MaxOpenConns: 4},
+		DSN:        dsn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testConcurrentAppend(t, db)
+}
+
+func TestMySQLConcurrentAppend(t *testing.T) {
+	dsn := os.Getenv("ZWIBSERVE_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("ZWIBSERVE_MYSQL_DSN is not set")
+	}
+	db, err := NewMySQLConnectionWithOptions(MySQLOptions{
+		SQLOptions: SQLOptions{MaxOpenConns: 4},
+		DSN:        dsn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testConcurrentAppend(t, db)
+}
+
+// testConcurrentAppend has several writers append records to one document,
+// retrying on conflicts, and checks that every record was written exactly once
+// and was not split by another writer's record.
+func testConcurrentAppend(t *testing.T, db DocumentDB) {
+	const writers = 8
+	const appends = 20
+
+	docID := fmt.Sprintf("concurrent-%d", time.Now().UnixNano())
+	if _, _, err := db.GetDocument(docID, AlwaysCreate, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteDocument(docID)
+
+	record := func(writer, i int) []byte {
+		return []byte(fmt.Sprintf("[%02d:%02d]", writer, i))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				for {
+					doc, _, err := db.GetDocument(docID, NeverCreate, nil)
+					if err != nil {
+						errs <- err
+						return
+					}
+					_, err = db.AppendDocument(docID, uint64(len(doc)), record(w, i))
+					if err == nil {
+						break
+					} else if err != ErrConflict {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	doc, _, err := db.GetDocument(docID, NeverCreate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(record(0, 0))
+	if len(doc) != writers*appends*size {
+		t.Fatalf("document has %d bytes, want %d", len(doc), writers*appends*size)
+	}
+
+	next := make([]int, writers)
+	for offset := 0; offset < len(doc); offset += size {
+		var w, i int
+		if _, err := fmt.Sscanf(string(doc[offset:offset+size]), "[%02d:%02d]", &w, &i); err != nil {
+			t.Fatalf("bad record at %d: %q", offset, doc[offset:offset+size])
+		}
+		if w >= writers || !bytes.Equal(doc[offset:offset+size], record(w, next[w])) {
+			t.Fatalf("record %q at %d is out of order", doc[offset:offset+size], offset)
+		}
+		next[w]++
+	}
+}
@@ -21,6 +21,12 @@ type StressTestArgs struct {
 	// The document to connect to
 	DocumentID string
 
+	// The number of documents. If more than one, the teachers and the students
+	// are each divided evenly among documents named DocumentID-0, DocumentID-1,
+	// etc., to measure throughput with many concurrent sessions. It is reduced
+	// to NumTeachers, so that every document has a teacher. Default: 1
+	NumDocuments int
+
 	// The number of clients which are modifying the document
 	NumTeachers int
 
@@ -60,6 +66,8 @@ type stressTestArgs struct {
 	numConnected int
 	maxPingTimes int // number of ping times to include in average
 	docLength    int64
+	numReceived  int64 // appends received by all clients
+	startTime    time.Time
 }
 
 func (args *stressTestArgs) recordPingTime(value int64, docLength int64) {
@@ -79,6 +87,7 @@ func (args *stressTestArgs) recordPingTime(value int64, docLength int64) {
 		args.maxTime = fv
 	}
 	args.numSamples += 1.0
+	args.numReceived++
 	args.pingTime = args.pingTime*((args.numSamples-1)/args.numSamples) + fv/args.numSamples
 
 	args.showStats()
@@ -98,11 +107,12 @@ func (args *stressTestArgs) showStats() {
 	}
 	args.lastShowTime = time.Now()
 
-	str := fmt.Sprintf("Connections=%d docLength=%d Screen-to-screen time avg=%dms min=%dms max=%dms      ",
+	str := fmt.Sprintf("Connections=%d docLength=%d Screen-to-screen time avg=%dms min=%dms max=%dms Received=%d/s      ",
 		args.numConnected,
 		args.docLength,
 		int(args.pingTime),
-		int(args.minTime), int(args.maxTime))
+		int(args.minTime), int(args.maxTime),
+		int(float64(args.numReceived)/time.Since(args.startTime).Seconds()))
 
 	if args.Verbose {
 		log.Print(str)
@@ -114,7 +124,7 @@ func (args *stressTestArgs) showStats() {
 // RunStressTest runs a stress test against another server. The test continues
 // forever, or until you quit the process.
 func RunStressTest(argsIn StressTestArgs) {
-	args := &stressTestArgs{StressTestArgs: argsIn}
+	args := &stressTestArgs{StressTestArgs: argsIn, startTime: time.Now()}
 	if args.ChangeLength <= 0 {
 		args.ChangeLength = defaultChangeLength
 	} else if args.ChangeLength < 8 {
@@ -125,20 +135,25 @@ func RunStressTest(argsIn StressTestArgs) {
 		args.DelayMS = 1000
 	}
 
+	if args.NumDocuments > args.NumTeachers && args.NumTeachers > 0 {
+		log.Printf("Using %d documents, one for each teacher", args.NumTeachers)
+		args.NumDocuments = args.NumTeachers
+	}
+
 	// try to smooth the average over five seconds
 	args.maxPingTimes = (args.NumTeachers + args.NumStudents) * 5
 
 	id := 1
 	for i := 0; i < args.NumStudents; i++ {
 		args.wg.Add(1)
-		go abortOnError(args, id, studentClient)
+		go abortOnError(args, id, args.documentID(i), studentClient)
 
 		id++
 	}
 
 	for i := 0; i < args.NumTeachers; i++ {
 		args.wg.Add(1)
-		go abortOnError(args, id, teacherClient)
+		go abortOnError(args, id, args.documentID(i), teacherClient)
 
 		id++
 	}
@@ -152,14 +167,22 @@ func RunStressTest(argsIn StressTestArgs) {
 	args.wg.Wait()
 }
 
-func abortOnError(args *stressTestArgs, clientID int, fn func(args *stressTestArgs, clientID int)) {
+func abortOnError(args *stressTestArgs, clientID int, docID string, fn func(args *stressTestArgs, clientID int, docID string)) {
 	defer func() {
 		err := recover()
 		if err != nil {
 			args.abort = true
 		}
 	}()
-	fn(args, clientID)
+	fn(args, clientID, docID)
+}
+
+// documentID returns the document that the nth teacher or student connects to.
+func (args *stressTestArgs) documentID(n int) string {
+	if args.NumDocuments <= 1 {
+		return args.DocumentID
+	}
+	return fmt.Sprintf("%s-%d", args.DocumentID, n%args.NumDocuments)
 }
 
 func connect(args *stressTestArgs, clientID int) *websocket.Conn {
@@ -200,13 +223,13 @@ func readStressMessage(conn *websocket.Conn) []uint8 {
 	return message
 }
 
-func studentClient(args *stressTestArgs, clientID int) {
+func studentClient(args *stressTestArgs, clientID int, docID string) {
 	defer args.wg.Done()
 	conn := connect(args, clientID)
 	defer conn.Close()
 	args.recordConnection()
 
-	sendConnectMessage(conn, args.DocumentID)
+	sendConnectMessage(conn, docID)
 	first := true
 
 	for !args.abort {
@@ -247,14 +270,14 @@ func sendConnectMessage(conn *websocket.Conn, docID string) {
 	})
 }
 
-func teacherClient(args *stressTestArgs, clientID int) {
+func teacherClient(args *stressTestArgs, clientID int, docID string) {
 	defer args.wg.Done()
 	conn := connect(args, clientID)
 	defer conn.Close()
 	args.recordConnection()
 
 	nextChar := 'A'
-	sendConnectMessage(conn, args.DocumentID)
+	sendConnectMessage(conn, docID)
 
 	// wait for initial append
 	m := readAppendMessage(conn)
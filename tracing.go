@@ -0,0 +1,199 @@
+package zwibserve
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpanData describes a completed, timed operation in the server. The
+// trace and span identifiers follow the W3C Trace Context format, so that
+// spans can be joined with those of the web application that made the
+// connection using the traceparent header.
+type SpanData struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes []LogField
+	Err        error
+}
+
+// Duration returns the length of the span.
+func (s SpanData) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// SpanExporter receives spans when they are completed. Implement it to
+// send spans to your tracing system, eg. by converting them to OpenTelemetry.
+// ExportSpan may be called from many goroutines at once.
+type SpanExporter interface {
+	ExportSpan(span SpanData)
+}
+
+// SpanRecorder is a SpanExporter that keeps spans in memory. It is
+// intended for tests.
+type SpanRecorder struct {
+	mutex sync.Mutex
+	spans []SpanData
+}
+
+// NewSpanRecorder returns an empty SpanRecorder.
+func NewSpanRecorder() *SpanRecorder {
+	return &SpanRecorder{}
+}
+
+// ExportSpan records the span.
+func (r *SpanRecorder) ExportSpan(span SpanData) {
+	r.mutex.Lock()
+	r.spans = append(r.spans, span)
+	r.mutex.Unlock()
+}
+
+// Spans returns a copy of the recorded spans, in order of completion.
+func (r *SpanRecorder) Spans() []SpanData {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]SpanData{}, r.spans...)
+}
+
+// Reset removes all recorded spans.
+func (r *SpanRecorder) Reset() {
+	r.mutex.Lock()
+	r.spans = nil
+	r.mutex.Unlock()
+}
+
+// SetSpanExporter enables tracing of client messages, hub operations, database calls
+// and webhooks. Completed spans are passed to the exporter. Pass nil to disable tracing,
+// which is the default.
+func (zh *Handler) SetSpanExporter(exporter SpanExporter) {
+	zh.hub.tracer.setExporter(exporter)
+}
+
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+type spanContextKey struct{}
+
+type tracer struct {
+	exporter atomic.Value // holds exporterHolder
+}
+
+type exporterHolder struct {
+	SpanExporter
+}
+
+func newTracer() *tracer {
+	t := &tracer{}
+	t.setExporter(nil)
+	return t
+}
+
+func (t *tracer) setExporter(exporter SpanExporter) {
+	t.exporter.Store(exporterHolder{exporter})
+}
+
+func (t *tracer) enabled() bool {
+	return t != nil && t.exporter.Load().(exporterHolder).SpanExporter != nil
+}
+
+// span is an operation in progress. A nil span is valid and does nothing,
+// which is what is returned when tracing is disabled.
+type span struct {
+	tracer *tracer
+	data   SpanData
+}
+
+// start begins a span that is a child of the span in ctx, if any. It returns a
+// context containing the new span.
+func (t *tracer) start(ctx context.Context, name string, attrs ...LogField) (context.Context, *span) {
+	if !t.enabled() {
+		return ctx, nil
+	}
+
+	s := &span{
+		tracer: t,
+		data: SpanData{
+			SpanID:     randomHex(8),
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: attrs,
+		},
+	}
+
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		s.data.TraceID = parent.traceID
+		s.data.ParentID = parent.spanID
+	} else {
+		s.data.TraceID = randomHex(16)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, spanContext{s.data.TraceID, s.data.SpanID}), s
+}
+
+func (s *span) setAttributes(attrs ...LogField) {
+	if s != nil {
+		s.data.Attributes = append(s.data.Attributes, attrs...)
+	}
+}
+
+// setError marks the span as failed.
+func (s *span) setError(err error) {
+	if s != nil && err != nil {
+		s.data.Err = err
+	}
+}
+
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.data.End = time.Now()
+	if exporter := s.tracer.exporter.Load().(exporterHolder).SpanExporter; exporter != nil {
+		exporter.ExportSpan(s.data)
+	}
+}
+
+// extract returns a context containing the trace parent given in the
+// W3C traceparent header of the request, if present. The context is not
+// derived from the request, because it must outlive it when the
+// connection is upgraded to a websocket.
+func (t *tracer) extract(r *http.Request) context.Context {
+	ctx := context.Background()
+	if !t.enabled() {
+		return ctx
+	}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("traceparent")), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 ||
+		!isHex(parts[1]) || !isHex(parts[2]) {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, spanContext{
+		traceID: strings.ToLower(parts[1]),
+		spanID:  strings.ToLower(parts[2]),
+	})
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.Trim(s, "0") != ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
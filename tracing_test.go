@@ -0,0 +1,112 @@
+package zwibserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readUntilType reads messages until one of the given type arrives.
+func readUntilType(t *testing.T, conn *websocket.Conn, messageType byte) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			t.Fatalf("waiting for message type %x: %v", messageType, err)
+		}
+		if msg[0] == messageType {
+			return msg
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	const traceID = "0af7651916cd43dd8448eb211c80319c"
+	const parentID = "b7ad6b7169203331"
+
+	recorder := NewSpanRecorder()
+	zh := NewHandler(NewMemoryDB())
+	zh.SetLogger(NewStdLogger(LogError))
+	zh.SetSpanExporter(recorder)
+	server := httptest.NewServer(zh)
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sendConnectMessage(conn, "traced")
+	readUntilType(t, conn, appendV2MessageType)
+
+	sendStressMessage(conn, appendMessageV2{MessageType: appendV2MessageType, Offset: 0, Data: []byte("hello")})
+	readUntilType(t, conn, ackNackMessageType)
+
+	sendStressMessage(conn, setKeyMessage{
+		MessageType: setKeyMessageType,
+		Lifetime:    0x01, // session
+		NewVersion:  1,
+		NameLength:  4,
+		Name:        "name",
+		ValueLength: 5,
+		Value:       "value",
+	})
+	readUntilType(t, conn, setKeyAckNackMessageType)
+
+	sendStressMessage(conn, broadcastMessage{MessageType: broadcastMessageType, Data: []byte("hi")})
+
+	// the hub spans end in the hub's goroutine, after the client has its reply.
+	byName := make(map[string]SpanData)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, span := range recorder.Spans() {
+			byName[span.Name] = span
+		}
+		if _, ok := byName["hub.Broadcast"]; ok {
+			if _, ok := byName["hub.SetSessionKey"]; ok {
+				break
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		parent string
+	}{
+		{"processInitMessage", ""},
+		{"DocumentDB.GetDocument", "processInitMessage"},
+		{"processAppend", ""},
+		{"DocumentDB.AppendDocument", "processAppend"},
+		{"hub.Append", "processAppend"},
+		{"processSetKey", ""},
+		{"DocumentDB.SetDocumentKey", "processSetKey"},
+		{"hub.SetSessionKey", "processSetKey"},
+		{"processBroadcast", ""},
+		{"hub.Broadcast", "processBroadcast"},
+	}
+
+	for _, test := range tests {
+		span, ok := byName[test.name]
+		if !ok {
+			t.Errorf("no %s span", test.name)
+			continue
+		}
+		if span.TraceID != traceID {
+			t.Errorf("%s has trace %s, want %s from the traceparent header", test.name, span.TraceID, traceID)
+		}
+		wantParent := parentID
+		if test.parent != "" {
+			wantParent = byName[test.parent].SpanID
+		}
+		if span.ParentID != wantParent {
+			t.Errorf("%s has parent %s, want %s", test.name, span.ParentID, wantParent)
+		}
+	}
+}
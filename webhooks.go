@@ -2,7 +2,7 @@ package zwibserve
 
 import (
 	"context"
-	"log"
+	"errors"
 	"sync"
 	"time"
 )
@@ -17,14 +17,25 @@ type webhookEvent struct {
 }
 
 type webhookQueue struct {
-	events []webhookEvent
-	mutex  sync.Mutex
-	cancel func()
+	events  []webhookEvent
+	mutex   sync.Mutex
+	cancel  func()
+	metrics *metrics
+	log     *logger
+	tracer  *tracer
+	stop    chan struct{}
+
+	// deliveries started by the queue, which flush waits for
+	deliveries sync.WaitGroup
 }
 
-func createWebhookQueue() *webhookQueue {
+func createWebhookQueue(m *metrics, l *logger, t *tracer) *webhookQueue {
 	whq := &webhookQueue{
-		cancel: func() {},
+		cancel:  func() {},
+		metrics: m,
+		log:     l,
+		tracer:  t,
+		stop:    make(chan struct{}),
 	}
 
 	go func() {
@@ -43,7 +54,11 @@ func createWebhookQueue() *webhookQueue {
 			for i := range whq.events {
 				item := whq.events[i]
 				if item.sendBy.Before(now) {
-					go item.send()
+					whq.deliveries.Add(1)
+					go func(item webhookEvent) {
+						defer whq.deliveries.Done()
+						whq.deliver(item)
+					}(item)
 					removed++
 					continue
 				} else if item.sendBy.Before(at) {
@@ -62,6 +77,9 @@ func createWebhookQueue() *webhookQueue {
 			select {
 			case <-ctx.Done():
 			case <-time.After(at.Sub(now)):
+			case <-whq.stop:
+				cancel()
+				return
 			}
 		}
 	}()
@@ -77,7 +95,7 @@ func (whq *webhookQueue) removeIf(fn func(event webhookEvent) bool) {
 	for i := range whq.events {
 		if fn(whq.events[i]) {
 			removed++
-			log.Printf("Remove queued webhook %s/%s", whq.events[i].name, whq.events[i].documentID)
+			whq.log.debug("remove queued webhook", field("event", whq.events[i].name), field(fieldDocument, whq.events[i].documentID))
 		} else if removed > 0 {
 			whq.events[i-removed] = whq.events[i]
 		}
@@ -89,14 +107,63 @@ func (whq *webhookQueue) removeIf(fn func(event webhookEvent) bool) {
 func (whq *webhookQueue) add(event webhookEvent) {
 	whq.mutex.Lock()
 	defer whq.mutex.Unlock()
-	log.Printf("Queue webhook %s/%s", event.name, event.documentID)
+	whq.log.debug("queue webhook", field("event", event.name), field(fieldDocument, event.documentID))
 	whq.events = append(whq.events, event)
 	whq.cancel()
 }
 
-func (event webhookEvent) send() {
+// flush immediately delivers all queued events, and stops the queue. It returns
+// when they and any deliveries already in progress have finished, or the
+// context is done.
+func (whq *webhookQueue) flush(ctx context.Context) error {
+	whq.mutex.Lock()
+	events := whq.events
+	whq.events = nil
+	close(whq.stop)
+	whq.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, event := range events {
+		wg.Add(1)
+		go func(event webhookEvent) {
+			defer wg.Done()
+			whq.deliver(event)
+		}(event)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		whq.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver sends the event and records the outcome.
+func (whq *webhookQueue) deliver(event webhookEvent) {
+	_, span := whq.tracer.start(context.Background(), "webhook", field("event", event.name),
+		field(fieldDocument, event.documentID))
+	defer span.end()
+
+	if event.send(whq.log) {
+		whq.metrics.inc("zwibserve_webhooks_total", event.name, "success")
+	} else {
+		span.setError(errors.New("webhook delivery failed"))
+		whq.metrics.inc("zwibserve_webhooks_total", event.name, "failure")
+	}
+}
+
+// send posts the event to the webhook url, and returns true if it succeeded.
+func (event webhookEvent) send(l *logger) bool {
 	var reply string
-	result := MakeHTTPRequest(HTTPRequestArgs{
+	result := makeHTTPRequest(l, HTTPRequestArgs{
 		Method: "POST",
 		URI:    event.url,
 		Data: map[string]interface{}{
@@ -107,6 +174,13 @@ func (event webhookEvent) send() {
 		Password: event.password,
 	}, &reply)
 
-	log.Printf("%s/%s to %s: HTTP Status=%v Error=%v", event.name, event.documentID, event.url,
-		result.StatusCode, result.Err)
+	ok := result.Err == nil && result.StatusCode >= 200 && result.StatusCode < 300
+	level := LogInfo
+	if !ok {
+		level = LogWarn
+	}
+	l.Log(level, "webhook delivered", field("event", event.name), field(fieldDocument, event.documentID),
+		field("url", event.url), field("status", result.StatusCode), field(fieldError, result.Err))
+
+	return ok
 }
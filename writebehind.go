@@ -0,0 +1,708 @@
+package zwibserve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// WriteBehindOptions configures a WriteBehindDB.
+type WriteBehindOptions struct {
+	// How often appended data is written to the underlying database.
+	// Default: 1 second
+	FlushInterval time.Duration
+
+	// If a document has more than this many bytes waiting to be written, it is
+	// flushed without waiting for the interval. Default: 1 MB
+	MaxPendingBytes int
+
+	// If set, each append is recorded in this file before it is acknowledged,
+	// and any appends that were not written to the underlying database are
+	// recovered from it when the WriteBehindDB is created. If they cannot be
+	// written, NewWriteBehindDB fails and the journal is kept. Without a journal,
+	// up to FlushInterval of changes are lost if the process exits without
+	// calling Close.
+	JournalPath string
+
+	// If true, the journal is synced to disk before each append is acknowledged,
+	// so that changes survive the loss of power as well as a crash of the process.
+	// This is much slower.
+	SyncJournal bool
+
+	// Appends that were acknowledged but can never be written, because the
+	// document was changed by another writer or expired, are saved in this file
+	// for an operator, in the format read by ReadWriteBehindJournal. If they
+	// cannot be saved, they are kept and retried. Default: JournalPath with
+	// ".rejected" added, or no file if there is no journal.
+	RejectedPath string
+}
+
+// WriteBehindDB wraps another DocumentDB, so that appends are acknowledged
+// immediately and written to it in batches. It keeps the length of each
+// document being changed in memory, so it must be the only writer to the
+// underlying database. Do not use it with multiple servers sharing a database.
+type WriteBehindDB struct {
+	db      DocumentDB
+	cdb     ContextDocumentDB
+	options WriteBehindOptions
+	log     *logger
+
+	mutex   sync.Mutex
+	docs    map[string]*writeBehindDoc
+	journal *os.File
+	closed  bool
+
+	// the error from the last failed flush, for CheckHealth.
+	flushErr error
+
+	// only one flush runs at a time
+	flushMutex sync.Mutex
+
+	wakeup chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// writeBehindDoc holds the appends to a document that have not been written.
+type writeBehindDoc struct {
+	// length in the underlying database
+	flushed uint64
+
+	// data after flushed
+	pending []byte
+
+	// the number of appends in pending, and the last of them
+	appends    int64
+	lastWriter string
+	modified   time.Time
+
+	lastAccess time.Time
+}
+
+func (doc *writeBehindDoc) length() uint64 {
+	return doc.flushed + uint64(len(doc.pending))
+}
+
+// Documents with nothing to write are forgotten after this time without appends.
+const writeBehindIdleTime = time.Minute
+
+// NewWriteBehindDB returns a DocumentDB that batches appends to db. If a journal
+// is configured, appends recorded in it are first written to db.
+func NewWriteBehindDB(db DocumentDB, options WriteBehindOptions) (*WriteBehindDB, error) {
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = time.Second
+	}
+	if options.MaxPendingBytes <= 0 {
+		options.MaxPendingBytes = 1024 * 1024
+	}
+	if options.RejectedPath == "" && options.JournalPath != "" {
+		options.RejectedPath = options.JournalPath + ".rejected"
+	}
+
+	wb := &WriteBehindDB{
+		db:      db,
+		cdb:     WithContext(db),
+		options: options,
+		log:     newLogger(nil),
+		docs:    make(map[string]*writeBehindDoc),
+		wakeup:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if options.JournalPath != "" {
+		if err := wb.recover(); err != nil {
+			return nil, err
+		}
+
+		journal, err := os.OpenFile(options.JournalPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		wb.journal = journal
+	}
+
+	go wb.flushThread()
+	return wb, nil
+}
+
+// ListDocuments lists the documents of the underlying database.
+func (wb *WriteBehindDB) ListDocuments(ctx context.Context, fn func(docID string) error) error {
+	lister, ok := wb.db.(DocumentLister)
+	if !ok {
+		return errListUnsupported
+	}
+	return lister.ListDocuments(ctx, fn)
+}
+
+// ListTokens lists the tokens of the underlying database.
+func (wb *WriteBehindDB) ListTokens(ctx context.Context, fn func(token TokenInfo) error) error {
+	lister, ok := wb.db.(TokenLister)
+	if !ok {
+		return errListUnsupported
+	}
+	return lister.ListTokens(ctx, fn)
+}
+
+// GetDocumentInfo returns the information recorded by the underlying
+// database, including the appends that have not been written to it yet.
+// Appends that were written together are counted separately.
+func (wb *WriteBehindDB) GetDocumentInfo(ctx context.Context, docID string) (DocumentInfo, error) {
+	provider, ok := wb.db.(DocumentInfoProvider)
+	if !ok {
+		return DocumentInfo{}, errInfoUnsupported
+	}
+
+	// A flush would change both the underlying database and the pending appends.
+	wb.flushMutex.Lock()
+	defer wb.flushMutex.Unlock()
+
+	info, err := provider.GetDocumentInfo(ctx, docID)
+	if err != nil {
+		return info, err
+	}
+
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	if doc := wb.docs[docID]; doc != nil {
+		info.Length = doc.length()
+		if doc.appends > 0 {
+			info.Appends += doc.appends
+			info.LastWriter = doc.lastWriter
+			info.Modified = doc.modified
+		}
+	}
+	return info, nil
+}
+
+// SetArchive sets the archive of the underlying database.
+func (wb *WriteBehindDB) SetArchive(archive Archive) {
+	if setter, ok := wb.db.(archiveSetter); ok {
+		setter.SetArchive(archive)
+	}
+}
+
+// InvalidateDocument passes the notification to the underlying database, if
+// it caches documents.
+func (wb *WriteBehindDB) InvalidateDocument(docID string) {
+	if invalidator, ok := wb.db.(DocumentInvalidator); ok {
+		invalidator.InvalidateDocument(docID)
+	}
+}
+
+// SetLogger sets the destination of log messages.
+func (wb *WriteBehindDB) SetLogger(l Logger) {
+	wb.log.setOutput(l)
+	if setter, ok := wb.db.(loggerSetter); ok {
+		setter.SetLogger(l)
+	}
+}
+
+// recover writes the appends in the journal which are not in the database.
+func (wb *WriteBehindDB) recover() error {
+	f, err := os.Open(wb.options.JournalPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	recovered := 0
+	for {
+		docID, offset, data, err := readJournalRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// a partial record is written when the process dies in the middle of an append.
+			wb.log.warn("journal ends with incomplete record", field(fieldError, err))
+			break
+		}
+
+		err = wb.recoverAppend(docID, offset, data)
+		if err == ErrConflict || err == ErrMissing {
+			// Someone else changed the document, or it expired. The append
+			// can never be written.
+			if rerr := wb.reject(docID, offset, data, err); rerr != nil {
+				return rerr
+			}
+			continue
+		} else if err != nil {
+			// The database may be unavailable. Keep the journal, so that the
+			// appends are recovered when the WriteBehindDB is created again.
+			wb.log.error("cannot recover append from journal", field(fieldDocument, docID),
+				field("offset", offset), field(fieldError, err))
+			return err
+		}
+		recovered++
+	}
+
+	if recovered > 0 {
+		wb.log.info("recovered appends from journal", field("appends", recovered))
+	}
+	return nil
+}
+
+func (wb *WriteBehindDB) recoverAppend(docID string, offset uint64, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	doc, _, err := wb.db.GetDocument(docID, NeverCreate, nil)
+	if err != nil {
+		return err
+	}
+
+	length := uint64(len(doc))
+	if end := offset + uint64(len(data)); end <= length {
+		if bytes.Equal(doc[offset:end], data) {
+			// already written
+			return nil
+		}
+		return ErrConflict
+	} else if offset != length {
+		return ErrConflict
+	}
+
+	_, err = wb.db.AppendDocument(docID, offset, data)
+	return err
+}
+
+// reject saves appends that can never be written in the rejected file. If
+// there is none, they are only logged.
+func (wb *WriteBehindDB) reject(docID string, offset uint64, data []byte, reason error) error {
+	fields := []LogField{field(fieldDocument, docID), field("offset", offset),
+		field("bytes", len(data)), field(fieldError, reason)}
+	if wb.options.RejectedPath == "" {
+		wb.log.error("discarding unwritten appends", fields...)
+		return nil
+	}
+
+	f, err := os.OpenFile(wb.options.RejectedPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		err = writeJournalRecord(f, docID, offset, data)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		wb.log.error("cannot save unwritten appends", append(fields, field("saveError", err))...)
+		return err
+	}
+
+	wb.log.error("saved unwritten appends", append(fields, field("file", wb.options.RejectedPath))...)
+	return nil
+}
+
+// ReadWriteBehindJournal calls fn with each append recorded in the journal or
+// rejected file of a WriteBehindDB, so that an operator can recover them. An
+// incomplete record at the end of the file is ignored.
+func ReadWriteBehindJournal(path string, fn func(docID string, offset uint64, data []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		docID, offset, data, err := readJournalRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(docID, offset, data); err != nil {
+			return err
+		}
+	}
+}
+
+// journal records are: docID length (4 bytes), docID, offset (8 bytes),
+// data length (4 bytes), data.
+func writeJournalRecord(w io.Writer, docID string, offset uint64, data []byte) error {
+	buf := make([]byte, 16+len(docID)+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(docID)))
+	n := 4 + copy(buf[4:], docID)
+	binary.BigEndian.PutUint64(buf[n:], offset)
+	binary.BigEndian.PutUint32(buf[n+8:], uint32(len(data)))
+	copy(buf[n+12:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readJournalRecord(r io.Reader) (docID string, offset uint64, data []byte, err error) {
+	var length uint32
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return
+	}
+
+	id := make([]byte, length)
+	if _, err = io.ReadFull(r, id); err != nil {
+		return
+	}
+	docID = string(id)
+
+	if err = binary.Read(r, binary.BigEndian, &offset); err != nil {
+		return
+	}
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return
+	}
+
+	data = make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// flushThread writes pending appends periodically, or when woken up.
+func (wb *WriteBehindDB) flushThread() {
+	defer close(wb.done)
+	ticker := time.NewTicker(wb.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-wb.wakeup:
+		case <-wb.stop:
+			wb.Flush()
+			return
+		}
+		wb.Flush()
+	}
+}
+
+// Flush writes all pending appends to the underlying database. It returns the
+// first error that occurred. Documents that could not be written are retried
+// on the next flush, unless another writer changed them or they expired, in
+// which case the appends are moved to the rejected file.
+func (wb *WriteBehindDB) Flush() error {
+	type batch struct {
+		docID   string
+		offset  uint64
+		data    []byte
+		appends int64
+		writer  string
+		written bool
+		discard bool
+	}
+
+	wb.flushMutex.Lock()
+	defer wb.flushMutex.Unlock()
+
+	wb.mutex.Lock()
+	var batches []*batch
+	for docID, doc := range wb.docs {
+		if len(doc.pending) > 0 {
+			batches = append(batches, &batch{docID: docID, offset: doc.flushed, data: doc.pending,
+				appends: doc.appends, writer: doc.lastWriter})
+		} else if time.Since(doc.lastAccess) > writeBehindIdleTime {
+			delete(wb.docs, docID)
+		}
+	}
+	wb.mutex.Unlock()
+
+	var result error
+	for _, b := range batches {
+		err := wb.write(b.docID, b.offset, b.data, b.writer)
+		if err == nil {
+			b.written = true
+		} else if err == ErrConflict || err == ErrMissing {
+			// Someone else changed the document, or it expired. The pending
+			// changes cannot be written.
+			rejectErr := fmt.Errorf("appends to %s rejected: %v", b.docID, err)
+			if serr := wb.reject(b.docID, b.offset, b.data, err); serr != nil {
+				rejectErr = serr
+			} else {
+				b.discard = true
+			}
+			if result == nil {
+				result = rejectErr
+			}
+		} else {
+			wb.log.warn("cannot write appends", field(fieldDocument, b.docID), field(fieldError, err))
+			if result == nil {
+				result = err
+			}
+		}
+	}
+
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	for _, b := range batches {
+		doc := wb.docs[b.docID]
+		if b.discard && doc != nil && doc.flushed == b.offset {
+			delete(wb.docs, b.docID)
+			continue
+		}
+		if !b.written || doc == nil || doc.flushed != b.offset {
+			// failed, or the document was deleted or replaced while writing.
+			continue
+		}
+
+		doc.flushed += uint64(len(b.data))
+		doc.pending = append([]byte(nil), doc.pending[len(b.data):]...)
+		doc.appends -= b.appends
+	}
+	wb.flushErr = result
+
+	// when nothing is pending, the journal is no longer needed.
+	if wb.journal != nil && wb.pendingBytes() == 0 {
+		if err := wb.journal.Truncate(0); err == nil {
+			wb.journal.Seek(0, io.SeekStart)
+		} else {
+			wb.log.warn("cannot truncate journal", field(fieldError, err))
+		}
+	}
+
+	return result
+}
+
+// write appends the data to the underlying database as the last writer,
+// converting panics to errors.
+func (wb *WriteBehindDB) write(docID string, offset uint64, data []byte, writer string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	_, err = wb.cdb.AppendDocumentContext(WithUserID(context.Background(), writer), docID, offset, data)
+	return err
+}
+
+// pendingBytes returns the total size of appends not yet written. The mutex must be held.
+func (wb *WriteBehindDB) pendingBytes() int {
+	total := 0
+	for _, doc := range wb.docs {
+		total += len(doc.pending)
+	}
+	return total
+}
+
+// Close writes all pending appends, and closes the journal and the underlying
+// database, if it implements io.Closer.
+func (wb *WriteBehindDB) Close() error {
+	wb.mutex.Lock()
+	if wb.closed {
+		wb.mutex.Unlock()
+		return nil
+	}
+	wb.closed = true
+	wb.mutex.Unlock()
+
+	close(wb.stop)
+	<-wb.done
+
+	wb.mutex.Lock()
+	err := wb.flushErr
+	if wb.journal != nil {
+		wb.journal.Close()
+	}
+	wb.mutex.Unlock()
+
+	if closer, ok := wb.db.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// GetDocument ...
+func (wb *WriteBehindDB) GetDocument(docID string, mode CreateMode, initialData []byte) ([]byte, bool, error) {
+	return wb.getDocumentByUser(docID, mode, initialData, "")
+}
+
+func (wb *WriteBehindDB) getDocumentByUser(docID string, mode CreateMode, initialData []byte, userID string) ([]byte, bool, error) {
+	wb.mutex.Lock()
+	_, pending := wb.docs[docID]
+	wb.mutex.Unlock()
+
+	if !pending {
+		if userID == "" {
+			return wb.db.GetDocument(docID, mode, initialData)
+		}
+		return wb.cdb.GetDocumentContext(WithUserID(context.Background(), userID), docID, mode, initialData)
+	}
+
+	if mode == AlwaysCreate {
+		return nil, false, ErrExists
+	}
+
+	for attempt := 0; ; attempt++ {
+		data, _, err := wb.db.GetDocument(docID, NeverCreate, nil)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if result, ok := wb.withPending(docID, data); ok {
+			return result, false, nil
+		} else if attempt == writeBehindReadAttempts-1 {
+			return nil, false, errWriteBehindChanged
+		}
+	}
+}
+
+// A read is retried this many times when flushes complete while it reads.
+const writeBehindReadAttempts = 5
+
+var errWriteBehindChanged = errors.New("the document was changed by another writer")
+
+// withPending returns the data read from the underlying database followed by
+// the pending appends. It returns false if a flush completed while reading,
+// so the data does not match them.
+func (wb *WriteBehindDB) withPending(docID string, data []byte) ([]byte, bool) {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	doc := wb.docs[docID]
+	if doc == nil {
+		return data, true
+	}
+
+	length := uint64(len(data))
+	if length < doc.flushed || length > doc.length() {
+		return nil, false
+	}
+
+	result := make([]byte, 0, doc.length())
+	result = append(result, data...)
+	result = append(result, doc.pending[length-doc.flushed:]...)
+	return result, true
+}
+
+// AppendDocument records the append, and returns immediately. It is written
+// to the underlying database later.
+func (wb *WriteBehindDB) AppendDocument(docID string, oldLength uint64, newData []byte) (uint64, error) {
+	return wb.appendDocumentByUser(docID, oldLength, newData, "")
+}
+
+func (wb *WriteBehindDB) appendDocumentByUser(docID string, oldLength uint64, newData []byte, userID string) (uint64, error) {
+	wb.mutex.Lock()
+	doc := wb.docs[docID]
+	wb.mutex.Unlock()
+
+	if doc == nil {
+		// learn the length of the document
+		data, _, err := wb.db.GetDocument(docID, NeverCreate, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		wb.mutex.Lock()
+		if wb.docs[docID] == nil {
+			wb.docs[docID] = &writeBehindDoc{flushed: uint64(len(data))}
+		}
+		wb.mutex.Unlock()
+	}
+
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+
+	if wb.closed {
+		return 0, errors.New("database is closed")
+	}
+
+	doc = wb.docs[docID]
+	if doc == nil {
+		// deleted in the meantime
+		return 0, ErrMissing
+	}
+
+	if doc.length() != oldLength {
+		return doc.length(), ErrConflict
+	}
+
+	if wb.journal != nil {
+		err := writeJournalRecord(wb.journal, docID, oldLength, newData)
+		if err == nil && wb.options.SyncJournal {
+			err = wb.journal.Sync()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	doc.pending = append(doc.pending, newData...)
+	doc.lastAccess = time.Now()
+	if len(newData) > 0 {
+		doc.appends++
+		doc.lastWriter = userID
+		doc.modified = doc.lastAccess
+	}
+
+	if len(doc.pending) >= wb.options.MaxPendingBytes {
+		select {
+		case wb.wakeup <- struct{}{}:
+		default:
+		}
+	}
+
+	return doc.length(), nil
+}
+
+// SetDocumentKey ...
+func (wb *WriteBehindDB) SetDocumentKey(docID string, oldVersion int, key Key) error {
+	return wb.db.SetDocumentKey(docID, oldVersion, key)
+}
+
+// GetDocumentKeys ...
+func (wb *WriteBehindDB) GetDocumentKeys(docID string) ([]Key, error) {
+	return wb.db.GetDocumentKeys(docID)
+}
+
+// SetExpiration ...
+func (wb *WriteBehindDB) SetExpiration(seconds int64) {
+	wb.db.SetExpiration(seconds)
+}
+
+// DeleteDocument discards any pending appends and deletes the document.
+func (wb *WriteBehindDB) DeleteDocument(docID string) error {
+	wb.mutex.Lock()
+	delete(wb.docs, docID)
+	wb.mutex.Unlock()
+	return wb.db.DeleteDocument(docID)
+}
+
+// AddToken ...
+func (wb *WriteBehindDB) AddToken(token, docID, userID, permissions string, expirationSeconds int64, contents []byte) error {
+	return wb.db.AddToken(token, docID, userID, permissions, expirationSeconds, contents)
+}
+
+// GetToken ...
+func (wb *WriteBehindDB) GetToken(token string) (string, string, string, error) {
+	return wb.db.GetToken(token)
+}
+
+// UpdateUser ...
+func (wb *WriteBehindDB) UpdateUser(userID, permissions string) error {
+	return wb.db.UpdateUser(userID, permissions)
+}
+
+// CheckHealth fails if the underlying database does, or if the last attempt
+// to write to it failed.
+func (wb *WriteBehindDB) CheckHealth() error {
+	wb.mutex.Lock()
+	err := wb.flushErr
+	wb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return wb.db.CheckHealth()
+}
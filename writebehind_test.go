@@ -0,0 +1,239 @@
+package zwibserve
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps the messages logged at LogError.
+type recordingLogger struct {
+	mutex  sync.Mutex
+	errors []string
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if level == LogError {
+		l.mutex.Lock()
+		l.errors = append(l.errors, msg)
+		l.mutex.Unlock()
+	}
+}
+
+func (l *recordingLogger) logged(msg string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, m := range l.errors {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+type journalRecord struct {
+	docID  string
+	offset uint64
+	data   string
+}
+
+func readJournal(t *testing.T, path string) []journalRecord {
+	t.Helper()
+	var records []journalRecord
+	err := ReadWriteBehindJournal(path, func(docID string, offset uint64, data []byte) error {
+		records = append(records, journalRecord{docID, offset, string(data)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func mustGetDocument(t *testing.T, db DocumentDB, docID string) string {
+	t.Helper()
+	doc, _, err := db.GetDocument(docID, NeverCreate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(doc)
+}
+
+func TestWriteBehindJournalRecovery(t *testing.T) {
+	for _, syncJournal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sync=%v", syncJournal), func(t *testing.T) {
+			inner := NewMemoryDB()
+			options := WriteBehindOptions{
+				FlushInterval: time.Hour,
+				JournalPath:   filepath.Join(tempDir(t), "journal"),
+				SyncJournal:   syncJournal,
+			}
+
+			wb, err := NewWriteBehindDB(inner, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wb.SetLogger(NewStdLogger(LogError))
+			if _, _, err := wb.GetDocument("doc", AlwaysCreate, []byte("start:")); err != nil {
+				t.Fatal(err)
+			}
+			for i, data := range []string{"one,", "two,", "three"} {
+				length := uint64(len(mustGetDocument(t, wb, "doc")))
+				if _, err := wb.AppendDocument("doc", length, []byte(data)); err != nil {
+					t.Fatalf("append %d: %v", i, err)
+				}
+			}
+			if got := mustGetDocument(t, inner, "doc"); got != "start:" {
+				t.Fatalf("appends were written before the flush: %q", got)
+			}
+
+			// The process dies without calling Close, and the server restarts.
+			wb, err = NewWriteBehindDB(inner, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wb.Close()
+
+			if got := mustGetDocument(t, inner, "doc"); got != "start:one,two,three" {
+				t.Errorf("recovered document is %q", got)
+			}
+			if records := readJournal(t, options.JournalPath); len(records) != 0 {
+				t.Errorf("journal still has %v after recovery", records)
+			}
+		})
+	}
+}
+
+func TestWriteBehindRejectedOnRecovery(t *testing.T) {
+	inner := NewMemoryDB()
+	options := WriteBehindOptions{
+		FlushInterval: time.Hour,
+		JournalPath:   filepath.Join(tempDir(t), "journal"),
+	}
+
+	wb, err := NewWriteBehindDB(inner, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb.SetLogger(NewStdLogger(LogError))
+	if _, _, err := inner.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wb.AppendDocument("doc", 3, []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+
+	// another writer changes the document before the server restarts.
+	if _, err := inner.AppendDocument("doc", 3, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	wb, err = NewWriteBehindDB(inner, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wb.Close()
+
+	if got := mustGetDocument(t, inner, "doc"); got != "abcother" {
+		t.Errorf("document is %q", got)
+	}
+	want := []journalRecord{{"doc", 3, "lost"}}
+	if got := readJournal(t, options.JournalPath+".rejected"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rejected appends are %v, want %v", got, want)
+	}
+}
+
+func TestWriteBehindRejectedOnFlush(t *testing.T) {
+	inner := NewMemoryDB()
+	options := WriteBehindOptions{
+		FlushInterval: time.Hour,
+		RejectedPath:  filepath.Join(tempDir(t), "rejected"),
+	}
+	wb, err := NewWriteBehindDB(inner, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wb.Close()
+	log := &recordingLogger{}
+	wb.SetLogger(log)
+
+	if _, _, err := wb.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"de", "fg"} {
+		length := uint64(len(mustGetDocument(t, wb, "doc")))
+		if _, err := wb.AppendDocument("doc", length, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := inner.AppendDocument("doc", 3, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wb.Flush(); err == nil {
+		t.Error("Flush did not report the rejected appends")
+	}
+	if got := mustGetDocument(t, wb, "doc"); got != "abcother" {
+		t.Errorf("document is %q", got)
+	}
+	if !log.logged("saved unwritten appends") {
+		t.Error("rejected appends were not logged")
+	}
+	want := []journalRecord{{"doc", 3, "defg"}}
+	if got := readJournal(t, options.RejectedPath); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rejected appends are %v, want %v", got, want)
+	}
+
+	// later appends use the length in the underlying database.
+	if _, err := wb.AppendDocument("doc", 8, []byte("h")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGetDocument(t, inner, "doc"); got != "abcotherh" {
+		t.Errorf("document is %q", got)
+	}
+}
+
+func TestWriteBehindKeepsAppendsThatCannotBeSaved(t *testing.T) {
+	inner := NewMemoryDB()
+	wb, err := NewWriteBehindDB(inner, WriteBehindOptions{
+		FlushInterval: time.Hour,
+		RejectedPath:  filepath.Join(tempDir(t), "missing", "rejected"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wb.Close()
+	log := &recordingLogger{}
+	wb.SetLogger(log)
+
+	if _, _, err := wb.GetDocument("doc", AlwaysCreate, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wb.AppendDocument("doc", 3, []byte("de")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inner.AppendDocument("doc", 3, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wb.Flush(); err == nil {
+		t.Error("Flush succeeded")
+	}
+	if err := wb.CheckHealth(); err == nil {
+		t.Error("CheckHealth succeeded")
+	}
+	wb.mutex.Lock()
+	doc := wb.docs["doc"]
+	if doc == nil || string(doc.pending) != "de" {
+		t.Error("pending appends were discarded")
+	}
+	wb.mutex.Unlock()
+	if !log.logged("cannot save unwritten appends") {
+		t.Error("failure to save appends was not logged")
+	}
+}